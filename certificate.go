@@ -74,7 +74,7 @@ func UnmarshalAetherportCertificate(b []byte) (ac *AetherportCertificate, err er
 	ac = &AetherportCertificate{
 		Details: AetherportCertificateDetails{
 			Name:      acr.Details.Name,
-			Labels:    make([]label, len(acr.Details.Labels)),
+			Labels:    make([]label, 0, len(acr.Details.Labels)),
 			NotBefore: time.Unix(0, acr.Details.NotBefore),
 			NotAfter:  time.Unix(0, acr.Details.NotAfter),
 			PublicKey: make([]byte, len(acr.Details.PublicKey)),
@@ -120,7 +120,7 @@ func (ac *AetherportCertificate) Marshal() ([]byte, error) {
 func (ac *AetherportCertificate) getDetailsRaw() (dr *AetherportCertificateDetailsRaw, err error) {
 	dr = &AetherportCertificateDetailsRaw{
 		Name:      ac.Details.Name,
-		Labels:    make([]string, len(ac.Details.Labels)),
+		Labels:    make([]string, 0, len(ac.Details.Labels)),
 		NotBefore: ac.Details.NotBefore.UnixNano(),
 		NotAfter:  ac.Details.NotAfter.UnixNano(),
 		PublicKey: make([]byte, len(ac.Details.PublicKey)),
@@ -294,7 +294,7 @@ func (l *label) UnmarshalText(text []byte) error {
 		return fmt.Errorf("invalid labels: %x", text)
 	}
 
-	l.key = string(text[:i-1])
+	l.key = string(text[:i])
 	if i < len(text)-1 {
 		l.value = string(text[i+1:])
 	}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+)
+
+// generated by an earlier release with `cert generate --name node --label team=db --label env=prod`,
+// which signed an empty label for each label given and cut the last character of their keys.
+const (
+	testOldCACert = `-----BEGIN AETHERPORT CERTIFICATE-----
+CjwKAmNhGO+lh86I/cTvGCDvpZO7u7fHpxkqIHrKW02ipXq3I4pRq4yymX5S9WQy
+0rno5dq60A+ng6dpMAESQIhihjxqNqMSesoDIPBAuKwrx1u45OfLQQg10RiBOmAM
+YzjR0/ekCIR73dTnsrgXdcwzLMacaOsevXW08itxNAc=
+-----END AETHERPORT CERTIFICATE-----
+`
+	testOldLabeledCert = `-----BEGIN AETHERPORT CERTIFICATE-----
+CnUKBG5vZGUSABIAEgZ0ZWE9ZGISB2VuPXByb2QYnaDF0Yj9xO8YIJ2ggdzRz9jv
+GCogLLmaV1xT8QB/x58nT+ap+NEN2VfOZt7ea4PPvNFFEzowATogMeoA+hqvG/uq
+UEEVXGJifov4MzYHbFAlekxjZBWnE/8SQHfxEpevI7t3zCKDcUOMXbsanpWKOY9s
+/CKwcwKdaXnqMSmwXmLPC9BOLbhqgLu4on8Iy9V51q2U566T8237RgE=
+-----END AETHERPORT CERTIFICATE-----
+`
+)
+
+func TestCertificateFromEarlierRelease(t *testing.T) {
+	pool, err := NewCAPoolFromPEM([]byte(testOldCACert))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _, err := UnmarshalAetherportCertificateFromPEM([]byte(testOldLabeledCert))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := cert.Verify(cert.Details.NotBefore.Add(time.Minute), pool); !ok {
+		t.Fatalf("expected the certificate of the earlier release to verify: %v", err)
+	}
+	want := []label{{}, {}, newLabel("tea", "db"), newLabel("en", "prod")}
+	if len(cert.Details.Labels) != len(want) {
+		t.Fatalf("expected the labels to be read as signed, got %q", cert.Details.Labels)
+	}
+	for i := range want {
+		if cert.Details.Labels[i] != want[i] {
+			t.Errorf("expected the labels to be read as signed, got %q", cert.Details.Labels)
+		}
+	}
+}
+
+func TestCertificateLabels(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &AetherportCertificate{Details: AetherportCertificateDetails{
+		Name: "ca", NotAfter: time.Now().Add(time.Hour), PublicKey: pub, IsCA: true,
+	}}
+	if err = ca.Sign(key, nil); err != nil {
+		t.Fatal(err)
+	}
+	cert := &AetherportCertificate{Details: AetherportCertificateDetails{
+		Name:      "node",
+		Labels:    []label{newLabel("team", "db"), newLabel("env", "prod")},
+		NotAfter:  time.Now().Add(time.Minute),
+		PublicKey: make([]byte, x25519KeyLen),
+	}}
+	if err = cert.Sign(key, ca); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := cert.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := UnmarshalAetherportCertificate(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.CheckSignature(pub) {
+		t.Fatal("expected the signature to verify after a round trip")
+	}
+	if len(got.Details.Labels) != 2 || got.Details.Labels[0] != newLabel("team", "db") || got.Details.Labels[1] != newLabel("env", "prod") {
+		t.Errorf("unexpected labels: %q", got.Details.Labels)
+	}
+}
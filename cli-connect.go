@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+type CliConnect struct {
+	Remote string `arg:"" name:"remote" placeholder:"<remote-ip>:<remote-port>" help:"Remote endpoint to connect stdin and stdout to."`
+
+	AetherlightIngressURL string `name:"aetherlight-ingress-url" required:"" help:"URL to connect to ingress connected to aetherlight."`
+
+	KeyFile    string `name:"key" required:"" help:"Path to key file."`
+	CertFile   string `name:"cert" required:"" help:"Path to certificate file."`
+	CaCertFile string `name:"cacert" required:"" help:"Path to file containing one or more trusted CA certificate. It must contain CA certificate that is used to sign the certificate specified in '--cert' flag."`
+
+	ICEServers []string `name:"ice-server" help:"List of ICE servers to use for discovering addresses." placeholder:"[stun|stuns|turn|turns]://<host>:<port>"`
+
+	DisconnectGrace time.Duration `name:"disconnect-grace" default:"20s" help:"Duration the peer connection may stay disconnected, such as after a network change, before being torn down. Meanwhile ICE is restarted, keeping the connection open."`
+}
+
+func (c *CliConnect) Run(ctx context.Context) (err error) {
+	ep, err := EndpointFromString(localStdio + ":" + c.Remote)
+	if err != nil {
+		return fmt.Errorf("parse remote endpoint failed: %w", err)
+	}
+
+	p := &CliProxy{
+		KeyFile:         c.KeyFile,
+		CertFile:        c.CertFile,
+		CaCertFile:      c.CaCertFile,
+		ICEServers:      c.ICEServers,
+		DisconnectGrace: c.DisconnectGrace,
+	}
+	id, err := p.newIdentity()
+	if err != nil {
+		return err
+	}
+
+	ee, err := NewEgressEndpoints([]Endpoint{ep}, []string{""}, 0)
+	if err != nil {
+		return err
+	}
+	return p.startAetherlightEgress(ctx, id, ee, "", c.AetherlightIngressURL)
+}
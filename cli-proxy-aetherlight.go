@@ -19,75 +19,124 @@ import (
 	"nhooyr.io/websocket"
 )
 
+// Bounds of the delay between attempts to reconnect to aetherlight and the peer.
+const (
+	reconnectMinBackoff = 500 * time.Millisecond
+	reconnectMaxBackoff = 30 * time.Second
+)
+
 func (c *CliProxy) runAetherlight(ctx context.Context) (err error) {
+	id, err := c.newIdentity()
+	if err != nil {
+		return err
+	}
+
+	wg := sync.WaitGroup{}
+	if c.isIngress() {
+		rules, err := c.ingressRules(ctx)
+		if err != nil {
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			retry(ctx, &backoff{min: reconnectMinBackoff, max: reconnectMaxBackoff}, func(ctx context.Context) error {
+				return c.runAetherlightIngress(ctx, id, rules)
+			}, func(err error) {
+				log.Println("run aetherlight ingress failed:", err)
+			})
+		}()
+	}
+	if c.isEgress() {
+		selectors, err := c.ingressSelectors()
+		if err != nil {
+			return err
+		}
+		groups := make([]string, 0, len(selectors))
+		for g := range selectors {
+			groups = append(groups, g)
+		}
+		ee, err := c.egressEndpoints(ctx, groups)
+		if err != nil {
+			return err
+		}
+		defer ee.Close()
+
+		for group, s := range selectors {
+			wg.Add(1)
+			go func(group string, s *IngressSelector) {
+				defer wg.Done()
+				s.Run(ctx, func(ctx context.Context, url string) error {
+					return c.runAetherlightEgress(ctx, id, ee, group, url)
+				}, func(err error) {
+					log.Println("run aetherlight egress failed:", err)
+				})
+			}(group, s)
+		}
+	}
+	wg.Wait()
+	return
+}
+
+// ingressSelectors groups the ingress URLs by the group forwards refer them with.
+func (c *CliProxy) ingressSelectors() (selectors map[string]*IngressSelector, err error) {
+	if len(c.AetherlightIngressURLs) == 0 {
+		return nil, fmt.Errorf("--aetherlight-ingress-url is required to forward with aetherlight signaling")
+	}
+
+	groups := map[string][]ingressURL{}
+	for _, s := range c.AetherlightIngressURLs {
+		u, err := ingressURLFromString(s)
+		if err != nil {
+			return nil, fmt.Errorf("parse ingress url failed: %s: %w", s, err)
+		}
+		groups[u.group] = append(groups[u.group], u)
+	}
+
+	selectors = map[string]*IngressSelector{}
+	for g, urls := range groups {
+		selectors[g] = NewIngressSelector(urls, c.IngressSelection, c.IngressCheckInterval)
+	}
+	return
+}
+
+func (c *CliProxy) newIdentity() (id *Identity, err error) {
 	bk, err := os.ReadFile(c.KeyFile)
 	if err != nil {
-		return fmt.Errorf("open private key failed: %w", err)
+		return nil, fmt.Errorf("open private key failed: %w", err)
 	}
 	key, _, err := UnmarshalX25519PrivateKey(bk)
 	if err != nil {
-		return fmt.Errorf("unmarshal private key failed: %w", err)
+		return nil, fmt.Errorf("unmarshal private key failed: %w", err)
 	}
 
 	bc, err := os.ReadFile(c.CertFile)
 	if err != nil {
-		return fmt.Errorf("open certificate failed: %w", err)
+		return nil, fmt.Errorf("open certificate failed: %w", err)
 	}
 	cert, _, err := UnmarshalAetherportCertificateFromPEM(bc)
 	if err != nil {
-		return fmt.Errorf("unmarshal certificate failed: %w", err)
+		return nil, fmt.Errorf("unmarshal certificate failed: %w", err)
 	}
 
 	bca, err := os.ReadFile(c.CaCertFile)
 	if err != nil {
-		return fmt.Errorf("open ca certificate failed: %w", err)
+		return nil, fmt.Errorf("open ca certificate failed: %w", err)
 	}
 	capool, err := NewCAPoolFromPEM(bca)
 	if err != nil {
-		return fmt.Errorf("unmarshall ca certificate failed: %w", err)
+		return nil, fmt.Errorf("unmarshall ca certificate failed: %w", err)
 	}
 
-	id, err := NewIdentity(key, cert, capool)
+	id, err = NewIdentity(key, cert, capool)
 	if err != nil {
-		return fmt.Errorf("instantiating node failed: %w", err)
+		return nil, fmt.Errorf("instantiating node failed: %w", err)
 	}
-
-	wg := sync.WaitGroup{}
-	if len(c.Allows) > 0 {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for {
-				if err := c.runAetherlightIngress(ctx, id); err != nil {
-					log.Println("run aetherlight ingress failed:", err)
-				}
-				if ctx.Err() != nil {
-					return
-				}
-				<-time.After(time.Second)
-			}
-		}()
-	}
-	if len(c.Forwards) > 0 {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for {
-				if err := c.runAetherlightEgress(ctx, id); err != nil {
-					log.Println("run aetherlight egress failed:", err)
-				}
-				if ctx.Err() != nil {
-					return
-				}
-				<-time.After(time.Second)
-			}
-		}()
-	}
-	wg.Wait()
 	return
 }
 
-func (c *CliProxy) runAetherlightIngress(ctx context.Context, id *Identity) (err error) {
+func (c *CliProxy) runAetherlightIngress(ctx context.Context, id *Identity, rules ingressRules) (err error) {
 	date := time.Now()
 	token, err := c.aetherlightToken(ctx, id, date)
 	if err != nil {
@@ -120,35 +169,59 @@ func (c *CliProxy) runAetherlightIngress(ctx context.Context, id *Identity) (err
 		if err != nil {
 			return fmt.Errorf("accept muxed connection failed: %w", err)
 		}
-		defer conn.Close()
-
-		ioc, err := NewNoisedMessengerI(ctx, NewChunkedIOMessenger(conn), id)
-		if err != nil {
-			return fmt.Errorf("create noised io chunked failed: %w", err)
-		}
-		defer ioc.Close()
-
-		peer, err := c.newWebRTCPeerConnection()
-		if err != nil {
-			return fmt.Errorf("create peer connection failed: %w: ", err)
-		}
-		defer peer.Close()
 
-		ip := &IngressProxy{
-			signal:        NewSignalMessenger(ctx, ioc),
-			signalTimeout: time.Minute,
-			peer:          peer,
-			epAuth:        NewBasicEndpointAuthorizer(c.Allows),
-		}
 		go func() {
-			if err := ip.Start(ctx); err != nil {
-				log.Fatalln("ingress: start errored:", err)
+			if err := c.serveAetherlightEgress(ctx, conn, id, rules); err != nil {
+				log.Println("ingress:", err)
 			}
-			log.Println("ingress done")
 		}()
 	}
 }
 
+// serveAetherlightEgress runs the ingress proxy for the egress connected through conn, after a noise handshake
+// bounded by egressHandshakeTimeout.
+func (c *CliProxy) serveAetherlightEgress(ctx context.Context, conn io.ReadWriteCloser, id *Identity, rules ingressRules) (err error) {
+	defer conn.Close()
+
+	hctx, cancel := context.WithTimeout(ctx, egressHandshakeTimeout)
+	ioc, err := NewNoisedMessengerI(hctx, NewChunkedIOMessenger(conn), id)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("create noised io chunked failed: %w", err)
+	}
+	defer ioc.Close()
+
+	peer, err := c.newWebRTCPeerConnection()
+	if err != nil {
+		return fmt.Errorf("create peer connection failed: %w: ", err)
+	}
+	defer peer.Close()
+
+	ip := &IngressProxy{
+		signal:        NewSignalMessenger(ctx, ioc),
+		signalTimeout: time.Minute,
+		peer:          peer,
+		peerCert:      ioc.Peer(),
+		epAuth:        rules.epAuth,
+		reverseAuth:   rules.reverseAuth,
+		httpFilter:    rules.httpFilter,
+		sniRouter:     rules.sniRouter,
+		proxyProtocol: rules.proxyProto,
+		router:        rules.router,
+		limiter:       rules.limiter,
+		noCompress:    c.NoCompress,
+
+		udpIdleTimeout:  c.UDPIdleTimeout,
+		timeouts:        c.streamTimeouts(),
+		disconnectGrace: c.DisconnectGrace,
+	}
+	if err = ip.Start(ctx); err != nil {
+		return fmt.Errorf("start errored: %w", err)
+	}
+	log.Println("ingress done")
+	return
+}
+
 func (c *CliProxy) aetherlightToken(ctx context.Context, id *Identity, date time.Time) (token string, err error) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.AetherlightBaseURL+"/public-key", nil)
 	if err != nil {
@@ -174,8 +247,26 @@ func (c *CliProxy) aetherlightToken(ctx context.Context, id *Identity, date time
 	return
 }
 
-func (c *CliProxy) runAetherlightEgress(ctx context.Context, id *Identity) (err error) {
-	ws, _, err := websocket.Dial(ctx, c.AetherlightIngressURL, nil)
+func (c *CliProxy) runAetherlightEgress(ctx context.Context, id *Identity, ee *EgressEndpoints, group string, url string) (err error) {
+	if c.Lazy {
+		if err = ee.waitDemand(ctx, group); err != nil {
+			return
+		}
+	}
+	if err = c.startAetherlightEgress(ctx, id, ee, group, url); err != nil {
+		return fmt.Errorf("egress: start failed: %w", err)
+	}
+	if c.Lazy {
+		log.Println("egress done, reconnecting on demand")
+		return
+	}
+	log.Println("egress done, reconnecting")
+	return
+}
+
+// startAetherlightEgress forwards the endpoints of the ingress group through the ingress at url.
+func (c *CliProxy) startAetherlightEgress(ctx context.Context, id *Identity, ee *EgressEndpoints, group string, url string) (err error) {
+	ws, _, err := websocket.Dial(ctx, url, nil)
 	if err != nil {
 		return fmt.Errorf("connectin to websocket failed: %w", err)
 	}
@@ -194,23 +285,20 @@ func (c *CliProxy) runAetherlightEgress(ctx context.Context, id *Identity) (err
 	}
 	defer peer.Close()
 
-	var eps []Endpoint
-	for _, e := range c.Forwards {
-		ep, err := EndpointFromString(e)
-		if err != nil {
-			return fmt.Errorf("parse forward endpoint failed: %w", err)
-		}
-		eps = append(eps, ep)
-	}
 	ep := &EgressProxy{
 		signal:        NewSignalMessenger(ctx, ioc),
 		signalTimeout: time.Minute,
 		peer:          peer,
-		endpoints:     eps,
+
+		udpIdleTimeout:  c.UDPIdleTimeout,
+		timeouts:        c.streamTimeouts(),
+		disconnectGrace: c.DisconnectGrace,
 	}
-	if err := ep.Start(ctx); err != nil {
-		log.Fatalln("egress: start failed:", err)
+	if c.Lazy {
+		ep.idleTimeout = c.IdleTimeout
 	}
-	log.Println("egress done")
-	return
+	ep.endpoints = ee.attach(ep, group)
+	defer ee.detach(ep, group)
+
+	return ep.Start(ctx)
 }
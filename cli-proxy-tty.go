@@ -12,37 +12,55 @@ func (c *CliProxy) runTTY(ctx context.Context) (err error) {
 	}
 
 	switch {
-	case len(c.Allows) > 0:
+	case c.isIngress():
+		rules, err := c.ingressRules(ctx)
+		if err != nil {
+			return err
+		}
+
 		i := &IngressProxy{
-			signal: NewSignalTTY(),
-			peer:   peer,
-			epAuth: NewBasicEndpointAuthorizer(c.Allows),
+			signal:        NewSignalTTY(),
+			peer:          peer,
+			epAuth:        rules.epAuth,
+			reverseAuth:   rules.reverseAuth,
+			httpFilter:    rules.httpFilter,
+			sniRouter:     rules.sniRouter,
+			proxyProtocol: rules.proxyProto,
+			router:        rules.router,
+			limiter:       rules.limiter,
+			noCompress:    c.NoCompress,
+
+			udpIdleTimeout:  c.UDPIdleTimeout,
+			timeouts:        c.streamTimeouts(),
+			disconnectGrace: c.DisconnectGrace,
 		}
 		if err := i.Start(ctx); err != nil {
 			return fmt.Errorf("start ingress proxy errored: %w", err)
 		}
 
-	case len(c.Forwards) > 0:
-		var eps []Endpoint
-		for _, pair := range c.Forwards {
-			ep, err := EndpointFromString(pair)
-			if err != nil {
-				return err
-			}
-			eps = append(eps, ep)
+	case c.isEgress():
+		ee, err := c.egressEndpoints(ctx, []string{""})
+		if err != nil {
+			return err
 		}
+		defer ee.Close()
 
 		i := &EgressProxy{
-			signal:    NewSignalTTY(),
-			peer:      peer,
-			endpoints: eps,
+			signal: NewSignalTTY(),
+			peer:   peer,
+
+			udpIdleTimeout:  c.UDPIdleTimeout,
+			timeouts:        c.streamTimeouts(),
+			disconnectGrace: c.DisconnectGrace,
 		}
+		i.endpoints = ee.attach(i, "")
+		defer ee.detach(i, "")
 		if err := i.Start(ctx); err != nil {
 			return fmt.Errorf("start egress proxy errored: %w", err)
 		}
 
 	default:
-		return fmt.Errorf("either specify --forward or --allow")
+		return fmt.Errorf("either specify --forward, --reverse, --allow, --allow-reverse, --allow-http, or --policy")
 	}
 	return
 }
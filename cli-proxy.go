@@ -2,18 +2,62 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
 
 	"github.com/pion/webrtc/v3"
 )
 
 type CliProxy struct {
-	Forwards []string `name:"forward" short:"f" placeholder:"<local-ip>:<local-port>:<remote-ip>:<remote-port>" help:"List of local to remote endpoint mapping."`
-	Allows   []string `name:"allow" short:"w" placeholder:"<ip>:<port>" help:"List of remote endpoints the egress is allowed to connect to."`
+	Forwards []string `name:"forward" short:"f" sep:"none" placeholder:"[tcp/|udp/]<local-ip>:<local-port>:<remote-ip>:<remote-port>|[socks5/|http-proxy/|sni/]<local-ip>:<local-port>" help:"List of local to remote endpoint mapping. Prefix with 'udp/' to forward UDP datagrams, or use 'socks5/' or 'http-proxy/' to serve a proxy whose destinations are checked by the ingress. With 'sni/', TLS connections are routed by the ingress from their server name. Either address can be 'unix:<path>' for a unix socket, with ',perm=<octal>' setting the permission of the local socket file. Add ',proxy-protocol' to read the client address from a PROXY protocol header on every local connection, ',max-streams=<n>' to refuse local connections beyond n relayed at once, ',compress=zstd|snappy' to compress the relayed data, except for UDP, and ',mux=sctp' to carry each connection on a data channel of its own rather than the shared smux session."`
+	Allows   []string `name:"allow" short:"w" placeholder:"[!][<selector>@][tcp/|udp/]<host>:<port>|unix:<path>|sni:<server-name>-><host>:<port>" help:"List of remote endpoints the egress is allowed to connect to. '<host>' can be an IP, a CIDR, a hostname, '*.<domain>', or '*', and '<port>' can be a '<from>-<to>' range or '*'. 'sni:' entries route the TLS connections of 'sni/' forwards whose server name matches to the given endpoint, or when it is not a single address, to the server name itself, which must resolve within it. Entries starting with '!' deny the endpoint instead, and also apply to the addresses hostnames resolve to, which a wildcard host does not allow when they are loopback or link-local. Deny the other address ranges allowed hostnames must not reach. Prefix with '<selector>@' to allow it only for egresses whose certificate matches every '&' separated 'name=<name>', 'issuer=<ca fingerprint>', or 'label.<key>=<value>'."`
+
+	Reverses []string `name:"reverse" short:"R" sep:"none" placeholder:"<ingress-ip>:<ingress-port>:<egress-ip>:<egress-port>" help:"List of endpoints to listen on the ingress side whose connections are forwarded back to an endpoint reachable from this egress. Add ',compress=zstd|snappy' to compress their streams."`
+
+	AllowReverses []string `name:"allow-reverse" placeholder:"[<selector>@]<ip>:<port>" help:"List of endpoints on this ingress an egress is allowed to listen on with '--reverse'. Accepts the same selectors as '--allow'."`
+
+	AllowHTTPs []string `name:"allow-http" sep:"none" placeholder:"[<selector>@]<host>:<port>[,method=<method>][,host=<host>][,path=<prefix>]" help:"List of HTTP requests allowed to the given remote endpoints, whose streams are then parsed as HTTP/1.1 and answered with 403 for any other request. Options can be repeated, and a request must match one value of each given option. The endpoint itself must still be allowed by '--allow', '--policy', or the external authorization."`
+
+	ProxyProtocols []string `name:"proxy-protocol" sep:"none" placeholder:"<host>:<port>[,version=1|2]" help:"List of remote endpoints whose connections start with a PROXY protocol header carrying the address of the egress client. Version 2, the default, also carries the name, labels, and fingerprint of the egress certificate."`
+
+	Routes []string `name:"route" sep:"none" placeholder:"[<selector>@]<host>:<port>-><upstream-host>:<upstream-port>" help:"List of upstreams to dial instead of the remote endpoints egresses ask for, depending on their certificate. The first route whose selector matches is used, and egresses matching no route of an endpoint are denied. The endpoint must still be allowed."`
+
+	Limits []string `name:"limit" sep:"none" placeholder:"[<selector>@]<host>:<port>[,up=<rate>][,down=<rate>][,quota=<size>/<window>][,streams=<n>][,idle=<duration>][,lifetime=<duration>][,shared]" help:"List of bandwidth limits, traffic quotas, and other limits of the streams to the given remote endpoints. Rates are bytes per second and sizes are bytes, with an optional k, M, G, T, Ki, Mi, Gi, or Ti suffix. A stream exceeding a quota is closed, and new ones are rejected until the window ends. Streams beyond the maximum number open at once are rejected, and the ones idle or open for longer than the given durations are closed. Every egress matching an entry has its own budget, unless ',shared' is given. Accepts the same selectors as '--allow'."`
+
+	NoCompress bool `name:"no-compress" help:"Relay every stream uncompressed, refusing the compression egresses ask for with ',compress'."`
+
+	Policy string `name:"policy" placeholder:"<path>" type:"path" help:"Path to a YAML file of ordered rules authorizing egresses, used instead of '--allow' and '--allow-reverse', except for the 'sni:' entries of '--allow'. It is reloaded on SIGHUP or when the file changes."`
+
+	AuthzURL      string        `name:"authz-url" placeholder:"<url>" help:"URL to POST every authorization decision to, in addition to the local rules if any."`
+	AuthzExec     string        `name:"authz-exec" placeholder:"<command>" help:"Command to run for every authorization decision, in addition to the local rules if any."`
+	AuthzTimeout  time.Duration `name:"authz-timeout" default:"5s" help:"Timeout of an external authorization decision."`
+	AuthzCacheTTL time.Duration `name:"authz-cache-ttl" default:"30s" help:"Duration an external authorization decision is cached for."`
+	AuthzFailOpen bool          `name:"authz-fail-open" help:"Allow the endpoint when the external authorization decision can not be obtained, instead of denying it."`
+
+	Control string `name:"control" placeholder:"unix:<path>|<ip>:<port>" help:"Address to serve the API for listing, adding, and removing forwards at runtime, either a unix socket or a loopback address, as it is not authenticated."`
+
+	ReconnectWait time.Duration `name:"reconnect-wait" default:"10s" help:"Duration a new local connection waits for the peer to reconnect before being reset. Local listeners stay open while reconnecting."`
+
+	Lazy        bool          `name:"lazy" help:"Make the peer connection only once a local connection is accepted, and close it after '--idle-timeout' without any. Local sockets are listened on meanwhile. Forwards sharing an ingress with a UDP or reverse forward stay connected. Not used in tty signaling."`
+	IdleTimeout time.Duration `name:"idle-timeout" default:"5m" help:"Duration the peer connection may carry no connection before being closed, with '--lazy'."`
+
+	DisconnectGrace time.Duration `name:"disconnect-grace" default:"20s" help:"Duration the peer connection may stay disconnected, such as after a network change, before being torn down. Meanwhile the egress restarts ICE over the aetherlight signaling channel, keeping every connection open. Zero tears it down right away."`
+
+	StreamIdleTimeout time.Duration `name:"stream-idle-timeout" help:"Duration a relayed connection may carry no data either way before being closed. Zero means no limit."`
+	StreamMaxLifetime time.Duration `name:"stream-max-lifetime" help:"Duration after which a relayed connection is closed, whatever its traffic. Zero means no limit."`
+
+	UDPIdleTimeout time.Duration `name:"udp-idle-timeout" default:"1m" help:"Duration after which an inactive UDP flow is forgotten."`
 
 	SignalType string `name:"signal-type" short:"t" default:"tty" enum:"tty,aetherlight" help:"Type of signaling. Available options are 'tty' or 'aetherlight'"`
 
-	AetherlightBaseURL    string `name:"aetherlight-base-url" help:"URL to connect to aetherlight as ingress."`
-	AetherlightIngressURL string `name:"aetherlight-ingress-url" help:"URL to connect to ingress connected to aetherlight."`
+	AetherlightBaseURL     string   `name:"aetherlight-base-url" help:"URL to connect to aetherlight as ingress."`
+	AetherlightIngressURLs []string `name:"aetherlight-ingress-url" sep:"none" placeholder:"<url>[,priority=<n>][,group=<name>]" help:"URLs to connect to ingresses connected to aetherlight. Given several URLs, the egress connects to one of them at a time, among the ones aetherlight reports as connected, and fails over to the next one when the peer connection is lost. Lower priorities are preferred, 0 by default. Forwards with the 'ingress=<group>' option go through the URLs of that group only, and the other forwards through the URLs without a group."`
+
+	IngressSelection     string        `name:"ingress-selection" default:"priority" enum:"priority,latency" help:"How the egress picks one of several ingress URLs: by 'priority', failing back to a preferred ingress once it is connected again, or by the lowest 'latency' to its aetherlight."`
+	IngressCheckInterval time.Duration `name:"ingress-check-interval" default:"10s" help:"Interval between checks of the ingresses given several URLs."`
 
 	KeyFile    string `name:"key"  help:"Path to key file. Not used in tty signaling."`
 	CertFile   string `name:"cert" help:"Path to certificate file. Not used in tty signaling."`
@@ -32,6 +76,186 @@ func (c *CliProxy) Run(ctx context.Context) (err error) {
 	return
 }
 
+func (c *CliProxy) streamTimeouts() streamTimeouts {
+	return streamTimeouts{idle: c.StreamIdleTimeout, lifetime: c.StreamMaxLifetime}
+}
+
+func (c *CliProxy) isIngress() bool {
+	return len(c.Allows) > 0 || len(c.AllowReverses) > 0 || len(c.AllowHTTPs) > 0 || c.Policy != "" || c.AuthzURL != "" || c.AuthzExec != ""
+}
+
+func (c *CliProxy) isEgress() bool {
+	return len(c.Forwards) > 0 || len(c.Reverses) > 0 || c.Control != ""
+}
+
+func (c *CliProxy) endpoints() (eps []Endpoint, err error) {
+	for _, e := range c.Forwards {
+		ep, err := EndpointFromString(e)
+		if err != nil {
+			return nil, fmt.Errorf("parse forward endpoint failed: %w", err)
+		}
+		eps = append(eps, ep)
+	}
+	for _, r := range c.Reverses {
+		ep, err := EndpointFromString(networkReverse + "/" + r)
+		if err != nil {
+			return nil, fmt.Errorf("parse reverse endpoint failed: %w", err)
+		}
+		eps = append(eps, ep)
+	}
+	return
+}
+
+// ingressRules are the access rules shared by every ingress proxy of the process.
+type ingressRules struct {
+	epAuth      EndpointAuthorizer
+	reverseAuth EndpointAuthorizer
+	httpFilter  *HTTPFilter
+	sniRouter   *SNIRouter
+	proxyProto  *ProxyProtocol
+	router      *Router
+	limiter     *Limiter
+}
+
+func (c *CliProxy) ingressRules(ctx context.Context) (r ingressRules, err error) {
+	var sniAuth EndpointAuthorizer
+	if r.epAuth, r.reverseAuth, sniAuth, err = c.ingressAuthorizers(ctx); err != nil {
+		return
+	}
+	if len(c.AllowHTTPs) > 0 {
+		if r.httpFilter, err = NewHTTPFilter(c.AllowHTTPs); err != nil {
+			return r, fmt.Errorf("parse allow-http rules failed: %w", err)
+		}
+	}
+	if len(c.ProxyProtocols) > 0 {
+		if r.proxyProto, err = NewProxyProtocol(c.ProxyProtocols); err != nil {
+			return r, fmt.Errorf("parse proxy-protocol rules failed: %w", err)
+		}
+	}
+	if len(c.Routes) > 0 {
+		if r.router, err = NewRouter(c.Routes); err != nil {
+			return r, fmt.Errorf("parse route rules failed: %w", err)
+		}
+	}
+	if len(c.Limits) > 0 {
+		if r.limiter, err = NewLimiter(c.Limits); err != nil {
+			return r, fmt.Errorf("parse limit rules failed: %w", err)
+		}
+	}
+	if _, sni := c.splitAllows(); len(sni) > 0 {
+		if r.sniRouter, err = NewSNIRouter(sni, sniAuth); err != nil {
+			return r, fmt.Errorf("parse allow rules failed: %w", err)
+		}
+	}
+	return
+}
+
+// splitAllows separates the '--allow' entries routing TLS connections by server name from the other ones.
+func (c *CliProxy) splitAllows() (allows []string, sni []string) {
+	for _, a := range c.Allows {
+		if isSNIRule(a) {
+			sni = append(sni, a)
+		} else {
+			allows = append(allows, a)
+		}
+	}
+	return
+}
+
+// ingressAuthorizers returns the authorizers of endpoints and reverse listen addresses, along with the one the
+// upstreams of the sni routes must also pass.
+func (c *CliProxy) ingressAuthorizers(ctx context.Context) (epAuth, reverseAuth, sniAuth EndpointAuthorizer, err error) {
+	if c.AuthzURL != "" && c.AuthzExec != "" {
+		return nil, nil, nil, fmt.Errorf("--authz-url can not be combined with --authz-exec")
+	}
+
+	if epAuth, reverseAuth, sniAuth, err = c.localAuthorizers(ctx); err != nil {
+		return
+	}
+	if c.AuthzURL == "" && c.AuthzExec == "" {
+		return
+	}
+
+	ea := NewExternalAuthorizer(c.AuthzURL, c.AuthzExec, c.AuthzTimeout, c.AuthzCacheTTL, c.AuthzFailOpen)
+	return allOfAuthorizers(epAuth, ea.Authorizer()), allOfAuthorizers(reverseAuth, ea.ReverseAuthorizer()),
+		allOfAuthorizers(sniAuth, ea.Authorizer()), nil
+}
+
+// localAuthorizers returns the authorizers from '--policy', or from '--allow' and '--allow-reverse'. They are nil
+// when none is given while an external authorizer is, leaving the decisions to it. The sni routes allowing their
+// upstreams, only the deny entries of '--allow' apply to them, while a policy applies in full.
+func (c *CliProxy) localAuthorizers(ctx context.Context) (epAuth, reverseAuth, sniAuth EndpointAuthorizer, err error) {
+	allows, _ := c.splitAllows()
+	if c.Policy != "" {
+		if len(allows) > 0 || len(c.AllowReverses) > 0 {
+			return nil, nil, nil, fmt.Errorf("--policy can not be combined with --allow or --allow-reverse, except for sni entries")
+		}
+		p, err := LoadPolicy(c.Policy)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		go p.Watch(ctx)
+		return p.Authorizer(), p.ReverseAuthorizer(), p.Authorizer(), nil
+	}
+
+	external := c.AuthzURL != "" || c.AuthzExec != ""
+	if len(allows) > 0 || !external {
+		if epAuth, err = NewBasicEndpointAuthorizer(allows); err != nil {
+			return nil, nil, nil, fmt.Errorf("parse allow rules failed: %w", err)
+		}
+	}
+	if len(c.AllowReverses) > 0 || !external {
+		if reverseAuth, err = NewBasicEndpointAuthorizer(c.AllowReverses); err != nil {
+			return nil, nil, nil, fmt.Errorf("parse allow-reverse rules failed: %w", err)
+		}
+	}
+
+	denies := []string{"*"}
+	for _, a := range allows {
+		if strings.HasPrefix(a, "!") {
+			denies = append(denies, a)
+		}
+	}
+	if sniAuth, err = NewBasicEndpointAuthorizer(denies); err != nil {
+		return nil, nil, nil, fmt.Errorf("parse allow rules failed: %w", err)
+	}
+	return
+}
+
+// egressEndpoints parses the configured endpoints, forwarded through the given ingress groups, and when requested,
+// serves the control API to change them at runtime.
+func (c *CliProxy) egressEndpoints(ctx context.Context, groups []string) (ee *EgressEndpoints, err error) {
+	eps, err := c.endpoints()
+	if err != nil {
+		return nil, err
+	}
+	if ee, err = NewEgressEndpoints(eps, groups, c.ReconnectWait); err != nil {
+		return nil, err
+	}
+	if c.Control == "" {
+		return
+	}
+	if !isLocalAddr(c.Control) {
+		return nil, fmt.Errorf("control api must listen on a unix socket or a loopback address: %s", c.Control)
+	}
+
+	l, err := listenStream(c.Control, endpointOptions{socketPerm: 0600})
+	if err != nil {
+		return nil, fmt.Errorf("listen for control api failed: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	go func() {
+		log.Println("control api listening on:", c.Control)
+		if err := http.Serve(l, NewEgressControlHandler(ee)); err != nil && ctx.Err() == nil {
+			log.Println("control api stopped:", err)
+		}
+	}()
+	return
+}
+
 func (c *CliProxy) newWebRTCPeerConnection() (peer *webrtc.PeerConnection, err error) {
 	urls := c.ICEServers
 	if len(urls) == 0 {
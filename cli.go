@@ -6,6 +6,7 @@ import (
 
 type Cli struct {
 	Proxy       CliProxy       `cmd:"" default:"withargs" name:"proxy" help:"start aetherport"`
+	Connect     CliConnect     `cmd:"" name:"connect" help:"connect stdin and stdout to a remote endpoint, e.g. as ssh ProxyCommand"`
 	Signal      CliSignal      `cmd:"" name:"signal" help:"start aetherlight signalling server"`
 	Certificate CliCertificate `cmd:"" name:"cert" help:""`
 }
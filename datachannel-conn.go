@@ -28,7 +28,8 @@ func (dataChannelAddr) String() string {
 type DataChannelConn struct {
 	*datachannel.DataChannel
 
-	r bufio.Reader
+	r       bufio.Reader
+	rClosed int32
 
 	wCtx            contextExec
 	wBuffMax        uint64
@@ -106,7 +107,16 @@ func detach(ctx context.Context, wdc *webrtc.DataChannel) (*datachannel.DataChan
 }
 
 func (dcc *DataChannelConn) Read(b []byte) (n int, err error) {
-	return dcc.r.Read(b)
+	n, err = dcc.r.Read(b)
+	if err != nil {
+		atomic.StoreInt32(&dcc.rClosed, 1)
+	}
+	return
+}
+
+// ReadClosed reports whether reading from the underlying data channel has failed, e.g. because the peer closed it.
+func (dcc *DataChannelConn) ReadClosed() bool {
+	return atomic.LoadInt32(&dcc.rClosed) == 1
 }
 
 func (dcc *DataChannelConn) Write(b []byte) (n int, err error) {
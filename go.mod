@@ -8,19 +8,20 @@ require (
 	github.com/flynn/noise v1.0.0
 	github.com/go-chi/chi/v5 v5.0.8
 	github.com/hashicorp/go-multierror v1.1.1
+	github.com/klauspost/compress v1.17.6
 	github.com/pion/datachannel v1.5.5
 	github.com/pion/webrtc/v3 v3.1.53
 	github.com/xtaci/smux v1.5.19
 	golang.org/x/crypto v0.0.0-20221010152910-d6f0a8c073c2
 	golang.org/x/net v0.8.0
 	google.golang.org/protobuf v1.28.1
+	gopkg.in/yaml.v3 v3.0.1
 	nhooyr.io/websocket v1.8.7
 )
 
 require (
 	github.com/google/uuid v1.3.0 // indirect
 	github.com/hashicorp/errwrap v1.0.0 // indirect
-	github.com/klauspost/compress v1.10.3 // indirect
 	github.com/pion/dtls/v2 v2.1.5 // indirect
 	github.com/pion/ice/v2 v2.2.16 // indirect
 	github.com/pion/interceptor v0.1.11 // indirect
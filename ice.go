@@ -2,13 +2,18 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"sync"
+	"time"
 
 	"github.com/pion/webrtc/v3"
 )
 
+// iceRestartInterval is the delay between the ICE restarts of a peer connection that stays disconnected.
+const iceRestartInterval = 10 * time.Second
+
 func gatherICE(ctx context.Context, peer *webrtc.PeerConnection, signal interface{}) <-chan struct{} {
 	done := make(chan struct{})
 
@@ -102,3 +107,88 @@ func trickleICE(ctx context.Context, peer *webrtc.PeerConnection, s SignalICE) <
 
 	return errc
 }
+
+// waitICEGathering waits for the candidates of peer to be gathered, so that they can be sent along with its description.
+func waitICEGathering(ctx context.Context, peer *webrtc.PeerConnection) (err error) {
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("gather ICE candidates failed: %w", ctx.Err())
+	case <-webrtc.GatheringCompletePromise(peer):
+		return
+	}
+}
+
+// addLateICECandidates adds the candidates the peer trickles after the local gathering is complete, until the
+// signaling channel is closed. Since the channel is kept open for ICE restarts, they would block it otherwise.
+func addLateICECandidates(ctx context.Context, peer *webrtc.PeerConnection, s SignalICE) {
+	for {
+		can, err := s.RecvICECandidate(ctx)
+		if err != nil {
+			return
+		}
+		if err = peer.AddICECandidate(*can); err != nil {
+			log.Println("add ICE candidate failed:", err)
+		}
+	}
+}
+
+// peerRecovery gives a disconnected peer connection a grace period to recover, such as after a network change,
+// before giving up on it. Meanwhile, restart is called periodically when set.
+type peerRecovery struct {
+	grace  time.Duration
+	giveUp func()
+
+	mu      sync.Mutex
+	restart func(ctx context.Context) error
+	cancel  context.CancelFunc
+}
+
+func (r *peerRecovery) setRestart(restart func(ctx context.Context) error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.restart = restart
+}
+
+// disconnected starts the grace period, unless it is already running.
+func (r *peerRecovery) disconnected(ctx context.Context) {
+	r.mu.Lock()
+	if r.cancel != nil {
+		r.mu.Unlock()
+		return
+	}
+	if r.grace <= 0 {
+		r.mu.Unlock()
+		r.giveUp()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.grace)
+	r.cancel = cancel
+	restart := r.restart
+	r.mu.Unlock()
+
+	go func() {
+		for restart != nil && ctx.Err() == nil {
+			if err := restart(ctx); err != nil && ctx.Err() == nil {
+				log.Println("ICE restart failed:", err)
+			}
+			chanRecv(ctx, time.After(iceRestartInterval))
+		}
+		<-ctx.Done()
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			log.Println("peer connection not recovered after", r.grace)
+			r.giveUp()
+		}
+	}()
+}
+
+// connected ends the grace period, if any.
+func (r *peerRecovery) connected() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cancel != nil {
+		r.cancel()
+		r.cancel = nil
+	}
+}
@@ -18,8 +18,6 @@ type Identity struct {
 	caPool  *AetherportCAPool
 	psk     [][]byte
 	payload []byte
-
-	peerCert *AetherportCertificate
 }
 
 func NewIdentity(key []byte, cert *AetherportCertificate, caPool *AetherportCAPool) (n *Identity, err error) {
@@ -93,20 +91,18 @@ func (i *Identity) Payload() []byte {
 	return i.payload
 }
 
-func (i *Identity) ValidatePeer(payload []byte) (err error) {
+func (i *Identity) ValidatePeer(payload []byte) (peer *AetherportCertificate, err error) {
 	c, err := UnmarshalAetherportCertificate(payload)
 	if err != nil {
-		return fmt.Errorf("invalid certificate: %w", err)
+		return nil, fmt.Errorf("invalid certificate: %w", err)
 	}
 
 	ok, err := c.Verify(time.Now(), i.caPool)
 	if err != nil {
-		return fmt.Errorf("certificate verification failed: %w", err)
+		return nil, fmt.Errorf("certificate verification failed: %w", err)
 	}
 	if !ok {
-		return fmt.Errorf("untrusted certificate")
+		return nil, fmt.Errorf("untrusted certificate")
 	}
-
-	i.peerCert = c
-	return
+	return c, nil
 }
@@ -13,7 +13,7 @@ type NoiseIdentity interface {
 	DHKey() noise.DHKey
 	PresharedKeys() [][]byte
 	Payload() []byte
-	ValidatePeer(payload []byte) error
+	ValidatePeer(payload []byte) (peer *AetherportCertificate, err error)
 }
 
 type NoisedMessenger struct {
@@ -21,6 +21,8 @@ type NoisedMessenger struct {
 	dec *noise.CipherState
 	enc *noise.CipherState
 	hsk *noise.HandshakeState
+
+	peer *AetherportCertificate
 }
 
 func NewNoisedMessengerI(ctx context.Context, ioc Messenger, id NoiseIdentity) (i *NoisedMessenger, err error) {
@@ -68,7 +70,8 @@ func NewNoisedMessengerI(ctx context.Context, ioc Messenger, id NoiseIdentity) (
 	if ki == nil || kr == nil {
 		return i, fmt.Errorf("no keypair created at the end of handshake")
 	}
-	if err := id.ValidatePeer(payload); err != nil {
+	peer, err := id.ValidatePeer(payload)
+	if err != nil {
 		return i, fmt.Errorf("peer validation failed: %w", err)
 	}
 
@@ -77,6 +80,7 @@ func NewNoisedMessengerI(ctx context.Context, ioc Messenger, id NoiseIdentity) (
 		hsk:       nhsk,
 		enc:       ki,
 		dec:       kr,
+		peer:      peer,
 	}, nil
 }
 
@@ -122,7 +126,8 @@ func NewNoisedMessengerR(ctx context.Context, ioc Messenger, id NoiseIdentity) (
 	if nhsk == nil {
 		return i, fmt.Errorf("reading initiator message failed, possibly due to unmatching PSK")
 	}
-	if err = id.ValidatePeer(payload); err != nil {
+	peer, err := id.ValidatePeer(payload)
+	if err != nil {
 		return i, fmt.Errorf("cannot validate initiator payload: %w", err)
 	}
 
@@ -144,9 +149,15 @@ func NewNoisedMessengerR(ctx context.Context, ioc Messenger, id NoiseIdentity) (
 		hsk:       nhsk,
 		enc:       kr,
 		dec:       ki,
+		peer:      peer,
 	}, nil
 }
 
+// Peer returns the certificate the other side presented during the handshake.
+func (c *NoisedMessenger) Peer() *AetherportCertificate {
+	return c.peer
+}
+
 func (c *NoisedMessenger) Read(ctx context.Context) (b []byte, err error) {
 	b, err = c.Messenger.Read(ctx)
 	if err != nil {
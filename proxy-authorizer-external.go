@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// externalAuthorizerCacheSize is the maximum number of cached decisions. Once reached, the expired ones are removed,
+// or when there is none, the oldest one.
+const externalAuthorizerCacheSize = 4096
+
+// externalAuthorizerResponseSize is the maximum size of a response read from the URL or the command, beyond which
+// it is cut, failing to parse.
+const externalAuthorizerResponseSize = 16 << 10
+
+// ExternalAuthorizer delegates authorization decisions to an HTTP endpoint or a command, caching them for a while.
+type ExternalAuthorizer struct {
+	url      string
+	command  string
+	timeout  time.Duration
+	ttl      time.Duration
+	failOpen bool
+	client   *http.Client
+
+	mu    sync.Mutex
+	cache map[externalAuthzKey]externalAuthzEntry
+}
+
+type externalAuthzKey struct {
+	peer    string
+	reverse bool
+	network string
+	remote  string
+	host    string
+}
+
+type externalAuthzEntry struct {
+	allow   bool
+	expires time.Time
+}
+
+// externalAuthzRequest is POSTed to the URL, or written to the stdin of the command, for every decision.
+type externalAuthzRequest struct {
+	Peer     *externalAuthzPeer    `json:"peer"`
+	Endpoint externalAuthzEndpoint `json:"endpoint"`
+	Reverse  bool                  `json:"reverse"`
+}
+
+type externalAuthzPeer struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels"`
+	Issuer string            `json:"issuer"`
+}
+
+type externalAuthzEndpoint struct {
+	Network      string `json:"network"`
+	Address      string `json:"address"`
+	ResolvedFrom string `json:"resolved_from,omitempty"`
+}
+
+// externalAuthzResponse is expected as the HTTP response body, or on the stdout of the command.
+type externalAuthzResponse struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason"`
+}
+
+// NewExternalAuthorizer asks url with a JSON POST, or runs command through 'sh -c' with the JSON on its stdin.
+// Decisions are cached for ttl. When the decision can not be obtained, the endpoint is allowed if failOpen is set.
+func NewExternalAuthorizer(url string, command string, timeout time.Duration, ttl time.Duration, failOpen bool) *ExternalAuthorizer {
+	return &ExternalAuthorizer{
+		url:      url,
+		command:  command,
+		timeout:  timeout,
+		ttl:      ttl,
+		failOpen: failOpen,
+		client:   &http.Client{},
+		cache:    map[externalAuthzKey]externalAuthzEntry{},
+	}
+}
+
+// Authorizer returns the authorizer for the destinations of streams.
+func (ea *ExternalAuthorizer) Authorizer() EndpointAuthorizer {
+	return func(cert *AetherportCertificate, ep Endpoint) (bool, error) {
+		return ea.authorize(cert, ep, false)
+	}
+}
+
+// ReverseAuthorizer returns the authorizer for the addresses listened on for reverse forwards.
+func (ea *ExternalAuthorizer) ReverseAuthorizer() EndpointAuthorizer {
+	return func(cert *AetherportCertificate, ep Endpoint) (bool, error) {
+		return ea.authorize(cert, ep, true)
+	}
+}
+
+func (ea *ExternalAuthorizer) authorize(cert *AetherportCertificate, ep Endpoint, reverse bool) (ok bool, err error) {
+	key := externalAuthzKey{reverse: reverse, network: ep.network, remote: ep.remote, host: ep.resolvedHost}
+	if cert != nil {
+		key.peer = hex.EncodeToString(cert.Signature)
+	}
+	if ok, found := ea.cached(key); found {
+		return ok, nil
+	}
+
+	req := externalAuthzRequest{
+		Endpoint: externalAuthzEndpoint{Network: ep.network, Address: ep.remote, ResolvedFrom: ep.resolvedHost},
+		Reverse:  reverse,
+	}
+	if req.Endpoint.Network == "" {
+		req.Endpoint.Network = networkTCP
+	}
+	if cert != nil {
+		req.Peer = &externalAuthzPeer{Name: cert.Details.Name, Issuer: cert.Details.Issuer, Labels: map[string]string{}}
+		for _, l := range cert.Details.Labels {
+			if l.key != "" {
+				req.Peer.Labels[l.key] = l.value
+			}
+		}
+	}
+
+	res, err := ea.ask(req)
+	if err != nil {
+		if ea.failOpen {
+			log.Println("authz: allowing after failure:", err)
+			return true, nil
+		}
+		return false, err
+	}
+	if !res.Allow {
+		log.Printf("authz: denied %s for %s: %s\n", ep.remoteString(), peerName(cert), res.Reason)
+	}
+
+	ea.store(key, res.Allow)
+	return res.Allow, nil
+}
+
+func (ea *ExternalAuthorizer) ask(req externalAuthzRequest) (res externalAuthzResponse, err error) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return res, fmt.Errorf("marshal authorization request failed: %w", err)
+	}
+
+	ctx := context.Background()
+	if ea.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ea.timeout)
+		defer cancel()
+	}
+
+	var out []byte
+	if ea.url != "" {
+		out, err = ea.post(ctx, b)
+	} else {
+		out, err = ea.exec(ctx, b)
+	}
+	if err != nil {
+		return
+	}
+
+	if err = json.Unmarshal(out, &res); err != nil {
+		return res, fmt.Errorf("unmarshal authorization response failed: %w", err)
+	}
+	return
+}
+
+func (ea *ExternalAuthorizer) post(ctx context.Context, b []byte) (out []byte, err error) {
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, ea.url, bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("create authorization request failed: %w", err)
+	}
+	hreq.Header.Set("content-type", "application/json")
+
+	hres, err := ea.client.Do(hreq)
+	if err != nil {
+		return nil, fmt.Errorf("send authorization request failed: %w", err)
+	}
+	defer hres.Body.Close()
+
+	if hres.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("authorization request failed with status: %s", hres.Status)
+	}
+	if out, err = io.ReadAll(io.LimitReader(hres.Body, externalAuthorizerResponseSize)); err != nil {
+		return nil, fmt.Errorf("read authorization response failed: %w", err)
+	}
+	return
+}
+
+func (ea *ExternalAuthorizer) exec(ctx context.Context, b []byte) (out []byte, err error) {
+	stdout := &cappedBuffer{max: externalAuthorizerResponseSize}
+	cmd := exec.CommandContext(ctx, "sh", "-c", ea.command)
+	cmd.Stdin, cmd.Stdout = bytes.NewReader(b), stdout
+	if err = cmd.Start(); err != nil {
+		return nil, fmt.Errorf("run authorization command failed: %w", err)
+	}
+
+	// the shell is killed on timeout, but its children may keep stdout open, so the wait is left to end on its own.
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("run authorization command failed: %w", err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// cappedBuffer keeps the first max bytes written to it and discards the rest, so that the writer is never blocked.
+type cappedBuffer struct {
+	buf bytes.Buffer
+	max int
+}
+
+func (cb *cappedBuffer) Write(b []byte) (int, error) {
+	if n := cb.max - cb.buf.Len(); n < len(b) {
+		cb.buf.Write(b[:n])
+		return len(b), nil
+	}
+	return cb.buf.Write(b)
+}
+
+func (cb *cappedBuffer) Bytes() []byte {
+	return cb.buf.Bytes()
+}
+
+func (ea *ExternalAuthorizer) cached(key externalAuthzKey) (allow bool, found bool) {
+	ea.mu.Lock()
+	defer ea.mu.Unlock()
+
+	e, ok := ea.cache[key]
+	if !ok || time.Now().After(e.expires) {
+		return false, false
+	}
+	return e.allow, true
+}
+
+func (ea *ExternalAuthorizer) store(key externalAuthzKey, allow bool) {
+	if ea.ttl <= 0 {
+		return
+	}
+
+	ea.mu.Lock()
+	defer ea.mu.Unlock()
+
+	now := time.Now()
+	if _, ok := ea.cache[key]; !ok && len(ea.cache) >= externalAuthorizerCacheSize {
+		ea.evictLocked(now)
+	}
+	ea.cache[key] = externalAuthzEntry{allow: allow, expires: now.Add(ea.ttl)}
+}
+
+// evictLocked removes the expired decisions, or the oldest one when none is. It must be called with ea.mu held.
+func (ea *ExternalAuthorizer) evictLocked(now time.Time) {
+	var oldest externalAuthzKey
+	var oldestExpires time.Time
+	for k, e := range ea.cache {
+		if now.After(e.expires) {
+			delete(ea.cache, k)
+			continue
+		}
+		if oldestExpires.IsZero() || e.expires.Before(oldestExpires) {
+			oldest, oldestExpires = k, e.expires
+		}
+	}
+	if len(ea.cache) >= externalAuthorizerCacheSize {
+		delete(ea.cache, oldest)
+	}
+}
+
+// allOfAuthorizers allows an endpoint only when every one of auths allows it. Nil authorizers are skipped.
+func allOfAuthorizers(auths ...EndpointAuthorizer) EndpointAuthorizer {
+	return func(cert *AetherportCertificate, ep Endpoint) (bool, error) {
+		for _, auth := range auths {
+			if auth == nil {
+				continue
+			}
+			if ok, err := auth(cert, ep); !ok || err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+}
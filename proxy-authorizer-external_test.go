@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// authzStub answers authorization requests with decide, recording them.
+type authzStub struct {
+	mu       sync.Mutex
+	requests []externalAuthzRequest
+	decide   func(req externalAuthzRequest) (status int, res externalAuthzResponse)
+}
+
+func newAuthzStub(t *testing.T, decide func(req externalAuthzRequest) (int, externalAuthzResponse)) (*authzStub, string) {
+	s := &authzStub{decide: decide}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req externalAuthzRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		s.requests = append(s.requests, req)
+		s.mu.Unlock()
+
+		status, res := s.decide(req)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(res)
+	}))
+	t.Cleanup(srv.Close)
+	return s, srv.URL
+}
+
+func (s *authzStub) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.requests)
+}
+
+func allowPort22(req externalAuthzRequest) (int, externalAuthzResponse) {
+	if strings.HasSuffix(req.Endpoint.Address, ":22") {
+		return http.StatusOK, externalAuthzResponse{Allow: true}
+	}
+	return http.StatusOK, externalAuthzResponse{Allow: false, Reason: "only ssh"}
+}
+
+var testAuthzPeer = &AetherportCertificate{
+	Details:   AetherportCertificateDetails{Name: "node", Issuer: "abcd", Labels: []label{newLabel("team", "db")}},
+	Signature: []byte{1, 2, 3},
+}
+
+func TestExternalAuthorizerDecision(t *testing.T) {
+	stub, url := newAuthzStub(t, allowPort22)
+	auth := NewExternalAuthorizer(url, "", time.Second, 0, false).Authorizer()
+
+	ok, err := auth(testAuthzPeer, Endpoint{remote: "10.0.0.5:22"})
+	if err != nil || !ok {
+		t.Fatalf("expected the endpoint to be allowed, got %v, %v", ok, err)
+	}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	ok, err = auth(testAuthzPeer, Endpoint{remote: "10.0.0.5:80"})
+	if err != nil || ok {
+		t.Fatalf("expected the endpoint to be denied, got %v, %v", ok, err)
+	}
+	if !strings.Contains(logs.String(), "only ssh") {
+		t.Errorf("expected the reason to be logged, got %q", logs.String())
+	}
+
+	req := stub.requests[0]
+	if req.Peer == nil || req.Peer.Name != "node" || req.Peer.Issuer != "abcd" || req.Peer.Labels["team"] != "db" {
+		t.Errorf("unexpected peer: %+v", req.Peer)
+	}
+	if req.Endpoint.Network != networkTCP || req.Endpoint.Address != "10.0.0.5:22" || req.Reverse {
+		t.Errorf("unexpected request: %+v", req)
+	}
+}
+
+func TestExternalAuthorizerReverse(t *testing.T) {
+	stub, url := newAuthzStub(t, func(req externalAuthzRequest) (int, externalAuthzResponse) {
+		return http.StatusOK, externalAuthzResponse{Allow: req.Reverse}
+	})
+	ea := NewExternalAuthorizer(url, "", time.Second, time.Minute, false)
+
+	if ok, _ := ea.ReverseAuthorizer()(nil, Endpoint{remote: "0.0.0.0:8080"}); !ok {
+		t.Error("expected the reverse address to be allowed")
+	}
+	if ok, _ := ea.Authorizer()(nil, Endpoint{remote: "0.0.0.0:8080"}); ok {
+		t.Error("expected the reverse decision not to be reused for the destination")
+	}
+	if stub.requests[0].Peer != nil {
+		t.Errorf("expected no peer for an unauthenticated one, got %+v", stub.requests[0].Peer)
+	}
+}
+
+func TestExternalAuthorizerCache(t *testing.T) {
+	stub, url := newAuthzStub(t, allowPort22)
+	auth := NewExternalAuthorizer(url, "", time.Second, 100*time.Millisecond, false).Authorizer()
+
+	ep := Endpoint{remote: "10.0.0.5:22"}
+	for i := 0; i < 3; i++ {
+		if ok, err := auth(testAuthzPeer, ep); !ok || err != nil {
+			t.Fatalf("expected the endpoint to be allowed, got %v, %v", ok, err)
+		}
+	}
+	if n := stub.count(); n != 1 {
+		t.Fatalf("expected a single request within the ttl, got %d", n)
+	}
+
+	other := &AetherportCertificate{Details: AetherportCertificateDetails{Name: "other"}, Signature: []byte{4}}
+	auth(other, ep)
+	auth(testAuthzPeer, Endpoint{remote: "10.0.0.6:22"})
+	if n := stub.count(); n != 3 {
+		t.Fatalf("expected decisions to be cached per peer and endpoint, got %d requests", n)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	auth(testAuthzPeer, ep)
+	if n := stub.count(); n != 4 {
+		t.Fatalf("expected the decision to be asked again after the ttl, got %d requests", n)
+	}
+}
+
+func TestExternalAuthorizerCacheSize(t *testing.T) {
+	ea := NewExternalAuthorizer("http://127.0.0.1:0", "", time.Second, time.Hour, false)
+	for i := 0; i <= externalAuthorizerCacheSize; i++ {
+		ea.store(externalAuthzKey{remote: strconv.Itoa(i)}, true)
+	}
+	if n := len(ea.cache); n != externalAuthorizerCacheSize {
+		t.Fatalf("expected the cache to be capped at %d decisions, got %d", externalAuthorizerCacheSize, n)
+	}
+	if _, found := ea.cached(externalAuthzKey{remote: "0"}); found {
+		t.Fatal("expected the oldest decision to be evicted")
+	}
+	if _, found := ea.cached(externalAuthzKey{remote: "1"}); !found {
+		t.Fatal("expected the newer decisions to be kept")
+	}
+}
+
+func TestExternalAuthorizerResolvedFrom(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	stub, url := newAuthzStub(t, func(req externalAuthzRequest) (int, externalAuthzResponse) {
+		return http.StatusOK, externalAuthzResponse{Allow: true}
+	})
+	auth := NewExternalAuthorizer(url, "", time.Second, 0, false).Authorizer()
+
+	conn, err := dialAuthorized(context.Background(), auth, nil, Endpoint{network: networkTCP, remote: "localhost:" + port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if stub.count() < 2 {
+		t.Fatalf("expected the hostname and its address to be asked, got %+v", stub.requests)
+	}
+	first, second := stub.requests[0].Endpoint, stub.requests[1].Endpoint
+	if first.Address != "localhost:"+port || first.ResolvedFrom != "" {
+		t.Errorf("expected the hostname to be asked first, got %+v", first)
+	}
+	if host, _, _ := net.SplitHostPort(second.Address); net.ParseIP(host) == nil || second.ResolvedFrom != "localhost" {
+		t.Errorf("expected a resolved address from localhost, got %+v", second)
+	}
+}
+
+func TestExternalAuthorizerFailure(t *testing.T) {
+	slow, slowURL := newAuthzStub(t, func(req externalAuthzRequest) (int, externalAuthzResponse) {
+		time.Sleep(300 * time.Millisecond)
+		return http.StatusOK, externalAuthzResponse{Allow: true}
+	})
+	_, errorURL := newAuthzStub(t, func(req externalAuthzRequest) (int, externalAuthzResponse) {
+		return http.StatusInternalServerError, externalAuthzResponse{}
+	})
+
+	tests := []struct {
+		name     string
+		url      string
+		failOpen bool
+		allow    bool
+	}{
+		{"timeout, fail closed", slowURL, false, false},
+		{"timeout, fail open", slowURL, true, true},
+		{"error status, fail closed", errorURL, false, false},
+		{"error status, fail open", errorURL, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := NewExternalAuthorizer(tt.url, "", 50*time.Millisecond, time.Minute, tt.failOpen).Authorizer()
+			ok, err := auth(testAuthzPeer, Endpoint{remote: "10.0.0.5:22"})
+			if ok != tt.allow {
+				t.Errorf("got %v, want %v", ok, tt.allow)
+			}
+			if !tt.failOpen && err == nil {
+				t.Error("expected the failure to be returned")
+			}
+		})
+	}
+
+	// failures are not cached, so the decision is asked again.
+	n := slow.count()
+	NewExternalAuthorizer(slowURL, "", time.Second, time.Minute, false).Authorizer()(testAuthzPeer, Endpoint{remote: "10.0.0.5:22"})
+	if slow.count() != n+1 {
+		t.Error("expected a new request after the failures")
+	}
+}
+
+func TestExternalAuthorizerExec(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "authz.sh")
+	err := os.WriteFile(script, []byte(`#!/bin/sh
+req=$(cat)
+echo "$req" >> "$(dirname "$0")/requests"
+case "$req" in
+*'"address":"10.0.0.5:22"'*) echo '{"allow": true}' ;;
+*'"address":"10.0.0.5:23"'*) exit 1 ;;
+*'"address":"10.0.0.5:24"'*) echo 'not json' ;;
+*) echo '{"allow": false, "reason": "nope"}' ;;
+esac
+`), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remote string
+		allow  bool
+		fails  bool
+	}{
+		{"10.0.0.5:22", true, false},
+		{"10.0.0.5:80", false, false},
+		{"10.0.0.5:23", false, true},
+		{"10.0.0.5:24", false, true},
+	}
+	auth := NewExternalAuthorizer("", script, time.Second, 0, false).Authorizer()
+	for _, tt := range tests {
+		ok, err := auth(testAuthzPeer, Endpoint{remote: tt.remote})
+		if ok != tt.allow || (err != nil) != tt.fails {
+			t.Errorf("%s: got %v, %v, want %v and failure %v", tt.remote, ok, err, tt.allow, tt.fails)
+		}
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "requests"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req externalAuthzRequest
+	if err = json.Unmarshal(bytes.SplitN(b, []byte("\n"), 2)[0], &req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Peer == nil || req.Peer.Name != "node" || req.Endpoint.Address != "10.0.0.5:22" {
+		t.Errorf("unexpected request on stdin: %s", b)
+	}
+
+	slow := NewExternalAuthorizer("", "sleep 1; echo '{\"allow\": true}'", 50*time.Millisecond, 0, false).Authorizer()
+	start := time.Now()
+	if ok, err := slow(testAuthzPeer, Endpoint{remote: "10.0.0.5:22"}); ok || err == nil {
+		t.Errorf("expected the slow command to fail, got %v, %v", ok, err)
+	}
+	if time.Since(start) > 900*time.Millisecond {
+		t.Error("expected the slow command to be killed at the timeout")
+	}
+}
+
+func TestExternalAuthorizerResponseSize(t *testing.T) {
+	huge := `{"allow": true, "reason": "` + strings.Repeat("x", 1<<20) + `"}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(huge))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name string
+		ea   *ExternalAuthorizer
+	}{
+		{"url", NewExternalAuthorizer(srv.URL, "", time.Second, 0, false)},
+		{"command", NewExternalAuthorizer("", `printf '{"allow": true, "reason": "'; head -c 1048576 /dev/zero | tr '\0' x; echo '"}'`, 5*time.Second, 0, false)},
+	}
+	for _, tt := range tests {
+		// the response is cut, so that it fails to parse instead of being read whole.
+		if ok, err := tt.ea.Authorizer()(testAuthzPeer, Endpoint{remote: "10.0.0.5:22"}); ok || err == nil {
+			t.Errorf("%s: expected an oversized response to fail, got %v, %v", tt.name, ok, err)
+		}
+	}
+
+	cb := &cappedBuffer{max: 4}
+	for _, s := range []string{"ab", "cdef", "gh"} {
+		if n, err := cb.Write([]byte(s)); n != len(s) || err != nil {
+			t.Fatalf("expected every write to succeed, got %d, %v", n, err)
+		}
+	}
+	if string(cb.Bytes()) != "abcd" {
+		t.Fatalf("expected the first bytes to be kept, got %q", cb.Bytes())
+	}
+}
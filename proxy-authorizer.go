@@ -0,0 +1,344 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// EndpointAuthorizer decides whether the peer presenting cert may use ep. cert is nil when the signaling does not
+// authenticate peers, as with tty.
+type EndpointAuthorizer = func(cert *AetherportCertificate, ep Endpoint) (ok bool, err error)
+
+// NewBasicEndpointAuthorizer allows the endpoints listed in epr, each written as '[!][<peer selector>@]<endpoint>'.
+// The endpoint is either '*' or '[<network>/]<host>:<port>'. The host is an IP, a CIDR, a hostname, '*.<domain>'
+// for any subdomain, or '*' for any host, and the port is a number, a '<from>-<to>' range, or '*'.
+// The optional selector limits the entry to peers matching every '&' separated term of 'name=<name>',
+// 'issuer=<ca fingerprint>', or 'label.<key>=<value>'. Entries starting with '!' deny the endpoint, taking precedence
+// over every allowing entry, and are also matched against the hostname a resolved address came from.
+func NewBasicEndpointAuthorizer(epr []string) (auth EndpointAuthorizer, err error) {
+	var allows, denies []endpointRule
+	for _, r := range epr {
+		rule, err := endpointRuleFromString(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allow rule: %s: %w", r, err)
+		}
+		if rule.deny {
+			denies = append(denies, rule)
+		} else {
+			allows = append(allows, rule)
+		}
+	}
+
+	return func(cert *AetherportCertificate, ep Endpoint) (bool, error) {
+		// a resolved address is checked along with the hostname it came from, either of them can be denied.
+		eps := authorizedForms(ep)
+		for _, r := range denies {
+			if r.match(cert, eps) {
+				return false, nil
+			}
+		}
+		for _, r := range allows {
+			if r.allows(cert, ep) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}, nil
+}
+
+// errUnallowedEndpoint is wrapped by authorizeEndpoint when the authorizer denies an endpoint.
+var errUnallowedEndpoint = errors.New("unallowed endpoint")
+
+// authorizeEndpoint checks ep against auth, returning the reason when it is not allowed. A nil auth allows everything.
+func authorizeEndpoint(auth EndpointAuthorizer, cert *AetherportCertificate, ep Endpoint) (ok bool, err error) {
+	if auth == nil {
+		return true, nil
+	}
+
+	ok, err = auth(cert, ep)
+	switch {
+	case err != nil:
+		return false, fmt.Errorf("error when authorizing endpoint: %s for %s: %w", ep.remoteString(), peerName(cert), err)
+	case !ok:
+		return false, fmt.Errorf("%w: %s for %s", errUnallowedEndpoint, ep.remoteString(), peerName(cert))
+	}
+	return true, nil
+}
+
+func peerName(cert *AetherportCertificate) string {
+	if cert == nil {
+		return "unauthenticated peer"
+	}
+	return "peer " + cert.Details.Name
+}
+
+// authorizedForms returns the forms of ep that rules are matched against: ep itself, and for a resolved address,
+// the hostname it was resolved from.
+func authorizedForms(ep Endpoint) []Endpoint {
+	if ep.resolvedHost == "" {
+		return []Endpoint{ep}
+	}
+	return []Endpoint{ep, ep.unresolved()}
+}
+
+type endpointRule struct {
+	deny bool
+	peer peerSelector
+	dest endpointPattern
+}
+
+func endpointRuleFromString(s string) (r endpointRule, err error) {
+	if strings.HasPrefix(s, "!") {
+		r.deny, s = true, s[1:]
+	}
+
+	// endpoints always have a colon before any '@', which may start an abstract unix socket path
+	if i := strings.Index(s, "@"); i >= 0 && !strings.Contains(s[:i], ":") {
+		if r.peer, err = peerSelectorFromString(s[:i]); err != nil {
+			return
+		}
+		s = s[i+1:]
+	}
+
+	r.dest, err = endpointPatternFromString(s)
+	return
+}
+
+func (r endpointRule) match(cert *AetherportCertificate, eps []Endpoint) bool {
+	if !r.peer.match(cert) {
+		return false
+	}
+	for _, ep := range eps {
+		if r.dest.match(ep) {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether r allows ep. A resolved address is allowed by an address or CIDR covering it, or by the
+// hostname it came from, except for a loopback or link-local address reached through a wildcard host. So '*' or
+// '*.<domain>' does not let a name resolving to the ingress itself, or to a metadata service, through.
+func (r endpointRule) allows(cert *AetherportCertificate, ep Endpoint) bool {
+	switch {
+	case !r.peer.match(cert):
+		return false
+	case ep.resolvedHost == "" || r.dest.host.ipnet != nil:
+		return r.dest.match(ep)
+	}
+	return r.dest.match(ep.unresolved()) && (r.dest.host.name != "" || !isInternalAddr(ep.remote))
+}
+
+// isInternalAddr reports whether addr is an unspecified, loopback, or link-local IP address.
+func isInternalAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsUnspecified() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast())
+}
+
+// endpointPattern matches the network and remote address of endpoints.
+type endpointPattern struct {
+	any     bool
+	network string
+
+	unix   string // exact unix socket address
+	host   hostMatcher
+	portLo int
+	portHi int
+}
+
+// endpointPatternFromString parses either '*' or '[<network>/]<host>:<port>' where host is an IP, a CIDR, a hostname,
+// '*.<domain>', or '*', and port is a number, a '<from>-<to>' range, or '*'.
+func endpointPatternFromString(s string) (p endpointPattern, err error) {
+	if s == "*" {
+		p.any = true
+		return
+	}
+
+	p.network, s = splitNetwork(s)
+	if isUnixAddr(s) {
+		p.unix = s
+		return
+	}
+
+	i := strings.LastIndex(s, ":")
+	if i < 0 {
+		return p, fmt.Errorf("missing port: %s", s)
+	}
+	if p.host, err = hostMatcherFromString(s[:i]); err != nil {
+		return
+	}
+	if p.portLo, p.portHi, err = parsePortRange(s[i+1:]); err != nil {
+		return
+	}
+	return
+}
+
+func parsePortRange(s string) (lo int, hi int, err error) {
+	if s == "*" {
+		return 0, 65535, nil
+	}
+
+	from, to, isRange := strings.Cut(s, "-")
+	if lo, err = strconv.Atoi(from); err != nil || lo < 0 || lo > 65535 {
+		return 0, 0, fmt.Errorf("invalid port: %s", from)
+	}
+	if !isRange {
+		return lo, lo, nil
+	}
+	if hi, err = strconv.Atoi(to); err != nil || hi < lo || hi > 65535 {
+		return 0, 0, fmt.Errorf("invalid port range: %s", s)
+	}
+	return
+}
+
+func (p endpointPattern) match(ep Endpoint) bool {
+	if p.any {
+		return true
+	}
+
+	network := ep.network
+	if network == "" {
+		network = networkTCP
+	}
+	if network != p.network {
+		return false
+	}
+
+	if isUnixAddr(ep.remote) || p.unix != "" {
+		return ep.remote == p.unix
+	}
+	host, port, err := net.SplitHostPort(ep.remote)
+	if err != nil {
+		return false
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < p.portLo || n > p.portHi {
+		return false
+	}
+	return p.host.match(host)
+}
+
+// hostMatcher matches the host part of an endpoint, which is either an IP address or a hostname.
+type hostMatcher struct {
+	any    bool
+	ipnet  *net.IPNet
+	name   string
+	suffix string // '.<domain>' of a '*.<domain>' wildcard
+}
+
+func hostMatcherFromString(s string) (h hostMatcher, err error) {
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	switch {
+	case s == "*":
+		h.any = true
+	case strings.Contains(s, "/"):
+		if _, h.ipnet, err = net.ParseCIDR(s); err != nil {
+			return h, fmt.Errorf("invalid cidr: %s", s)
+		}
+	case net.ParseIP(s) != nil:
+		ip := net.ParseIP(s)
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		h.ipnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	case strings.HasPrefix(s, "*."):
+		h.suffix = normalizeHostname(s[1:])
+	case s == "":
+		return h, fmt.Errorf("missing host")
+	default:
+		h.name = normalizeHostname(s)
+	}
+	return
+}
+
+func normalizeHostname(s string) string {
+	return strings.TrimSuffix(strings.ToLower(s), ".")
+}
+
+func (h hostMatcher) match(host string) bool {
+	if h.any {
+		return true
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return h.ipnet != nil && h.ipnet.Contains(ip)
+	}
+	host = normalizeHostname(host)
+	switch {
+	case h.name != "":
+		return host == h.name
+	case h.suffix != "":
+		return strings.HasSuffix(host, h.suffix)
+	}
+	return false
+}
+
+// peerSelector matches peer certificates. The zero value matches every peer, including an unauthenticated one.
+type peerSelector struct {
+	name   string
+	issuer string
+	labels []label
+}
+
+func peerSelectorFromString(s string) (ps peerSelector, err error) {
+	for _, term := range strings.Split(s, "&") {
+		k, v, ok := strings.Cut(term, "=")
+		switch {
+		case !ok || v == "":
+			return ps, fmt.Errorf("invalid peer selector: %s", term)
+		case k == "name":
+			ps.name = v
+		case k == "issuer":
+			ps.issuer = strings.ToLower(v)
+		case strings.HasPrefix(k, "label.") && len(k) > len("label."):
+			ps.labels = append(ps.labels, newLabel(strings.TrimPrefix(k, "label."), v))
+		default:
+			return ps, fmt.Errorf("unknown peer selector: %s", k)
+		}
+	}
+	return
+}
+
+func (ps peerSelector) isZero() bool {
+	return ps.name == "" && ps.issuer == "" && len(ps.labels) == 0
+}
+
+func (ps peerSelector) match(cert *AetherportCertificate) bool {
+	if ps.isZero() {
+		return true
+	}
+	if cert == nil {
+		return false
+	}
+
+	d := cert.Details
+	if ps.name != "" && ps.name != d.Name {
+		return false
+	}
+	if ps.issuer != "" && ps.issuer != d.Issuer {
+		return false
+	}
+	for _, l := range ps.labels {
+		if !hasLabel(d.Labels, l) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasLabel(labels []label, l label) bool {
+	for _, x := range labels {
+		if x == l {
+			return true
+		}
+	}
+	return false
+}
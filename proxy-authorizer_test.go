@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestHostMatcher(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		match   bool
+	}{
+		{"*", "10.0.0.1", true},
+		{"*", "example.com", true},
+		{"10.0.0.0/8", "10.1.2.3", true},
+		{"10.0.0.0/8", "11.0.0.1", false},
+		{"10.0.0.0/8", "example.com", false},
+		{"10.0.0.5", "10.0.0.5", true},
+		{"10.0.0.5", "10.0.0.6", false},
+		{"10.0.0.5", "::ffff:10.0.0.5", true},
+		{"[::1]", "::1", true},
+		{"fd00::/8", "fd12::1", true},
+		{"fd00::/8", "fe80::1", false},
+		{"example.com", "example.com", true},
+		{"example.com", "EXAMPLE.com.", true},
+		{"example.com", "www.example.com", false},
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "a.b.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "badexample.com", false},
+		{"*.example.com", "10.0.0.1", false},
+	}
+	for _, tt := range tests {
+		h, err := hostMatcherFromString(tt.pattern)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.pattern, err)
+		}
+		if got := h.match(tt.host); got != tt.match {
+			t.Errorf("%s matching %s: got %v, want %v", tt.pattern, tt.host, got, tt.match)
+		}
+	}
+}
+
+func TestHostMatcherInvalid(t *testing.T) {
+	for _, s := range []string{"", "10.0.0.0/33", "not-a-cidr/8"} {
+		if _, err := hostMatcherFromString(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestEndpointPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		ep      Endpoint
+		match   bool
+	}{
+		{"*", Endpoint{network: networkUDP, remote: "10.0.0.1:53"}, true},
+		{"10.0.0.5:22", Endpoint{remote: "10.0.0.5:22"}, true},
+		{"10.0.0.5:22", Endpoint{network: networkTCP, remote: "10.0.0.5:22"}, true},
+		{"10.0.0.5:22", Endpoint{network: networkUDP, remote: "10.0.0.5:22"}, false},
+		{"udp/10.0.0.5:53", Endpoint{network: networkUDP, remote: "10.0.0.5:53"}, true},
+		{"10.0.0.5:8000-8100", Endpoint{remote: "10.0.0.5:8000"}, true},
+		{"10.0.0.5:8000-8100", Endpoint{remote: "10.0.0.5:8100"}, true},
+		{"10.0.0.5:8000-8100", Endpoint{remote: "10.0.0.5:8101"}, false},
+		{"10.0.0.5:8000-8100", Endpoint{remote: "10.0.0.5:7999"}, false},
+		{"10.0.0.5:*", Endpoint{remote: "10.0.0.5:1"}, true},
+		{"10.0.0.0/24:443", Endpoint{remote: "10.0.0.200:443"}, true},
+		{"10.0.0.0/24:443", Endpoint{remote: "10.0.1.1:443"}, false},
+		{"*.example.com:443", Endpoint{remote: "api.example.com:443"}, true},
+		{"*.example.com:443", Endpoint{remote: "api.example.com:80"}, false},
+		{"[::1]:22", Endpoint{remote: "[::1]:22"}, true},
+		{"unix:/run/app.sock", Endpoint{remote: "unix:/run/app.sock"}, true},
+		{"unix:/run/app.sock", Endpoint{remote: "unix:/run/other.sock"}, false},
+		{"10.0.0.5:22", Endpoint{remote: "unix:/run/app.sock"}, false},
+	}
+	for _, tt := range tests {
+		p, err := endpointPatternFromString(tt.pattern)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.pattern, err)
+		}
+		if got := p.match(tt.ep); got != tt.match {
+			t.Errorf("%s matching %s/%s: got %v, want %v", tt.pattern, tt.ep.network, tt.ep.remote, got, tt.match)
+		}
+	}
+}
+
+func TestEndpointPatternInvalid(t *testing.T) {
+	for _, s := range []string{"10.0.0.5", "10.0.0.5:70000", "10.0.0.5:100-10", "10.0.0.5:a-b", ":22"} {
+		if _, err := endpointPatternFromString(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestBasicEndpointAuthorizer(t *testing.T) {
+	db := &AetherportCertificate{Details: AetherportCertificateDetails{
+		Name:   "db-client",
+		Issuer: "abcd",
+		Labels: []label{newLabel("team", "db")},
+	}}
+	other := &AetherportCertificate{Details: AetherportCertificateDetails{Name: "other", Issuer: "abcd"}}
+
+	auth, err := NewBasicEndpointAuthorizer([]string{
+		"10.0.0.0/8:*",
+		"!10.0.0.5:*",
+		"!label.team=db@10.0.1.0/24:5432",
+		"name=db-client&issuer=abcd@192.168.0.10:5432",
+		"*.internal:443",
+		"!secret.internal:443",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		cert  *AetherportCertificate
+		ep    Endpoint
+		allow bool
+	}{
+		{"allowed cidr", other, Endpoint{remote: "10.1.0.1:22"}, true},
+		{"deny wins over an earlier allow", other, Endpoint{remote: "10.0.0.5:22"}, false},
+		{"deny limited to a peer", db, Endpoint{remote: "10.0.1.7:5432"}, false},
+		{"deny of another peer", other, Endpoint{remote: "10.0.1.7:5432"}, true},
+		{"allow limited to a peer", db, Endpoint{remote: "192.168.0.10:5432"}, true},
+		{"allow of another peer", other, Endpoint{remote: "192.168.0.10:5432"}, false},
+		{"unauthenticated peer", nil, Endpoint{remote: "192.168.0.10:5432"}, false},
+		{"wildcard hostname", other, Endpoint{remote: "git.internal:443"}, true},
+		{"denied hostname", other, Endpoint{remote: "secret.internal:443"}, false},
+		{"nothing matching", other, Endpoint{remote: "8.8.8.8:53"}, false},
+		{
+			"resolved address of an allowed hostname",
+			other, Endpoint{remote: "172.16.0.1:443", resolvedHost: "git.internal"}, true,
+		},
+		{
+			"resolved address of a denied hostname",
+			other, Endpoint{remote: "10.9.9.9:443", resolvedHost: "secret.internal"}, false,
+		},
+		{
+			"denied address of an allowed hostname",
+			other, Endpoint{remote: "10.0.0.5:443", resolvedHost: "git.internal"}, false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, err := auth(tt.cert, tt.ep)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.allow {
+				t.Errorf("got %v, want %v", ok, tt.allow)
+			}
+		})
+	}
+}
+
+func TestBasicEndpointAuthorizerInvalid(t *testing.T) {
+	for _, r := range []string{"10.0.0.5", "nope=x@10.0.0.5:22", "name@10.0.0.5:22"} {
+		if _, err := NewBasicEndpointAuthorizer([]string{r}); err == nil {
+			t.Errorf("%q: expected an error", r)
+		}
+	}
+}
+
+func TestDialAuthorizedRechecksResolvedAddresses(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	ep := Endpoint{network: networkTCP, remote: net.JoinHostPort("localhost", port)}
+
+	allowed, err := NewBasicEndpointAuthorizer([]string{"localhost:*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialAuthorized(context.Background(), allowed, nil, ep)
+	if err != nil {
+		t.Fatalf("expected the hostname to be dialed: %v", err)
+	}
+	conn.Close()
+
+	denied, err := NewBasicEndpointAuthorizer([]string{"localhost:*", "!127.0.0.0/8:*", "![::1]:*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = dialAuthorized(context.Background(), denied, nil, ep); !errors.Is(err, errUnallowedEndpoint) {
+		t.Fatalf("expected the resolved address to be denied, got %v", err)
+	}
+}
+
+func TestBasicEndpointAuthorizerInternalAddresses(t *testing.T) {
+	tests := []struct {
+		rules []string
+		ep    Endpoint
+		allow bool
+	}{
+		{[]string{"*.example.com:443"}, Endpoint{remote: "127.0.0.1:443", resolvedHost: "api.example.com"}, false},
+		{[]string{"*.example.com:443"}, Endpoint{remote: "[::1]:443", resolvedHost: "api.example.com"}, false},
+		{[]string{"*.example.com:443"}, Endpoint{remote: "169.254.169.254:443", resolvedHost: "api.example.com"}, false},
+		{[]string{"*.example.com:443"}, Endpoint{remote: "[fe80::1]:443", resolvedHost: "api.example.com"}, false},
+		{[]string{"*.example.com:443"}, Endpoint{remote: "0.0.0.0:443", resolvedHost: "api.example.com"}, false},
+		{[]string{"*.example.com:443"}, Endpoint{remote: "10.0.0.5:443", resolvedHost: "api.example.com"}, true},
+		{[]string{"*"}, Endpoint{remote: "127.0.0.1:443", resolvedHost: "api.example.com"}, false},
+		{[]string{"*:*"}, Endpoint{remote: "169.254.169.254:80", resolvedHost: "metadata.example.com"}, false},
+		{[]string{"*"}, Endpoint{remote: "127.0.0.1:443"}, true},
+		{[]string{"*.example.com:443", "127.0.0.1:443"}, Endpoint{remote: "127.0.0.1:443", resolvedHost: "api.example.com"}, true},
+		{[]string{"*.example.com:443", "127.0.0.0/8:*"}, Endpoint{remote: "127.0.0.1:443", resolvedHost: "api.example.com"}, true},
+		{[]string{"api.example.com:443"}, Endpoint{remote: "127.0.0.1:443", resolvedHost: "api.example.com"}, true},
+		{[]string{"api.example.com:443", "!127.0.0.0/8:*"}, Endpoint{remote: "127.0.0.1:443", resolvedHost: "api.example.com"}, false},
+		{[]string{"10.0.0.0/8:*"}, Endpoint{remote: "10.0.0.5:443", resolvedHost: "api.example.com"}, true},
+	}
+	for _, tt := range tests {
+		auth, err := NewBasicEndpointAuthorizer(tt.rules)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, _ := auth(nil, tt.ep); ok != tt.allow {
+			t.Errorf("%v, %s resolved from %s: got %v, want %v", tt.rules, tt.ep.remote, tt.ep.resolvedHost, ok, tt.allow)
+		}
+	}
+}
+
+func TestDialAuthorizedDeniesWildcardInternalAddresses(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	auth, err := NewBasicEndpointAuthorizer([]string{"*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialAuthorized(context.Background(), auth, nil, Endpoint{network: networkTCP, remote: net.JoinHostPort("localhost", port)})
+	if err == nil {
+		conn.Close()
+		t.Fatal("expected a hostname allowed by a wildcard not to reach a loopback address")
+	}
+	if !errors.Is(err, errUnallowedEndpoint) {
+		t.Fatalf("expected the resolved address to be unallowed, got %v", err)
+	}
+}
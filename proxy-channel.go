@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Multiplexing of the streams of a forward: smux streams sharing a single data channel, or a data channel per stream
+// multiplexed by SCTP itself.
+const (
+	muxSmux = "smux"
+	muxSCTP = "sctp"
+)
+
+// channelStreamLabel is the label of the data channels each carrying a single stream.
+const channelStreamLabel = "aetherport/stream"
+
+const (
+	// channelStreamMinID leaves the lower data channel IDs to the channels pion assigns one to, such as the smux and
+	// UDP ones, as it picks them from the bottom.
+	channelStreamMinID = 1024
+
+	// channelStreamIDs is how many IDs the data channels of streams take turns on, a few times channelStreamMaxOpen so
+	// that an ID is used again long after its channel was closed.
+	channelStreamIDs = 4 * channelStreamMaxOpen
+
+	// channelMessageSize is the largest message written to the data channel of a stream, well below the 64KiB
+	// DataChannelConn reads at once.
+	channelMessageSize = 16 * 1024
+
+	// channelStreamMaxOpen is how many streams may be carried by data channels of their own at once. Further ones are
+	// carried by the smux session.
+	channelStreamMaxOpen = 1024
+
+	// channelStreamMaxTotal is how many data channels of their own the streams of a peer connection may ever use. pion
+	// keeps every data channel until the peer connection is closed, about 2KiB on each side once its stream is closed,
+	// so the later streams are carried by the smux session instead.
+	channelStreamMaxTotal = 16384
+
+	// channelStreamAckTimeout bounds opening the data channel of a stream and waiting for the ingress to acknowledge
+	// it, which includes dialing the destination.
+	channelStreamAckTimeout = 2 * time.Minute
+)
+
+// errNoChannelStream is returned once a stream can not be carried by a data channel of its own.
+var errNoChannelStream = errors.New("no data channel left for a stream")
+
+func isMux(s string) bool {
+	return s == muxSmux || s == muxSCTP
+}
+
+// dataChannelIDs hands out the IDs of the data channels carrying a stream, with the parity the DTLS role of the egress
+// dictates: even as the DTLS client, odd as the server. They are taken from a range of their own, as pion picks the IDs
+// of the other channels from the bottom. The ID of a closed channel is queued behind every other free one, which
+// leaves its reset plenty of time to complete on both sides before it is used again. No more than
+// channelStreamMaxOpen are handed out at once, and channelStreamMaxTotal overall.
+type dataChannelIDs struct {
+	mu     sync.Mutex
+	free   []uint16
+	opened int
+	full   bool
+}
+
+func newDataChannelIDs(role webrtc.DTLSRole) *dataChannelIDs {
+	first := channelStreamMinID
+	if role != webrtc.DTLSRoleClient {
+		first++
+	}
+
+	ids := &dataChannelIDs{free: make([]uint16, channelStreamIDs)}
+	for i := range ids.free {
+		ids.free[i] = uint16(first + 2*i)
+	}
+	return ids
+}
+
+func (ids *dataChannelIDs) acquire() (id uint16, err error) {
+	ids.mu.Lock()
+	defer ids.mu.Unlock()
+
+	if ids.opened >= channelStreamMaxTotal {
+		return 0, errNoChannelStream
+	}
+	if channelStreamIDs-len(ids.free) >= channelStreamMaxOpen {
+		if !ids.full {
+			ids.full = true
+			log.Println("egress:", channelStreamMaxOpen, "streams are open on data channels of their own, carrying the next ones on the smux session")
+		}
+		return 0, errNoChannelStream
+	}
+
+	id, ids.free, ids.full = ids.free[0], ids.free[1:], false
+	if ids.opened++; ids.opened == channelStreamMaxTotal {
+		log.Println("egress: data channels per stream used up, carrying the next streams on the smux session")
+	}
+	return id, nil
+}
+
+func (ids *dataChannelIDs) release(id uint16) {
+	ids.mu.Lock()
+	defer ids.mu.Unlock()
+	ids.free = append(ids.free, id)
+}
+
+// offererDTLSRole returns the DTLS role of the offerer of peer, which is the client only when the answer asks to be
+// the server.
+func offererDTLSRole(peer *webrtc.PeerConnection) webrtc.DTLSRole {
+	if d := peer.RemoteDescription(); d != nil && strings.Contains(d.SDP, "a=setup:passive") {
+		return webrtc.DTLSRoleClient
+	}
+	return webrtc.DTLSRoleServer
+}
+
+// channelConn is a stream carried by a data channel of its own.
+type channelConn struct {
+	*DataChannelConn
+
+	onClose   func()
+	closeOnce sync.Once
+}
+
+func newChannelConn(ctx context.Context, dc *webrtc.DataChannel, onClose func()) (cc *channelConn, err error) {
+	dcc, err := NewDataChannelConn(ctx, dc)
+	if err != nil {
+		dc.Close()
+		return nil, err
+	}
+	return &channelConn{DataChannelConn: dcc, onClose: onClose}, nil
+}
+
+// Write splits b into messages of up to channelMessageSize bytes.
+func (cc *channelConn) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		m := len(b)
+		if m > channelMessageSize {
+			m = channelMessageSize
+		}
+
+		k, err := cc.DataChannelConn.Write(b[:m])
+		if n += k; err != nil {
+			return n, err
+		}
+		b = b[m:]
+	}
+	return
+}
+
+// Close resets the data channel, then calls onClose once. The callback holding the connection is removed, so that the
+// channel pion keeps does not hold its buffers too.
+func (cc *channelConn) Close() (err error) {
+	err = cc.DataChannelConn.Close()
+	cc.OnBufferedAmountLow(nil)
+	if cc.onClose != nil {
+		cc.closeOnce.Do(cc.onClose)
+	}
+	return
+}
+
+// openChannelStream opens a stream on a data channel of its own instead of the smux session, writes h and data, and
+// waits for the ingress to acknowledge it. errNoChannelStream is returned when no more data channel can be used.
+func (egp *EgressProxy) openChannelStream(h streamHeader, data []byte) (conn net.Conn, err error) {
+	egp.mu.Lock()
+	ctx, ids := egp.tunnelsCtx, egp.channelIDs
+	egp.mu.Unlock()
+
+	id, err := ids.acquire()
+	if err != nil {
+		return nil, err
+	}
+	dc, err := egp.peer.CreateDataChannel(channelStreamLabel, &webrtc.DataChannelInit{ID: &id})
+	if err != nil {
+		ids.release(id)
+		return nil, fmt.Errorf("create data channel failed: %w", err)
+	}
+
+	deadline := time.Now().Add(channelStreamAckTimeout)
+	octx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	stream, err := newChannelConn(octx, dc, func() { ids.release(id) })
+	if err != nil {
+		ids.release(id)
+		return nil, fmt.Errorf("open datachannel error: %w", err)
+	}
+
+	stream.SetReadDeadline(deadline)
+	if conn, err = startStream(stream, h, data); err != nil {
+		return nil, err
+	}
+	stream.SetReadDeadline(time.Time{})
+	return
+}
+
+// acceptChannelStream counts a data channel carrying a stream, reporting false once the peer connection has had
+// channelStreamMaxTotal of them, as pion keeps them all.
+func (igp *IngressProxy) acceptChannelStream() bool {
+	return atomic.AddInt32(&igp.channelStreams, 1) <= channelStreamMaxTotal
+}
+
+// serveChannelStream serves the single stream carried by dc.
+func (igp *IngressProxy) serveChannelStream(ctx context.Context, dc *webrtc.DataChannel) (err error) {
+	stream, err := newChannelConn(ctx, dc, nil)
+	if err != nil {
+		return fmt.Errorf("open datachannel error: %w", err)
+	}
+	return igp.handleStream(ctx, nil, stream)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/xtaci/smux"
+)
+
+// newTestPeers connects two peer connections in process, returning the offerer and the data channels the answerer
+// gets.
+func newTestPeers(tb testing.TB) (offerer *webrtc.PeerConnection, channels <-chan *webrtc.DataChannel) {
+	s := webrtc.SettingEngine{}
+	s.DetachDataChannels()
+	api := webrtc.NewAPI(webrtc.WithSettingEngine(s))
+
+	offerer, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	answerer, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		offerer.Close()
+		answerer.Close()
+	})
+
+	dcs := make(chan *webrtc.DataChannel, 64)
+	answerer.OnDataChannel(func(dc *webrtc.DataChannel) { dcs <- dc })
+
+	// a first data channel, so that the offer carries the SCTP transport.
+	if _, err = offerer.CreateDataChannel(muxLabel, nil); err != nil {
+		tb.Fatal(err)
+	}
+	offer, err := offerer.CreateOffer(nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(offerer)
+	if err = offerer.SetLocalDescription(offer); err != nil {
+		tb.Fatal(err)
+	}
+	<-gathered
+	if err = answerer.SetRemoteDescription(*offerer.LocalDescription()); err != nil {
+		tb.Fatal(err)
+	}
+	answer, err := answerer.CreateAnswer(nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	gathered = webrtc.GatheringCompletePromise(answerer)
+	if err = answerer.SetLocalDescription(answer); err != nil {
+		tb.Fatal(err)
+	}
+	<-gathered
+	if err = offerer.SetRemoteDescription(*answerer.LocalDescription()); err != nil {
+		tb.Fatal(err)
+	}
+	return offerer, dcs
+}
+
+func TestDataChannelIDs(t *testing.T) {
+	ids := newDataChannelIDs(webrtc.DTLSRoleServer)
+	first, err := ids.acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first%2 != 1 || first < channelStreamMinID {
+		t.Fatalf("expected an odd ID from %d for the DTLS server, got %d", channelStreamMinID, first)
+	}
+	if id, _ := newDataChannelIDs(webrtc.DTLSRoleClient).acquire(); id%2 != 0 {
+		t.Fatalf("expected an even ID for the DTLS client, got %d", id)
+	}
+
+	ids.release(first)
+	seen := map[uint16]bool{first: true}
+	for i := 1; i < channelStreamIDs; i++ {
+		id, err := ids.acquire()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[id] || id%2 != 1 {
+			t.Fatalf("unexpected ID %d", id)
+		}
+		seen[id] = true
+		ids.release(id)
+	}
+	if id, _ := ids.acquire(); id != first {
+		t.Fatalf("expected the released ID %d to be used again once the others were, got %d", first, id)
+	}
+}
+
+func TestDataChannelIDsMaxOpen(t *testing.T) {
+	ids := newDataChannelIDs(webrtc.DTLSRoleServer)
+	var last uint16
+	for i := 0; i < channelStreamMaxOpen; i++ {
+		id, err := ids.acquire()
+		if err != nil {
+			t.Fatal(err)
+		}
+		last = id
+	}
+	if _, err := ids.acquire(); err != errNoChannelStream {
+		t.Fatalf("expected no ID past %d open channels, got %v", channelStreamMaxOpen, err)
+	}
+	ids.release(last)
+	if _, err := ids.acquire(); err != nil {
+		t.Fatalf("expected an ID once a channel is closed, got %v", err)
+	}
+}
+
+func TestOffererDTLSRole(t *testing.T) {
+	offerer, _ := newTestPeers(t)
+	if role := offererDTLSRole(offerer); role != webrtc.DTLSRoleServer {
+		t.Fatalf("expected the offerer to be the DTLS server of an active answer, got %s", role)
+	}
+}
+
+// BenchmarkStreams compares carrying concurrent streams on a single smux session with a data channel each.
+func BenchmarkStreams(b *testing.B) {
+	const streams, size = 8, 256 * 1024
+	payload := make([]byte, size)
+
+	b.Run(muxSmux, func(b *testing.B) {
+		offerer, dcs := newTestPeers(b)
+		ctx := context.Background()
+
+		dc, err := offerer.CreateDataChannel(muxLabel+"/bench", nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		client, err := NewDataChannelConn(ctx, dc)
+		if err != nil {
+			b.Fatal(err)
+		}
+		server, err := NewDataChannelConn(ctx, waitDataChannel(b, dcs, muxLabel+"/bench"))
+		if err != nil {
+			b.Fatal(err)
+		}
+		cs, err := smux.Client(client, muxConfig(0))
+		if err != nil {
+			b.Fatal(err)
+		}
+		ss, err := smux.Server(server, muxConfig(0))
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer cs.Close()
+		defer ss.Close()
+
+		accepted := make(chan net.Conn, streams)
+		go func() {
+			for {
+				s, err := ss.AcceptStream()
+				if err != nil {
+					return
+				}
+				accepted <- s
+			}
+		}()
+		benchmarkStreams(b, streams, payload, func() (net.Conn, net.Conn) {
+			s, err := cs.OpenStream()
+			if err != nil {
+				b.Fatal(err)
+			}
+			return s, <-accepted
+		})
+	})
+
+	b.Run(muxSCTP, func(b *testing.B) {
+		offerer, dcs := newTestPeers(b)
+		ctx := context.Background()
+		waitDataChannel(b, dcs, muxLabel)
+		ids := newDataChannelIDs(offererDTLSRole(offerer))
+
+		benchmarkStreams(b, streams, payload, func() (net.Conn, net.Conn) {
+			id, err := ids.acquire()
+			if err != nil {
+				b.Fatal(err)
+			}
+			dc, err := offerer.CreateDataChannel(channelStreamLabel, &webrtc.DataChannelInit{ID: &id})
+			if err != nil {
+				b.Fatal(err)
+			}
+			client, err := newChannelConn(ctx, dc, func() { ids.release(id) })
+			if err != nil {
+				b.Fatal(err)
+			}
+			server, err := newChannelConn(ctx, waitDataChannel(b, dcs, channelStreamLabel), nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			return client, server
+		})
+	})
+}
+
+// benchmarkStreams opens streams pairs of connections with open for every iteration, and writes payload on each of
+// them concurrently until the other end has read it all.
+func benchmarkStreams(b *testing.B, streams int, payload []byte, open func() (net.Conn, net.Conn)) {
+	b.SetBytes(int64(streams * len(payload)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		for j := 0; j < streams; j++ {
+			client, server := open()
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				client.Write(payload)
+			}()
+			go func() {
+				defer wg.Done()
+				defer client.Close()
+				defer server.Close()
+				if _, err := io.ReadFull(server, make([]byte, len(payload))); err != nil {
+					b.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+func waitDataChannel(tb testing.TB, dcs <-chan *webrtc.DataChannel, label string) *webrtc.DataChannel {
+	for dc := range dcs {
+		if dc.Label() == label {
+			return dc
+		}
+	}
+	tb.Fatal("no data channel", label)
+	return nil
+}
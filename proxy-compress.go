@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression algorithms of the streams of a forward.
+const (
+	compressionNone   = "none"
+	compressionZstd   = "zstd"
+	compressionSnappy = "snappy"
+)
+
+// zstdWindowSize is the window of both ends of a stream, the decoder refusing any larger one so that a peer can not
+// make it allocate more.
+const zstdWindowSize = 1 << 20
+
+func isCompression(s string) bool {
+	return s == compressionNone || s == compressionZstd || s == compressionSnappy
+}
+
+// compressedConn compresses what is written to a connection and decompresses what is read from it. Every write is
+// flushed right away, so that interactive traffic is not held back waiting for more data.
+type compressedConn struct {
+	net.Conn
+	r io.Reader
+
+	mu sync.Mutex
+	w  interface {
+		io.WriteCloser
+		Flush() error
+	}
+	closed bool
+
+	// freeR releases the decompressor, once reading failed so that it is not used concurrently.
+	freeR    func()
+	freeOnce sync.Once
+}
+
+func newCompressedConn(conn net.Conn, algorithm string) (cc *compressedConn, err error) {
+	cc = &compressedConn{Conn: conn, freeR: func() {}}
+	switch algorithm {
+	case compressionZstd:
+		w, err := zstd.NewWriter(conn, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(zstdWindowSize))
+		if err != nil {
+			return nil, fmt.Errorf("create zstd writer failed: %w", err)
+		}
+		r, err := zstd.NewReader(conn, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(zstdWindowSize))
+		if err != nil {
+			w.Close()
+			return nil, fmt.Errorf("create zstd reader failed: %w", err)
+		}
+		cc.w, cc.r, cc.freeR = w, r, r.Close
+
+	case compressionSnappy:
+		cc.w, cc.r = snappy.NewBufferedWriter(conn), snappy.NewReader(conn)
+
+	default:
+		return nil, fmt.Errorf("unknown compression: %s", algorithm)
+	}
+	return
+}
+
+func (cc *compressedConn) Read(b []byte) (n int, err error) {
+	if n, err = cc.r.Read(b); err != nil {
+		cc.freeOnce.Do(cc.freeR)
+	}
+	return
+}
+
+func (cc *compressedConn) Write(b []byte) (n int, err error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if cc.closed {
+		return 0, net.ErrClosed
+	}
+	if n, err = cc.w.Write(b); err != nil {
+		return
+	}
+	err = cc.w.Flush()
+	return
+}
+
+// Close ends the compressed stream before closing the connection.
+func (cc *compressedConn) Close() error {
+	cc.mu.Lock()
+	if !cc.closed {
+		cc.closed = true
+		cc.w.Close()
+	}
+	cc.mu.Unlock()
+
+	return cc.Conn.Close()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestCompressedConn(t *testing.T) {
+	for _, algorithm := range []string{compressionZstd, compressionSnappy} {
+		t.Run(algorithm, func(t *testing.T) {
+			// the pipe is closed rather than the compressed connections, whose closing writes to it.
+			a, b := net.Pipe()
+			defer a.Close()
+			defer b.Close()
+			ca, err := newCompressedConn(a, algorithm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cb, err := newCompressedConn(b, algorithm)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// every message is read before the next one is written, as for interactive traffic.
+			for _, m := range [][]byte{[]byte("ping"), bytes.Repeat([]byte("aetherport "), 4096), []byte("pong")} {
+				go ca.Write(m)
+				got := make([]byte, len(m))
+				if _, err := io.ReadFull(cb, got); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, m) {
+					t.Fatalf("expected %d bytes to round trip, got %q", len(m), got)
+				}
+			}
+		})
+	}
+}
+
+func TestStreamCompressionNegotiation(t *testing.T) {
+	tests := []struct {
+		compression string
+		compressed  bool
+	}{
+		{compression: compressionZstd, compressed: true},
+		{compression: compressionSnappy, compressed: true},
+		{compression: compressionNone},
+		{compression: ""},
+		{compression: "lz4"},
+	}
+	for _, tt := range tests {
+		client, server := newTestConnPair(t)
+
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			defer close(accepted)
+			h, err := readStreamHeader(server)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conn, err := ackStream(server, h)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			accepted <- conn
+		}()
+
+		conn, err := startStream(client, streamHeader{Network: networkTCP, Compression: tt.compression}, nil)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.compression, err)
+		}
+		sconn := <-accepted
+		if sconn == nil {
+			t.FailNow()
+		}
+
+		_, cok := conn.(*compressedConn)
+		_, sok := sconn.(*compressedConn)
+		if cok != tt.compressed || sok != tt.compressed {
+			t.Fatalf("%q: expected compressed to be %v, got %v for the opener and %v for the receiver", tt.compression, tt.compressed, cok, sok)
+		}
+
+		conn.Write([]byte("hello"))
+		got := make([]byte, 5)
+		if _, err = io.ReadFull(sconn, got); err != nil || string(got) != "hello" {
+			t.Fatalf("%q: expected hello, got %q: %v", tt.compression, got, err)
+		}
+		conn.Close()
+		sconn.Close()
+	}
+}
+
+// newTestConnPair returns both ends of a loopback TCP connection, which unlike a pipe buffers what is written.
+func newTestConnPair(t *testing.T) (client net.Conn, server net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if client, err = net.Dial("tcp", l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if server, err = l.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// EgressEndpoints holds the endpoints forwarded by the egress so they can be changed at runtime.
+// Changes are applied to the EgressProxy attached for the ingress group of the endpoint, and kept for the ones created
+// after reconnecting, along with the local listeners of the endpoints.
+type EgressEndpoints struct {
+	mu        sync.Mutex
+	eps       []Endpoint
+	groups    map[string]bool
+	proxies   map[string]*EgressProxy
+	listeners *EgressListeners
+}
+
+// NewEgressEndpoints returns the endpoints forwarded through the given ingress groups, whose connections wait up to
+// reconnectWait for a tunnel to be available.
+func NewEgressEndpoints(eps []Endpoint, groups []string, reconnectWait time.Duration) (ee *EgressEndpoints, err error) {
+	ee = &EgressEndpoints{
+		groups:    map[string]bool{},
+		proxies:   map[string]*EgressProxy{},
+		listeners: NewEgressListeners(reconnectWait),
+	}
+	for _, g := range groups {
+		ee.groups[g] = true
+	}
+	for _, ep := range eps {
+		if err = ee.checkGroup(ep); err != nil {
+			return nil, err
+		}
+	}
+	ee.eps = eps
+	return
+}
+
+func (ee *EgressEndpoints) checkGroup(ep Endpoint) error {
+	if !ee.groups[ep.options.ingress] {
+		return fmt.Errorf("no ingress for endpoint %s: unknown ingress group '%s'", ep, ep.options.ingress)
+	}
+	return nil
+}
+
+// attach makes egp the proxy receiving subsequent changes to the endpoints of group, sharing the listeners with it,
+// and returns the endpoints it should forward.
+func (ee *EgressEndpoints) attach(egp *EgressProxy, group string) (eps []Endpoint) {
+	ee.mu.Lock()
+	defer ee.mu.Unlock()
+
+	ee.proxies[group], egp.listeners = egp, ee.listeners
+	for _, ep := range ee.eps {
+		if ep.options.ingress == group {
+			eps = append(eps, ep)
+		}
+	}
+	return
+}
+
+func (ee *EgressEndpoints) detach(egp *EgressProxy, group string) {
+	ee.mu.Lock()
+	defer ee.mu.Unlock()
+
+	if ee.proxies[group] == egp {
+		delete(ee.proxies, group)
+	}
+}
+
+func (ee *EgressEndpoints) List() []Endpoint {
+	ee.mu.Lock()
+	defer ee.mu.Unlock()
+
+	return append([]Endpoint{}, ee.eps...)
+}
+
+func (ee *EgressEndpoints) Add(ep Endpoint) (err error) {
+	ee.mu.Lock()
+	defer ee.mu.Unlock()
+
+	for _, e := range ee.eps {
+		if e.String() == ep.String() {
+			return fmt.Errorf("endpoint already exists: %s", ep)
+		}
+	}
+	if err = ee.checkGroup(ep); err != nil {
+		return
+	}
+	// listened on right away, so that an address already in use is reported rather than logged by the tunnel.
+	if err = ee.listeners.listen(ep); err != nil {
+		return fmt.Errorf("listen to local socket failed: %w", err)
+	}
+	if p := ee.proxies[ep.options.ingress]; p != nil {
+		if err = p.AddEndpoint(ep); err != nil {
+			ee.listeners.close(ep)
+			return
+		}
+	}
+	ee.eps = append(ee.eps, ep)
+	ee.listeners.notify(ep.options.ingress)
+	return
+}
+
+func (ee *EgressEndpoints) Remove(ep Endpoint) (err error) {
+	ee.mu.Lock()
+	defer ee.mu.Unlock()
+
+	i := -1
+	for j, e := range ee.eps {
+		if e.String() == ep.String() {
+			i = j
+		}
+	}
+	if i < 0 {
+		return fmt.Errorf("endpoint does not exist: %s", ep)
+	}
+	if p := ee.proxies[ee.eps[i].options.ingress]; p != nil {
+		if err = p.RemoveEndpoint(ep); err != nil {
+			return
+		}
+	}
+	ee.listeners.close(ep)
+	ee.eps = append(ee.eps[:i:i], ee.eps[i+1:]...)
+	return
+}
+
+// waitDemand listens on the local addresses of the endpoints of group, then waits for a local connection to need a
+// tunnel. It returns right away when an endpoint of group needs the peer connection regardless.
+func (ee *EgressEndpoints) waitDemand(ctx context.Context, group string) (err error) {
+	for {
+		if !ee.listenOnDemand(group) {
+			return
+		}
+		waiting, err := ee.listeners.waitDemand(ctx, group)
+		if err != nil || waiting {
+			return err
+		}
+	}
+}
+
+// listenOnDemand listens on the local addresses of the endpoints of group, reporting false when one of them is not
+// forwarded on demand.
+func (ee *EgressEndpoints) listenOnDemand(group string) bool {
+	ee.mu.Lock()
+	defer ee.mu.Unlock()
+
+	for _, ep := range ee.eps {
+		if ep.options.ingress != group {
+			continue
+		}
+		if !ep.isOnDemand() {
+			return false
+		}
+		if _, err := ee.listeners.stream(ep); err != nil {
+			log.Println("egress: listen to local socket failed:", err)
+		}
+	}
+	return true
+}
+
+// Close closes the listeners of every endpoint.
+func (ee *EgressEndpoints) Close() (err error) {
+	return ee.listeners.Close()
+}
+
+// checkListenable fails unless the local side of ep is an address a forward added at runtime can listen on, that is an
+// '<ip>:<port>' or a 'unix:<path>'.
+func checkListenable(ep Endpoint) error {
+	if isUnixAddr(ep.local) {
+		if _, path := splitAddr(ep.local); path == "" {
+			return fmt.Errorf("empty unix socket path: %s", ep)
+		}
+		return nil
+	}
+	_, port, err := net.SplitHostPort(ep.local)
+	if err != nil {
+		return fmt.Errorf("local address can not be listened on: %s", ep)
+	}
+	if _, err = strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid local port: %s", ep)
+	}
+	return nil
+}
+
+// controlHeader must be set on the requests changing forwards. A web page can not send it to another origin without a
+// CORS preflight, which the API does not allow.
+const controlHeader = "X-Aetherport-Control"
+
+// checkControlRequest rejects the requests a web page may have sent: those whose Host or Origin is not a loopback
+// address, as with DNS rebinding, and those changing forwards without controlHeader.
+func checkControlRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host != "" && !isLoopbackHost(host) {
+			http.Error(w, "host is not a loopback address", http.StatusForbidden)
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" {
+			if u, err := url.Parse(origin); err != nil || !isLoopbackHost(u.Hostname()) {
+				http.Error(w, "origin is not a loopback address", http.StatusForbidden)
+				return
+			}
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Header.Get(controlHeader) == "" {
+			http.Error(w, "missing "+controlHeader+" header", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// NewEgressControlHandler serves the API to list, add, and remove forwards. Endpoints are sent as plain text in the same
+// format as the '--forward' flag, and changes require the controlHeader header.
+func NewEgressControlHandler(ee *EgressEndpoints) *chi.Mux {
+	r := chi.NewRouter()
+	r.Use(checkControlRequest)
+
+	r.Get("/forwards", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "text/plain")
+		for _, ep := range ee.List() {
+			fmt.Fprintln(w, ep)
+		}
+	})
+
+	endpoint := func(r *http.Request) (ep Endpoint, err error) {
+		b, err := io.ReadAll(io.LimitReader(r.Body, 4096))
+		if err != nil {
+			return ep, fmt.Errorf("read request body failed: %w", err)
+		}
+		return EndpointFromString(strings.TrimSpace(string(b)))
+	}
+
+	r.Post("/forwards", func(w http.ResponseWriter, r *http.Request) {
+		ep, err := endpoint(r)
+		if err == nil {
+			err = checkListenable(ep)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = ee.Add(ep); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	r.Delete("/forwards", func(w http.ResponseWriter, r *http.Request) {
+		ep, err := endpoint(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = ee.Remove(ep); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return r
+}
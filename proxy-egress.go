@@ -2,33 +2,65 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pion/webrtc/v3"
 	"github.com/xtaci/smux"
 )
 
+// idleCheckInterval is the delay between checks of the streams of an egress closed when idle.
+const idleCheckInterval = time.Second
+
 type EgressProxy struct {
 	signal        SignalEgress
 	signalTimeout time.Duration
 
 	peer      *webrtc.PeerConnection
 	endpoints []Endpoint
+
+	udpIdleTimeout time.Duration
+	timeouts       streamTimeouts
+
+	// disconnectGrace is how long the peer connection may stay disconnected, while ICE is restarted, before giving up.
+	disconnectGrace time.Duration
+
+	// idleTimeout is how long the peer connection may carry no stream before being closed, or zero to keep it open.
+	idleTimeout time.Duration
+
+	// listeners outlive the proxy, keeping the local sockets bound when the peer reconnects.
+	listeners *EgressListeners
+
+	mu          sync.Mutex
+	muxConn     *DataChannelConn
+	session     *smux.Session
+	channelIDs  *dataChannelIDs
+	tunnelsCtx  context.Context
+	tunnels     map[string]*egressTunnel
+	tunnelsWait sync.WaitGroup
+	stdioErr    func(error)
+	conns       int32 // number of local connections being handled
 }
 
 func (egp *EgressProxy) Start(ctx context.Context) (err error) {
 	ctx, cancel := context.WithCancel(ctx)
+	recovery := &peerRecovery{grace: egp.disconnectGrace, giveUp: func() {
+		err = fmt.Errorf("peer connection lost")
+		egp.Stop()
+	}}
 	egp.peer.OnConnectionStateChange(func(pcs webrtc.PeerConnectionState) {
 		switch pcs {
-		case webrtc.PeerConnectionStateFailed:
-			err = fmt.Errorf("peer connection failed")
-			egp.Stop()
-		case webrtc.PeerConnectionStateDisconnected:
-			egp.Stop()
+		case webrtc.PeerConnectionStateConnected:
+			recovery.connected()
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateDisconnected:
+			recovery.disconnected(ctx)
 		case webrtc.PeerConnectionStateClosed:
 			cancel()
 		}
@@ -41,8 +73,9 @@ func (egp *EgressProxy) Start(ctx context.Context) (err error) {
 		defer scancel()
 	}
 
-	if err := egp.createDummyDataChannel(); err != nil {
-		return err
+	dc, err := egp.peer.CreateDataChannel(muxLabel, nil)
+	if err != nil {
+		return fmt.Errorf("create data channel failed: %w", err)
 	}
 	offer, err := egp.peer.CreateOffer(nil)
 	if err != nil {
@@ -72,118 +105,463 @@ func (egp *EgressProxy) Start(ctx context.Context) (err error) {
 
 	go func() {
 		defer cancel()
-		if errt := egp.startTunnels(sctx); errt != nil {
+		if errt := egp.startTunnels(ctx, dc); errt != nil {
 			err = fmt.Errorf("start tunnels failed: %w", errt)
 		}
 	}()
 
 	chanRecv(sctx, iceDone)
-	egp.signal.Close()
+	if si, ok := egp.signal.(SignalICE); ok {
+		// the signaling channel stays open to restart ICE when the network changes.
+		defer si.Close()
+		go addLateICECandidates(ctx, egp.peer, si)
+		recovery.setRestart(egp.restartICE)
+		if ska, ok := egp.signal.(SignalKeepAlive); ok {
+			go keepSignalAlive(ctx, ska, signalKeepAliveInterval)
+		}
+	} else {
+		egp.signal.Close()
+	}
 	<-ctx.Done()
 	egp.Stop()
 
 	return
 }
 
-// createDummyDataChannel create auto-closed data channel only to populate SDP
-func (egp *EgressProxy) createDummyDataChannel() (err error) {
-	dc, err := egp.peer.CreateDataChannel("", nil)
+// restartICE renegotiates the ICE transport of the peer with new credentials and candidates, leaving the DTLS and
+// SCTP associations on top of it, and so every data channel, intact. Candidates are sent along with the offer rather
+// than trickled, so that none is added to the peer before it restarts.
+func (egp *EgressProxy) restartICE(ctx context.Context) (err error) {
+	offer, err := egp.peer.CreateOffer(&webrtc.OfferOptions{ICERestart: true})
 	if err != nil {
-		return fmt.Errorf("create dummy data channel failed: %w", err)
+		return fmt.Errorf("create webrtc offer failed: %w", err)
+	}
+	if err = egp.peer.SetLocalDescription(offer); err != nil {
+		return fmt.Errorf("set local description failed: %w", err)
+	}
+	defer func() {
+		// an offer left unanswered is rolled back, or the next one could not be set.
+		if err != nil && egp.peer.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+			egp.peer.SetLocalDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeRollback, SDP: offer.SDP})
+		}
+	}()
+	if err = waitICEGathering(ctx, egp.peer); err != nil {
+		return
 	}
-	dc.OnOpen(func() { dc.Close() })
-	dc.OnError(func(error) { dc.Close() })
 
+	if err = egp.signal.SendOffer(ctx, egp.peer.LocalDescription().SDP); err != nil {
+		return fmt.Errorf("send offer failed: %w", err)
+	}
+	answer, err := egp.signal.RecvAnswer(ctx)
+	if err != nil {
+		return fmt.Errorf("receive answer failed: %w", err)
+	}
+	err = egp.peer.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  answer,
+	})
+	if err != nil {
+		return fmt.Errorf("set remote description failed: %w", err)
+	}
+	log.Println("egress: ICE restarted")
 	return
 }
 
-func (egp *EgressProxy) startTunnels(ctx context.Context) (err error) {
+// startTunnels opens the smux session shared by every stream based endpoint on dc, then starts the tunnel of each endpoint.
+func (egp *EgressProxy) startTunnels(ctx context.Context, dc *webrtc.DataChannel) (err error) {
+	defer dc.Close()
+
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	var wg sync.WaitGroup
-	defer wg.Wait()
+	dcc, err := NewDataChannelConn(ctx, dc)
+	if err != nil {
+		return fmt.Errorf("create new datachannel connection failed: %w", err)
+	}
+	defer dcc.Close()
 
+	session, err := smux.Client(dcc, muxConfig(egp.disconnectGrace))
+	if err != nil {
+		return fmt.Errorf("create client session failed: %w", err)
+	}
+	defer session.Close()
+
+	var errStdio error
+	egp.mu.Lock()
+	egp.muxConn, egp.session, egp.channelIDs = dcc, session, newDataChannelIDs(offererDTLSRole(egp.peer))
+	egp.tunnelsCtx, egp.tunnels = ctx, map[string]*egressTunnel{}
+	egp.stdioErr = func(err error) {
+		errStdio = err
+		cancel()
+	}
 	for _, ep := range egp.endpoints {
-		if err = ctx.Err(); err != nil {
+		egp.startTunnelLocked(ep)
+	}
+	egp.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		if err := egp.acceptStreams(ctx, session); err != nil {
+			log.Println("egress:", err)
+		}
+	}()
+	if egp.idleTimeout > 0 {
+		go egp.closeWhenIdle(ctx, session, cancel)
+	}
+
+	<-ctx.Done()
+	egp.mu.Lock()
+	egp.tunnels = nil
+	egp.mu.Unlock()
+
+	egp.tunnelsWait.Wait()
+	return errStdio
+}
+
+// closeWhenIdle calls stop once session has carried no stream for the idle timeout, as long as every endpoint is
+// forwarded on demand.
+func (egp *EgressProxy) closeWhenIdle(ctx context.Context, session *smux.Session, stop func()) {
+	t := time.NewTicker(idleCheckInterval)
+	defer t.Stop()
+
+	idleSince := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
 			return
+		case <-t.C:
 		}
 
-		dc, err := egp.peer.CreateDataChannel(ep.String(), nil)
+		if session.NumStreams() > 0 || atomic.LoadInt32(&egp.conns) > 0 || !egp.onDemand() {
+			idleSince = time.Now()
+			continue
+		}
+		if time.Since(idleSince) >= egp.idleTimeout {
+			log.Printf("egress: no stream for %s, closing the peer connection", egp.idleTimeout)
+			stop()
+			return
+		}
+	}
+}
+
+func (egp *EgressProxy) onDemand() bool {
+	egp.mu.Lock()
+	defer egp.mu.Unlock()
+
+	for _, ep := range egp.endpoints {
+		if !ep.isOnDemand() {
+			return false
+		}
+	}
+	return true
+}
+
+type egressTunnel struct {
+	ep     Endpoint
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// startTunnelLocked starts the tunnel of ep. It must be called with egp.mu held.
+func (egp *EgressProxy) startTunnelLocked(ep Endpoint) {
+	start := egp.startTunnel
+	switch ep.network {
+	case networkUDP:
+		start = egp.startUDPTunnel
+	case networkReverse:
+		start = egp.startReverseTunnel
+	}
+
+	ctx, cancel := context.WithCancel(egp.tunnelsCtx)
+	t := &egressTunnel{ep: ep, ctx: ctx, cancel: cancel}
+	egp.tunnels[ep.String()] = t
+
+	egp.tunnelsWait.Add(1)
+	go func() {
+		defer egp.tunnelsWait.Done()
+		defer egp.removeTunnel(ep, t)
+
+		err := start(ctx, ep)
+		if ep.isStdio() {
+			egp.stdioErr(err)
+			return
+		}
 		if err != nil {
-			cancel()
-			return fmt.Errorf("create data channel failed: %w", err)
+			log.Println("egress: create tunnel failed: ", err)
 		}
+	}()
+}
 
-		wg.Add(1)
-		ep := ep
-		go func() {
-			defer wg.Done()
-			if err := egp.startTunnel(ctx, dc, ep); err != nil {
-				log.Println("egress: create tunnel failed: ", err)
-			}
-		}()
+func (egp *EgressProxy) removeTunnel(ep Endpoint, t *egressTunnel) {
+	t.cancel()
+
+	egp.mu.Lock()
+	defer egp.mu.Unlock()
+	if egp.tunnels[ep.String()] == t {
+		delete(egp.tunnels, ep.String())
+	}
+}
+
+// AddEndpoint starts forwarding ep. When the proxy is already connected, the tunnel starts on the existing session.
+func (egp *EgressProxy) AddEndpoint(ep Endpoint) (err error) {
+	egp.mu.Lock()
+	defer egp.mu.Unlock()
+
+	for _, e := range egp.endpoints {
+		if e.String() == ep.String() {
+			return fmt.Errorf("endpoint already exists: %s", ep)
+		}
+	}
+	if egp.tunnels != nil {
+		egp.startTunnelLocked(ep)
 	}
+	egp.endpoints = append(egp.endpoints, ep)
 	return
 }
 
-func (egp *EgressProxy) startTunnel(ctx context.Context, dc *webrtc.DataChannel, ep Endpoint) (err error) {
-	defer dc.Close()
+// RemoveEndpoint stops forwarding ep, closing its listener and connections without affecting the other endpoints.
+func (egp *EgressProxy) RemoveEndpoint(ep Endpoint) (err error) {
+	egp.mu.Lock()
+	defer egp.mu.Unlock()
 
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
+	i := -1
+	for j, e := range egp.endpoints {
+		if e.String() == ep.String() {
+			i = j
+		}
+	}
+	if i < 0 {
+		return fmt.Errorf("endpoint does not exist: %s", ep)
+	}
+	egp.endpoints = append(egp.endpoints[:i:i], egp.endpoints[i+1:]...)
 
-	dcc, err := NewDataChannelConn(ctx, dc)
-	if err != nil {
-		return fmt.Errorf("create new datachannel connection failed: %w", err)
+	if t, ok := egp.tunnels[ep.String()]; ok {
+		t.cancel()
+		delete(egp.tunnels, ep.String())
 	}
-	defer dcc.Close()
+	return
+}
 
-	session, err := smux.Client(dcc, nil)
-	if err != nil {
-		return fmt.Errorf("create client session failed: %w", err)
+func (egp *EgressProxy) Endpoints() (eps []Endpoint) {
+	egp.mu.Lock()
+	defer egp.mu.Unlock()
+	return append(eps, egp.endpoints...)
+}
+
+func (egp *EgressProxy) startTunnel(ctx context.Context, ep Endpoint) (err error) {
+	if ep.isStdio() {
+		return egp.relayStdio(ctx, ep)
 	}
-	defer session.Close()
 
-	listener, err := net.Listen("tcp", ep.local)
+	listener, err := egp.listeners.stream(ep)
 	if err != nil {
 		return fmt.Errorf("listen to local socket failed: %w", err)
 	}
-	defer listener.Close()
-
-	go func() {
-		chanRecv(ctx, session.CloseChan())
-		cancel()
-		listener.Close()
-	}()
 
+	var active int32
 	for {
-		if ctx.Err() != nil {
-			break
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-listener.done:
+			return nil
+
+		case conn := <-listener.conns:
+			if ctx.Err() != nil {
+				egp.listeners.requeue(ep, conn)
+				return nil
+			}
+			if max := ep.options.maxStreams; max > 0 && atomic.LoadInt32(&active) >= int32(max) {
+				log.Printf("egress: %s: %s, refusing connection: %s", errTooManyStreams, ep, conn.RemoteAddr())
+				resetConn(conn)
+				continue
+			}
+			atomic.AddInt32(&active, 1)
+			atomic.AddInt32(&egp.conns, 1)
+			go func() {
+				defer atomic.AddInt32(&active, -1)
+				defer atomic.AddInt32(&egp.conns, -1)
+				if err := egp.handleConn(ctx, conn, ep); err != nil {
+					log.Println("egress:", err)
+				}
+			}()
 		}
+	}
+}
+
+// handleConn relays conn through a new stream, closing conn when the tunnel of ep is stopped.
+func (egp *EgressProxy) handleConn(ctx context.Context, conn net.Conn, ep Endpoint) (err error) {
+	if !ep.options.proxyProtocol && ep.network != networkSOCKS5 && ep.network != networkHTTPProxy && ep.network != networkSNI {
+		return egp.handleForwardConn(ctx, conn, ep)
+	}
+
+	stop := closeOnDone(ctx, conn)
+	defer stop()
 
-		conn, err := listener.Accept()
+	if ep.options.proxyProtocol {
+		pc, err := acceptProxyHeader(conn)
 		if err != nil {
-			log.Println("egress: accept connection error:", err)
-			continue
+			conn.Close()
+			return err
+		}
+		conn = pc
+	}
+
+	switch ep.network {
+	case networkSOCKS5:
+		return egp.handleSOCKS5Conn(conn, ep)
+	case networkHTTPProxy:
+		return egp.handleHTTPProxyConn(conn, ep)
+	case networkSNI:
+		return egp.handleSNIConn(conn, ep)
+	}
+
+	stream, err := egp.openStream(ep, ep.remote, conn.RemoteAddr().String())
+	if err != nil {
+		resetConn(conn)
+		return err
+	}
+
+	if err = relay(conn, stream, egp.timeouts); err != nil {
+		return fmt.Errorf("relay error: %w", err)
+	}
+	return
+}
+
+// handleForwardConn relays conn to the remote of ep. As nothing is read from conn before its stream is accepted, a
+// connection whose stream fails because the tunnel is going down is handed to the next tunnel instead of being reset.
+func (egp *EgressProxy) handleForwardConn(ctx context.Context, conn net.Conn, ep Endpoint) (err error) {
+	stream, err := egp.openStream(ep, ep.remote, conn.RemoteAddr().String())
+	var rejected *streamError
+	if err != nil && !errors.As(err, &rejected) {
+		if waitDone(ctx, egp.listeners.wait) && egp.listeners.requeue(ep, conn) {
+			return fmt.Errorf("%w, waiting for the next tunnel", err)
+		}
+	}
+	if err != nil {
+		resetConn(conn)
+		return err
+	}
+
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+
+	if err = relay(conn, stream, egp.timeouts); err != nil {
+		return fmt.Errorf("relay error: %w", err)
+	}
+	return
+}
+
+// openStream opens a stream that the ingress will connect to dest on behalf of the client at clientAddr, compressed as
+// the forward of ep asks.
+func (egp *EgressProxy) openStream(ep Endpoint, dest string, clientAddr string) (stream net.Conn, err error) {
+	stream, err = egp.openStreamWithData(ep, streamHeader{
+		Network:     networkTCP,
+		Destination: dest,
+		ClientAddr:  clientAddr,
+		RequestID:   newRequestID(),
+		Compression: ep.options.compress,
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s failed: %w", dest, err)
+	}
+	return
+}
+
+// openStreamWithData opens a stream for ep with the header h followed by data, either on the smux session or on a
+// data channel of its own as ep asks.
+func (egp *EgressProxy) openStreamWithData(ep Endpoint, h streamHeader, data []byte) (stream net.Conn, err error) {
+	if ep.options.mux == muxSCTP {
+		if stream, err = egp.openChannelStream(h, data); !errors.Is(err, errNoChannelStream) {
+			return
 		}
-		log.Println("egress: new connection: ", conn.RemoteAddr())
+	}
+	return openStreamWithData(egp.session, h, data)
+}
 
-		stream, err := session.OpenStream()
+// acceptStreams serves the streams opened by the ingress until the session is closed.
+func (egp *EgressProxy) acceptStreams(ctx context.Context, session *smux.Session) (err error) {
+	for {
+		stream, err := session.AcceptStream()
+		if ctx.Err() != nil {
+			return nil
+		}
 		if err != nil {
-			log.Println("egress: open stream error:", err)
-			continue
+			return fmt.Errorf("accept stream error: %w", err)
 		}
 
 		go func() {
-			err = relay(conn, stream)
-			if err != nil {
-				log.Println("egress: relay error:", err)
+			if err := egp.handleStream(stream); err != nil {
+				log.Println("egress:", err)
 			}
 		}()
 	}
+}
 
-	return
+func (egp *EgressProxy) handleStream(stream *smux.Stream) (err error) {
+	h, err := readStreamHeader(stream)
+	if err != nil {
+		stream.Close()
+		return err
+	}
+
+	switch h.Network {
+	case networkReverse:
+		return egp.handleReverseStream(stream, h)
+	default:
+		writeStreamAck(stream, streamStatusFailure)
+		stream.Close()
+		return fmt.Errorf("unexpected stream network: %s", h.Network)
+	}
+}
+
+// relayStdio relays a single stream to stdin and stdout, returning once the stream is closed by either side.
+func (egp *EgressProxy) relayStdio(ctx context.Context, ep Endpoint) (err error) {
+	stream, err := egp.openStream(ep, ep.remote, localStdio)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	stop := closeOnDone(ctx, stream)
+	defer stop()
+
+	// streams can not be half-closed, so the end of stdin is not forwarded and the output is relayed until the
+	// remote side ends the stream, as a reply may still be on its way.
+	go func() {
+		if _, err := io.Copy(stream, os.Stdin); err != nil {
+			log.Println("egress: read stdin error:", err)
+		}
+	}()
+
+	// smux streams return io.EOF from WriteTo, which io.Copy does not hide, and io.ErrClosedPipe once closed locally,
+	// such as when the tunnel is lost. Only the remote side ending the stream is a success.
+	_, err = io.Copy(os.Stdout, stream)
+	switch {
+	case err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrClosedPipe):
+		return fmt.Errorf("relay stream failed: %w", err)
+	case ctx.Err() != nil || egp.transportClosed(stream):
+		return fmt.Errorf("tunnel closed before the stream ended")
+	case errors.Is(err, io.ErrClosedPipe):
+		return fmt.Errorf("stream closed before it ended")
+	}
+	return nil
+}
+
+// transportClosed reports whether the transport carrying stream was lost, rather than stream being ended by the
+// remote side.
+func (egp *EgressProxy) transportClosed(stream net.Conn) bool {
+	if cc, ok := stream.(*compressedConn); ok {
+		stream = cc.Conn
+	}
+	// the data channel of a stream of its own is closed along with the stream, unlike the peer connection.
+	if _, ok := stream.(*channelConn); ok {
+		return egp.peer.ConnectionState() != webrtc.PeerConnectionStateConnected
+	}
+
+	egp.mu.Lock()
+	defer egp.mu.Unlock()
+	return egp.muxConn == nil || egp.muxConn.ReadClosed()
 }
 
 func (egp *EgressProxy) Stop() (err error) {
@@ -2,51 +2,218 @@ package main
 
 import (
 	"fmt"
+	"net"
+	"os"
+	"strconv"
 	"strings"
 )
 
-type EndpointAuthorizer = func(ep Endpoint) (ok bool, err error)
+const (
+	networkTCP    = "tcp"
+	networkUDP    = "udp"
+	networkSOCKS5 = "socks5"
 
-func NewBasicEndpointAuthorizer(epr []string) EndpointAuthorizer {
-	noop := func(ep Endpoint) (bool, error) {
-		return true, nil
+	networkHTTPProxy = "http-proxy"
+
+	// networkSNI endpoints leave the choice of the remote address to the ingress, from the server name of TLS connections.
+	networkSNI = "sni"
+
+	// networkReverse endpoints listen on the ingress and dial from the egress.
+	networkReverse = "reverse"
+
+	// localStdio marks an endpoint whose local side is the process' stdin and stdout.
+	localStdio = "stdio"
+)
+
+type Endpoint struct {
+	network string
+	local   string
+	remote  string
+	options endpointOptions
+
+	// resolvedHost is the hostname remote was resolved from, when remote holds one of its addresses.
+	resolvedHost string
+}
+
+func EndpointFromString(s string) (ep Endpoint, err error) {
+	network, s := splitNetwork(s)
+	s, opts, _ := strings.Cut(s, ",")
+
+	a, err := splitAddrs(s)
+	if err != nil {
+		return ep, fmt.Errorf("invalid forward endpoint: %s: %w", s, err)
 	}
 
-	eps := map[string]struct{}{}
-	whitelist := func(ep Endpoint) (bool, error) {
-		_, ok := eps[ep.remote]
-		return ok, nil
+	switch {
+	case isDynamicNetwork(network) && len(a) == 1:
+		ep = Endpoint{network: network, local: a[0]}
+
+	case isDynamicNetwork(network):
+		return ep, fmt.Errorf("invalid %s endpoint, expecting only local address: %s", network, s)
+
+	case len(a) == 2 && a[1] != localStdio:
+		ep = Endpoint{network: network, local: a[0], remote: a[1]}
+
+	default:
+		return ep, fmt.Errorf("invalid forward endpoint: %s", s)
 	}
 
-	for _, r := range epr {
-		if r == "*" {
-			return noop
-		}
+	if network == networkUDP && (isUnixAddr(ep.local) || isUnixAddr(ep.remote)) {
+		return ep, fmt.Errorf("unix socket is not supported for udp endpoint: %s", s)
+	}
 
-		eps[r] = struct{}{}
+	if ep.options, err = parseEndpointOptions(opts); err != nil {
+		return ep, fmt.Errorf("invalid forward endpoint options: %s: %w", opts, err)
+	}
+	if network == networkUDP && ep.options.compress != "" && ep.options.compress != compressionNone {
+		return ep, fmt.Errorf("compression is not supported for udp endpoint: %s", s)
 	}
+	if (network == networkUDP || network == networkReverse) && ep.options.mux == muxSCTP {
+		return ep, fmt.Errorf("a data channel per stream is not supported for %s endpoint: %s", network, s)
+	}
+	return
+}
+
+// splitAddrs splits colon separated addresses where each one is either '<ip>:<port>', 'unix:<path>', or 'stdio'.
+func splitAddrs(s string) (addrs []string, err error) {
+	a := strings.Split(s, ":")
+	for i := 0; i < len(a); {
+		if a[i] == localStdio {
+			addrs, i = append(addrs, a[i]), i+1
+			continue
+		}
 
-	return whitelist
+		if i+1 >= len(a) {
+			return nil, fmt.Errorf("incomplete address: %s", a[i])
+		}
+		addrs, i = append(addrs, a[i]+":"+a[i+1]), i+2
+	}
+	return
 }
 
-type Endpoint struct {
-	local  string
-	remote string
+type endpointOptions struct {
+	// socketPerm is the permission of the unix socket file created for the local side.
+	socketPerm os.FileMode
+
+	// proxyProtocol expects every connection accepted on the local side to start with a PROXY protocol header.
+	proxyProtocol bool
+
+	// ingress is the group of ingress URLs the endpoint is forwarded through, empty for the default one.
+	ingress string
+
+	// maxStreams is the maximum number of local connections relayed at once, or zero for no limit.
+	maxStreams int
+
+	// compress is the algorithm the streams of the endpoint are compressed with, if the ingress supports it.
+	compress string
+
+	// mux is how the streams of the endpoint share the peer connection, either smux, the default, or sctp for a data
+	// channel per stream.
+	mux string
 }
 
-func EndpointFromString(s string) (ep Endpoint, err error) {
-	a := strings.Split(s, ":")
-	if len(a) != 4 {
-		return ep, fmt.Errorf("invalid forward endpoint: %s", s)
+func parseEndpointOptions(s string) (o endpointOptions, err error) {
+	if s == "" {
+		return
 	}
 
-	ep = Endpoint{
-		local:  a[0] + ":" + a[1],
-		remote: a[2] + ":" + a[3],
+	for _, kv := range strings.Split(s, ",") {
+		k, v, _ := strings.Cut(kv, "=")
+		switch k {
+		case "perm":
+			p, err := strconv.ParseUint(v, 8, 32)
+			if err != nil {
+				return o, fmt.Errorf("invalid socket permission: %s: %w", v, err)
+			}
+			o.socketPerm = os.FileMode(p) & os.ModePerm
+
+		case "proxy-protocol":
+			o.proxyProtocol = true
+
+		case "max-streams":
+			if o.maxStreams, err = strconv.Atoi(v); err != nil || o.maxStreams <= 0 {
+				return o, fmt.Errorf("invalid max streams: %s", v)
+			}
+
+		case "compress":
+			if !isCompression(v) {
+				return o, fmt.Errorf("unknown compression: %s", v)
+			}
+			o.compress = v
+
+		case "mux":
+			if !isMux(v) {
+				return o, fmt.Errorf("unknown mux: %s", v)
+			}
+			o.mux = v
+
+		case "ingress":
+			if v == "" {
+				return o, fmt.Errorf("empty ingress group")
+			}
+			o.ingress = v
+
+		default:
+			return o, fmt.Errorf("unknown option: %s", k)
+		}
 	}
 	return
 }
 
+// splitNetwork separates the optional '<network>/' prefix from s, defaulting to tcp.
+func splitNetwork(s string) (network string, addr string) {
+	for _, n := range []string{networkTCP, networkUDP, networkSOCKS5, networkHTTPProxy, networkSNI, networkReverse} {
+		if strings.HasPrefix(s, n+"/") {
+			return n, strings.TrimPrefix(s, n+"/")
+		}
+	}
+	return networkTCP, s
+}
+
+func (ep Endpoint) isStdio() bool {
+	return ep.local == localStdio
+}
+
+// isOnDemand reports whether ep only needs the peer connection while a local connection is relayed, which is not the
+// case of UDP, reverse, and stdio endpoints.
+func (ep Endpoint) isOnDemand() bool {
+	return ep.network != networkUDP && ep.network != networkReverse && !ep.isStdio()
+}
+
+// isDynamicNetwork reports whether endpoints of the network choose their remote address per stream.
+func isDynamicNetwork(network string) bool {
+	return network == networkSOCKS5 || network == networkHTTPProxy || network == networkSNI
+}
+
+// isDynamic reports whether the remote address is chosen per stream instead of being fixed by the endpoint.
+func (ep Endpoint) isDynamic() bool {
+	return isDynamicNetwork(ep.network)
+}
+
+// unresolved returns ep with the hostname it was resolved from in place of the resolved address.
+func (ep Endpoint) unresolved() Endpoint {
+	if ep.resolvedHost == "" {
+		return ep
+	}
+	_, port, _ := net.SplitHostPort(ep.remote)
+	ep.remote, ep.resolvedHost = net.JoinHostPort(ep.resolvedHost, port), ""
+	return ep
+}
+
+func (ep Endpoint) prefix() string {
+	if ep.network == "" || ep.network == networkTCP {
+		return ""
+	}
+	return ep.network + "/"
+}
+
+func (ep Endpoint) remoteString() string {
+	return ep.prefix() + ep.remote
+}
+
 func (ep Endpoint) String() string {
-	return ep.local + ":" + ep.remote
+	if ep.isDynamic() {
+		return ep.prefix() + ep.local
+	}
+	return ep.prefix() + ep.local + ":" + ep.remote
 }
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// HTTPFilter parses the HTTP/1.1 requests of streams to the destinations it covers, forwarding only the requests
+// allowed by one of its rules and answering the others with 403.
+type HTTPFilter struct {
+	rules []httpRule
+}
+
+type httpRule struct {
+	peer    peerSelector
+	dest    endpointPattern
+	methods []string
+	hosts   []hostMatcher
+	paths   []string
+}
+
+// NewHTTPFilter parses rules, each written as '[<peer selector>@]<endpoint>[,method=<method>][,host=<host>][,path=<prefix>]'.
+// Every option can be repeated, and a request must match one value of each given option. The endpoint is matched
+// like an '--allow' entry, and hosts like its host part.
+func NewHTTPFilter(rules []string) (f *HTTPFilter, err error) {
+	f = &HTTPFilter{}
+	for _, s := range rules {
+		r, err := httpRuleFromString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid http rule: %s: %w", s, err)
+		}
+		f.rules = append(f.rules, r)
+	}
+	return
+}
+
+func httpRuleFromString(s string) (r httpRule, err error) {
+	s, opts, _ := strings.Cut(s, ",")
+	er, err := endpointRuleFromString(s)
+	if err != nil {
+		return
+	}
+	if er.deny {
+		return r, fmt.Errorf("deny entries are not supported")
+	}
+	r.peer, r.dest = er.peer, er.dest
+
+	if opts == "" {
+		return
+	}
+	for _, kv := range strings.Split(opts, ",") {
+		k, v, _ := strings.Cut(kv, "=")
+		if v == "" {
+			return r, fmt.Errorf("missing value of option: %s", k)
+		}
+		switch k {
+		case "method":
+			r.methods = append(r.methods, strings.ToUpper(v))
+		case "host":
+			h, err := hostMatcherFromString(v)
+			if err != nil {
+				return r, err
+			}
+			r.hosts = append(r.hosts, h)
+		case "path":
+			if !strings.HasPrefix(v, "/") {
+				return r, fmt.Errorf("path must start with '/': %s", v)
+			}
+			r.paths = append(r.paths, v)
+		default:
+			return r, fmt.Errorf("unknown option: %s", k)
+		}
+	}
+	return
+}
+
+// covers reports whether streams to any of eps are filtered, regardless of the peer.
+func (f *HTTPFilter) covers(eps []Endpoint) bool {
+	if f == nil {
+		return false
+	}
+	for _, r := range f.rules {
+		for _, ep := range eps {
+			if r.dest.match(ep) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (f *HTTPFilter) allows(cert *AetherportCertificate, eps []Endpoint, req *http.Request) bool {
+	for _, r := range f.rules {
+		if r.match(cert, eps, req) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r httpRule) match(cert *AetherportCertificate, eps []Endpoint, req *http.Request) bool {
+	if !r.peer.match(cert) || !r.matchDest(eps) {
+		return false
+	}
+	if len(r.methods) > 0 && !containsString(r.methods, req.Method) {
+		return false
+	}
+
+	if len(r.hosts) > 0 {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		ok := false
+		for _, h := range r.hosts {
+			ok = ok || h.match(host)
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	if len(r.paths) > 0 {
+		p, canonical := canonicalRequestPath(req)
+		ok := false
+		for _, prefix := range r.paths {
+			ok = ok || hasPathPrefix(p, prefix)
+		}
+		if !ok || !canonical {
+			return false
+		}
+	}
+	return true
+}
+
+func (r httpRule) matchDest(eps []Endpoint) bool {
+	for _, ep := range eps {
+		if r.dest.match(ep) {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalRequestPath returns the decoded path of req with dot segments resolved, and whether the upstream is sent
+// the same path. Paths with dot segments, empty segments, or encoded slashes are not canonical, as an upstream may
+// resolve them differently, so that they could escape a prefix.
+func canonicalRequestPath(req *http.Request) (p string, canonical bool) {
+	raw := req.URL.Path
+	if raw == "" {
+		raw = "/"
+	}
+	p = path.Clean("/" + raw)
+	canonical = (p == raw || p+"/" == raw) && !strings.Contains(strings.ToLower(req.URL.EscapedPath()), "%2f")
+	return
+}
+
+// hasPathPrefix reports whether p is prefix or under it, comparing whole segments.
+func hasPathPrefix(p string, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return prefix == "" || p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+func containsString(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// relay forwards the requests read from client to server one at a time, along with their responses. A denied or
+// malformed request is answered by the filter and ends the relay. After a protocol switch, such as a WebSocket
+// upgrade, or a successful CONNECT, the rest of both connections is relayed as is.
+func (f *HTTPFilter) relay(cert *AetherportCertificate, eps []Endpoint, client net.Conn, server net.Conn, t streamTimeouts) (err error) {
+	cr, sr, stop := watchRelay(client, server, t)
+	cbr, sbr := bufio.NewReader(cr), bufio.NewReader(sr)
+	defer func() {
+		if errt := stop(); errt != nil {
+			err = errt
+		}
+		client.Close()
+		server.Close()
+	}()
+
+	for {
+		req, err := http.ReadRequest(cbr)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			httpFilterReply(client, http.StatusBadRequest)
+			return fmt.Errorf("read http request error: %w", err)
+		}
+
+		if !f.allows(cert, eps, req) {
+			httpFilterReply(client, http.StatusForbidden)
+			return fmt.Errorf("%w: http %s %s%s for %s", errUnallowedEndpoint, req.Method, req.Host, req.URL.RequestURI(), peerName(cert))
+		}
+
+		// the client waits for the go ahead before sending its body, which the upstream will never give once Expect is removed.
+		if strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+			req.Header.Del("Expect")
+			if _, err = io.WriteString(client, "HTTP/1.1 100 Continue\r\n\r\n"); err != nil {
+				return fmt.Errorf("write http response error: %w", err)
+			}
+		}
+		if _, ok := req.Header["User-Agent"]; !ok {
+			req.Header["User-Agent"] = []string{""} // keeps Write from adding its own
+		}
+		if err = req.Write(server); err != nil {
+			return fmt.Errorf("write http request error: %w", err)
+		}
+
+		res, err := readFinalResponse(sbr, req, client)
+		if err != nil {
+			return err
+		}
+
+		// the rest of the connections is not HTTP anymore, which the response to a CONNECT would otherwise be read
+		// as the body of.
+		switched := res.StatusCode == http.StatusSwitchingProtocols || req.Method == http.MethodConnect && res.StatusCode/100 == 2
+		if switched {
+			err = writeResponseHeader(client, res)
+		} else {
+			err = res.Write(client)
+		}
+		if err != nil {
+			return fmt.Errorf("write http response error: %w", err)
+		}
+
+		switch {
+		case switched:
+			return relay(bufferedConn{Conn: client, r: cbr}, bufferedConn{Conn: server, r: sbr}, streamTimeouts{})
+		case req.Close || res.Close:
+			return nil
+		}
+	}
+}
+
+// writeResponseHeader writes the status line and the header of res, without its body.
+func writeResponseHeader(w io.Writer, res *http.Response) (err error) {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "HTTP/%d.%d %s\r\n", res.ProtoMajor, res.ProtoMinor, res.Status)
+	res.Header.Write(bw)
+	bw.WriteString("\r\n")
+	return bw.Flush()
+}
+
+// readFinalResponse reads the response to req from r, forwarding the informational ones before it to client.
+func readFinalResponse(r *bufio.Reader, req *http.Request, client io.Writer) (res *http.Response, err error) {
+	for {
+		if res, err = http.ReadResponse(r, req); err != nil {
+			return nil, fmt.Errorf("read http response error: %w", err)
+		}
+		if res.StatusCode/100 != 1 || res.StatusCode == http.StatusSwitchingProtocols {
+			return
+		}
+		if err = res.Write(client); err != nil {
+			return nil, fmt.Errorf("write http response error: %w", err)
+		}
+	}
+}
+
+func httpFilterReply(w io.Writer, code int) (err error) {
+	body := http.StatusText(code) + "\n"
+	_, err = fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		code, http.StatusText(code), len(body), body)
+	return
+}
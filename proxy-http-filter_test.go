@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testHTTPEndpoints = []Endpoint{{network: networkTCP, remote: "10.0.0.5:80"}}
+
+func readTestRequest(t *testing.T, raw string) *http.Request {
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+	if err != nil {
+		t.Fatalf("%q: %v", raw, err)
+	}
+	return req
+}
+
+func TestHTTPFilterAllows(t *testing.T) {
+	tests := []struct {
+		rule  string
+		raw   string
+		allow bool
+	}{
+		{"10.0.0.5:80", "GET /anything HTTP/1.1\r\nHost: a\r\n\r\n", true},
+		{"10.0.0.6:80", "GET / HTTP/1.1\r\nHost: a\r\n\r\n", false},
+		{"name=node@10.0.0.5:80", "GET / HTTP/1.1\r\nHost: a\r\n\r\n", true},
+		{"name=other@10.0.0.5:80", "GET / HTTP/1.1\r\nHost: a\r\n\r\n", false},
+
+		{"10.0.0.5:80,method=get", "GET / HTTP/1.1\r\nHost: a\r\n\r\n", true},
+		{"10.0.0.5:80,method=GET", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 0\r\n\r\n", false},
+
+		{"10.0.0.5:80,path=/public", "GET /public HTTP/1.1\r\nHost: a\r\n\r\n", true},
+		{"10.0.0.5:80,path=/public", "GET /public/ HTTP/1.1\r\nHost: a\r\n\r\n", true},
+		{"10.0.0.5:80,path=/public", "GET /public/a/b?x=../y HTTP/1.1\r\nHost: a\r\n\r\n", true},
+		{"10.0.0.5:80,path=/public/", "GET /public/a HTTP/1.1\r\nHost: a\r\n\r\n", true},
+		{"10.0.0.5:80,path=/public", "GET /publicity HTTP/1.1\r\nHost: a\r\n\r\n", false},
+		{"10.0.0.5:80,path=/public", "GET /admin HTTP/1.1\r\nHost: a\r\n\r\n", false},
+		{"10.0.0.5:80,path=/public", "GET /public/../admin HTTP/1.1\r\nHost: a\r\n\r\n", false},
+		{"10.0.0.5:80,path=/public", "GET /admin/../public/x HTTP/1.1\r\nHost: a\r\n\r\n", false},
+		{"10.0.0.5:80,path=/public", "GET /public/%2e%2e/admin HTTP/1.1\r\nHost: a\r\n\r\n", false},
+		{"10.0.0.5:80,path=/public", "GET /public/%2E%2E%2Fadmin HTTP/1.1\r\nHost: a\r\n\r\n", false},
+		{"10.0.0.5:80,path=/public", "GET /public%2Fx HTTP/1.1\r\nHost: a\r\n\r\n", false},
+		{"10.0.0.5:80,path=/public", "GET /public/a%2fb HTTP/1.1\r\nHost: a\r\n\r\n", false},
+		{"10.0.0.5:80,path=/public", "GET //public/x HTTP/1.1\r\nHost: a\r\n\r\n", false},
+		{"10.0.0.5:80,path=/public", "GET /public/./x HTTP/1.1\r\nHost: a\r\n\r\n", false},
+		{"10.0.0.5:80,path=/public", "GET http://a/public/x HTTP/1.1\r\nHost: a\r\n\r\n", true},
+
+		{"10.0.0.5:80,host=example.com", "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", true},
+		{"10.0.0.5:80,host=example.com", "GET / HTTP/1.1\r\nHost: EXAMPLE.com:8080\r\n\r\n", true},
+		{"10.0.0.5:80,host=example.com", "GET / HTTP/1.1\r\nHost: evil.com\r\n\r\n", false},
+		{"10.0.0.5:80,host=example.com", "GET / HTTP/1.1\r\nHost: example.com.evil.com\r\n\r\n", false},
+		{"10.0.0.5:80,host=example.com", "GET / HTTP/1.1\r\n\r\n", false},
+		{"10.0.0.5:80,host=example.com", "GET http://evil.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n", false},
+		{"10.0.0.5:80,host=*.example.com", "GET / HTTP/1.1\r\nHost: api.example.com\r\n\r\n", true},
+
+		{"10.0.0.5:80,method=GET,path=/public,host=example.com", "GET /public/x HTTP/1.1\r\nHost: example.com\r\n\r\n", true},
+		{"10.0.0.5:80,method=GET,path=/public,host=example.com", "GET /public/x HTTP/1.1\r\nHost: evil.com\r\n\r\n", false},
+	}
+	for _, tt := range tests {
+		f, err := NewHTTPFilter([]string{tt.rule})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.rule, err)
+		}
+		if got := f.allows(testLimitPeer, testHTTPEndpoints, readTestRequest(t, tt.raw)); got != tt.allow {
+			t.Errorf("%s, %q: got %v, want %v", tt.rule, tt.raw, got, tt.allow)
+		}
+	}
+}
+
+func TestHTTPFilterInvalid(t *testing.T) {
+	for _, s := range []string{"10.0.0.5:80,path=public", "10.0.0.5:80,method=", "10.0.0.5:80,port=80", "!10.0.0.5:80"} {
+		if _, err := NewHTTPFilter([]string{s}); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+// httpFilterTest relays the connection of a client through an HTTP filter to an upstream, whose requests are answered
+// by respond.
+type httpFilterTest struct {
+	client   net.Conn
+	requests chan *http.Request
+	relayed  chan error
+}
+
+func newHTTPFilterTest(t *testing.T, rules []string, respond func(req *http.Request, body string, upstream net.Conn, r *bufio.Reader)) *httpFilterTest {
+	f, err := NewHTTPFilter(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, filterClient := newTestConnPair(t)
+	filterServer, upstream := newTestConnPair(t)
+	t.Cleanup(func() {
+		client.Close()
+		upstream.Close()
+	})
+
+	ft := &httpFilterTest{client: client, requests: make(chan *http.Request, 16), relayed: make(chan error, 1)}
+	go func() {
+		ft.relayed <- f.relay(testLimitPeer, testHTTPEndpoints, filterClient, filterServer, streamTimeouts{})
+	}()
+	go func() {
+		r := bufio.NewReader(upstream)
+		for {
+			req, err := http.ReadRequest(r)
+			if err != nil {
+				return
+			}
+			body, _ := io.ReadAll(req.Body)
+			ft.requests <- req
+			respond(req, string(body), upstream, r)
+		}
+	}()
+	return ft
+}
+
+func respondOK(req *http.Request, body string, upstream net.Conn, r *bufio.Reader) {
+	io.WriteString(upstream, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+}
+
+// wait returns the error the relay ended with, failing when it does not end in time.
+func (ft *httpFilterTest) wait(t *testing.T) error {
+	select {
+	case err := <-ft.relayed:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay did not end")
+		return nil
+	}
+}
+
+// readResponse reads the response to a request with method, whose body depends on it.
+func (ft *httpFilterTest) readResponse(t *testing.T, r *bufio.Reader, method string) *http.Response {
+	ft.client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	res, err := http.ReadResponse(r, &http.Request{Method: method})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the response to a CONNECT is followed by the tunneled bytes rather than a body.
+	if method != http.MethodConnect || res.StatusCode/100 != 2 {
+		io.ReadAll(res.Body)
+	}
+	return res
+}
+
+func TestHTTPFilterRelayDenied(t *testing.T) {
+	ft := newHTTPFilterTest(t, []string{"10.0.0.5:80,path=/public"}, respondOK)
+	io.WriteString(ft.client, "GET /admin HTTP/1.1\r\nHost: a\r\n\r\n")
+
+	r := bufio.NewReader(ft.client)
+	if res := ft.readResponse(t, r, http.MethodGet); res.StatusCode != http.StatusForbidden || !res.Close {
+		t.Fatalf("expected a 403 closing the connection, got %d", res.StatusCode)
+	}
+	if err := ft.wait(t); !errors.Is(err, errUnallowedEndpoint) {
+		t.Fatalf("expected the relay to end unallowed, got %v", err)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+	if len(ft.requests) != 0 {
+		t.Fatal("expected the denied request not to reach the upstream")
+	}
+}
+
+func TestHTTPFilterRelayMalformed(t *testing.T) {
+	ft := newHTTPFilterTest(t, []string{"10.0.0.5:80"}, respondOK)
+	io.WriteString(ft.client, "GET / HTTP/1.1\r\nHost: a\r\nHost: b\r\n\r\n")
+
+	if res := ft.readResponse(t, bufio.NewReader(ft.client), http.MethodGet); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected a 400 for duplicate hosts, got %d", res.StatusCode)
+	}
+	if err := ft.wait(t); err == nil {
+		t.Fatal("expected the relay to fail")
+	}
+}
+
+func TestHTTPFilterRelayPipelined(t *testing.T) {
+	ft := newHTTPFilterTest(t, []string{"10.0.0.5:80,path=/public"}, respondOK)
+	io.WriteString(ft.client, "GET /public/a HTTP/1.1\r\nHost: a\r\n\r\nGET /admin HTTP/1.1\r\nHost: a\r\n\r\n")
+
+	r := bufio.NewReader(ft.client)
+	if res := ft.readResponse(t, r, http.MethodGet); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected the first request to be relayed, got %d", res.StatusCode)
+	}
+	if res := ft.readResponse(t, r, http.MethodGet); res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected the second request to be denied, got %d", res.StatusCode)
+	}
+	if err := ft.wait(t); !errors.Is(err, errUnallowedEndpoint) {
+		t.Fatalf("expected the relay to end unallowed, got %v", err)
+	}
+	if n := len(ft.requests); n != 1 {
+		t.Fatalf("expected a single request to reach the upstream, got %d", n)
+	}
+	if req := <-ft.requests; req.URL.Path != "/public/a" {
+		t.Fatalf("expected the allowed request to reach the upstream, got %s", req.URL.Path)
+	}
+}
+
+func TestHTTPFilterRelayExpectContinue(t *testing.T) {
+	bodies := make(chan string, 1)
+	ft := newHTTPFilterTest(t, []string{"10.0.0.5:80"}, func(req *http.Request, body string, upstream net.Conn, r *bufio.Reader) {
+		bodies <- body
+		respondOK(req, body, upstream, r)
+	})
+	io.WriteString(ft.client, "POST /upload HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nExpect: 100-continue\r\n\r\n")
+
+	r := bufio.NewReader(ft.client)
+	if res := ft.readResponse(t, r, http.MethodGet); res.StatusCode != http.StatusContinue {
+		t.Fatalf("expected the filter to let the body be sent, got %d", res.StatusCode)
+	}
+	io.WriteString(ft.client, "hello")
+	if res := ft.readResponse(t, r, http.MethodGet); res.StatusCode != http.StatusOK {
+		t.Fatalf("expected the request to be relayed, got %d", res.StatusCode)
+	}
+
+	if req := <-ft.requests; req.Header.Get("Expect") != "" {
+		t.Fatalf("expected Expect not to be forwarded, got %q", req.Header.Get("Expect"))
+	}
+	if body := <-bodies; body != "hello" {
+		t.Fatalf("expected the body to reach the upstream, got %q", body)
+	}
+}
+
+func TestHTTPFilterRelaySwitch(t *testing.T) {
+	tests := []struct {
+		rule     string
+		method   string
+		request  string
+		response string
+	}{
+		{
+			"10.0.0.5:80,path=/ws",
+			http.MethodGet,
+			"GET /ws HTTP/1.1\r\nHost: a\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n",
+			"HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n",
+		},
+		{
+			"10.0.0.5:80,method=CONNECT",
+			http.MethodConnect,
+			"CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n",
+			"HTTP/1.1 200 Connection Established\r\n\r\n",
+		},
+	}
+	for _, tt := range tests {
+		ft := newHTTPFilterTest(t, []string{tt.rule}, func(req *http.Request, body string, upstream net.Conn, r *bufio.Reader) {
+			io.WriteString(upstream, tt.response)
+			// echoes whatever follows, which is no longer HTTP.
+			io.Copy(upstream, r)
+		})
+		io.WriteString(ft.client, tt.request)
+
+		r := bufio.NewReader(ft.client)
+		res := ft.readResponse(t, r, tt.method)
+		if res.StatusCode != http.StatusSwitchingProtocols && res.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected the switch to be relayed, got %d", tt.rule, res.StatusCode)
+		}
+
+		// not a valid request, which the filter would answer with 400 if it still parsed the stream.
+		raw := "\x00\x01 not http \r\n\r\n"
+		io.WriteString(ft.client, raw)
+		got := make([]byte, len(raw))
+		if _, err := io.ReadFull(r, got); err != nil || string(got) != raw {
+			t.Fatalf("%s: expected raw bytes to be relayed as is, got %q: %v", tt.rule, got, err)
+		}
+	}
+}
+
+func TestHTTPFilterRelayDeniedSwitch(t *testing.T) {
+	ft := newHTTPFilterTest(t, []string{"10.0.0.5:80,method=CONNECT"}, func(req *http.Request, body string, upstream net.Conn, r *bufio.Reader) {
+		io.WriteString(upstream, "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n")
+	})
+	io.WriteString(ft.client, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+
+	r := bufio.NewReader(ft.client)
+	if res := ft.readResponse(t, r, http.MethodConnect); res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected the refusal of the upstream, got %d", res.StatusCode)
+	}
+
+	// without a switch, what follows is still parsed as requests, and denied.
+	io.WriteString(ft.client, "GET / HTTP/1.1\r\nHost: a\r\n\r\n")
+	if res := ft.readResponse(t, r, http.MethodGet); res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected the next request to be checked, got %d", res.StatusCode)
+	}
+	if err := ft.wait(t); !errors.Is(err, errUnallowedEndpoint) {
+		t.Fatalf("expected the relay to end unallowed, got %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// handleHTTPProxyConn serves a single HTTP proxy request, either a CONNECT tunnel or a plain absolute-URI request.
+func (egp *EgressProxy) handleHTTPProxyConn(conn net.Conn, ep Endpoint) (err error) {
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("read http proxy request error: %w", err)
+	}
+
+	dest := req.Host
+	if req.Method != http.MethodConnect {
+		if !req.URL.IsAbs() {
+			httpProxyReply(conn, http.StatusBadRequest)
+			conn.Close()
+			return fmt.Errorf("not a proxy request: %s", req.RequestURI)
+		}
+		// requests are relayed as they are, so https ones have to use CONNECT.
+		if !strings.EqualFold(req.URL.Scheme, "http") {
+			httpProxyReply(conn, http.StatusBadRequest)
+			conn.Close()
+			return fmt.Errorf("unsupported scheme: %s", req.URL.Scheme)
+		}
+		dest = req.URL.Host
+	}
+	if _, _, errs := net.SplitHostPort(dest); errs != nil {
+		dest = net.JoinHostPort(dest, "80")
+	}
+
+	stream, err := egp.openStream(ep, dest, conn.RemoteAddr().String())
+	if err != nil {
+		httpProxyReply(conn, httpProxyStatusOf(err))
+		conn.Close()
+		return err
+	}
+
+	switch req.Method {
+	case http.MethodConnect:
+		httpProxyReply(conn, http.StatusOK)
+
+	default:
+		// the whole connection is bound to dest, so the client must not reuse it for other hosts.
+		req.Header.Del("Proxy-Connection")
+		req.Header.Del("Proxy-Authorization")
+		req.Close = true
+		if err = req.Write(stream); err != nil {
+			httpProxyReply(conn, http.StatusBadGateway)
+			conn.Close()
+			stream.Close()
+			return fmt.Errorf("write http request error: %w", err)
+		}
+	}
+
+	if err = relay(bufferedConn{Conn: conn, r: br}, stream, egp.timeouts); err != nil {
+		return fmt.Errorf("relay error: %w", err)
+	}
+	return
+}
+
+// httpProxyStatusOf maps the failure of a stream to the closest HTTP status code.
+func httpProxyStatusOf(err error) int {
+	switch streamErrorStatus(err) {
+	case streamStatusUnauthorized:
+		return http.StatusForbidden
+	case streamStatusTimeout:
+		return http.StatusGatewayTimeout
+	case streamStatusQuotaExceeded:
+		return http.StatusTooManyRequests
+	case streamStatusTooManyStreams:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
+
+func httpProxyReply(conn net.Conn, code int) (err error) {
+	_, err = fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n\r\n", code, http.StatusText(code))
+	return
+}
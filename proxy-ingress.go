@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"strings"
 	"time"
 
 	"github.com/pion/webrtc/v3"
@@ -15,19 +16,39 @@ type IngressProxy struct {
 	signal        SignalIngress
 	signalTimeout time.Duration
 	peer          *webrtc.PeerConnection
+	peerCert      *AetherportCertificate
 	epAuth        EndpointAuthorizer
+	reverseAuth   EndpointAuthorizer
+	httpFilter    *HTTPFilter
+	sniRouter     *SNIRouter
+	router        *Router
+	proxyProtocol *ProxyProtocol
+	limiter       *Limiter
+
+	// noCompress relays every stream uncompressed, whatever the egress asks for.
+	noCompress bool
+
+	// channelStreams counts the data channels each carrying a stream the egress opened.
+	channelStreams int32
+
+	udpIdleTimeout time.Duration
+	timeouts       streamTimeouts
+
+	// disconnectGrace is how long the peer connection may stay disconnected, waiting for the egress to restart ICE,
+	// before giving up.
+	disconnectGrace time.Duration
 }
 
 func (igp *IngressProxy) Start(ctx context.Context) (err error) {
 	ctx, cancel := context.WithCancel(ctx)
 
+	recovery := &peerRecovery{grace: igp.disconnectGrace, giveUp: func() { igp.Stop() }}
 	igp.peer.OnConnectionStateChange(func(pcs webrtc.PeerConnectionState) {
 		switch pcs {
-		case webrtc.PeerConnectionStateFailed:
-			err = fmt.Errorf("peer connection failed")
-			igp.Stop()
-		case webrtc.PeerConnectionStateDisconnected:
-			igp.Stop()
+		case webrtc.PeerConnectionStateConnected:
+			recovery.connected()
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateDisconnected:
+			recovery.disconnected(ctx)
 		case webrtc.PeerConnectionStateClosed:
 			cancel()
 		}
@@ -40,7 +61,8 @@ func (igp *IngressProxy) Start(ctx context.Context) (err error) {
 		defer scancel()
 	}
 
-	igp.createTunnelsListener(sctx)
+	// data channels outlive signaling, as the peer connection lasts across ICE restarts.
+	igp.createTunnelsListener(ctx)
 
 	offer, err := igp.signal.RecvOffer(sctx)
 	if err != nil {
@@ -69,52 +91,122 @@ func (igp *IngressProxy) Start(ctx context.Context) (err error) {
 	}
 
 	chanRecv(sctx, iceDone)
-	igp.signal.Close()
+	if si, ok := igp.signal.(SignalICE); ok {
+		// the signaling channel stays open for the egress to restart ICE when the network changes.
+		defer si.Close()
+		go addLateICECandidates(ctx, igp.peer, si)
+		go igp.acceptICERestarts(ctx)
+	} else {
+		igp.signal.Close()
+	}
 	<-ctx.Done()
 	igp.Stop()
 
 	return
 }
 
+// acceptICERestarts answers the offers the egress sends to restart ICE, until the signaling channel is closed.
+func (igp *IngressProxy) acceptICERestarts(ctx context.Context) {
+	for {
+		offer, err := igp.signal.RecvOffer(ctx)
+		if err != nil {
+			return
+		}
+		if err = igp.answerICERestart(ctx, offer); err != nil {
+			log.Println("ingress: ICE restart failed:", err)
+			continue
+		}
+		log.Println("ingress: ICE restarted")
+	}
+}
+
+// answerICERestart answers offer with the candidates of the restarted ICE transport included.
+func (igp *IngressProxy) answerICERestart(ctx context.Context, offer string) (err error) {
+	err = igp.peer.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  offer,
+	})
+	if err != nil {
+		return fmt.Errorf("set remote description failed: %w", err)
+	}
+
+	answer, err := igp.peer.CreateAnswer(nil)
+	if err != nil {
+		return fmt.Errorf("create answer failed: %w", err)
+	}
+	if err = igp.peer.SetLocalDescription(answer); err != nil {
+		return fmt.Errorf("set local description failed: %w", err)
+	}
+	if err = waitICEGathering(ctx, igp.peer); err != nil {
+		return
+	}
+
+	if err = igp.signal.SendAnswer(ctx, igp.peer.LocalDescription().SDP); err != nil {
+		return fmt.Errorf("send answer failed: %w", err)
+	}
+	return
+}
+
 func (igp *IngressProxy) createTunnelsListener(ctx context.Context) {
 	igp.peer.OnDataChannel(func(dc *webrtc.DataChannel) {
 		if ctx.Err() != nil {
+			rejectDataChannel(dc)
 			return
 		}
 
-		if dc.Label() == "" {
-			return
-		}
+		var create func() error
+		switch label := dc.Label(); {
+		case label == muxLabel:
+			create = func() error { return igp.createTunnel(ctx, dc) }
 
-		if igp.epAuth != nil {
-			ep, err := EndpointFromString(dc.Label())
-			if err != nil {
-				log.Printf("got invalid endpoint: %s: %s\n", dc.Label(), err)
-				dc.Close()
+		case label == channelStreamLabel:
+			if !igp.acceptChannelStream() {
+				log.Println("ingress: data channel per stream rejected: more than", channelStreamMaxTotal, "were opened")
+				rejectDataChannel(dc)
 				return
 			}
-
-			if ok, err := igp.epAuth(ep); !ok || err != nil {
-				if err != nil {
-					log.Printf("error when authorizing endpoint: %s: %s", dc.Label(), err)
-				} else {
-					log.Printf("unallowed endpoint: %s", dc.Label())
+			// logged once the header of its stream is read, rather than for every connection.
+			go func() {
+				if err := igp.serveChannelStream(ctx, dc); err != nil {
+					log.Println("ingress:", err)
 				}
-				dc.Close()
+			}()
+			return
+
+		case strings.HasPrefix(label, networkUDP+"/"):
+			ep := Endpoint{network: networkUDP, remote: strings.TrimPrefix(label, networkUDP+"/")}
+			if _, err := igp.authorize(ep); err != nil {
+				log.Println(err)
+				rejectDataChannel(dc)
 				return
 			}
+			create = func() error { return igp.createUDPTunnel(ctx, dc, ep) }
+
+		default:
+			log.Println("got unknown data channel:", label)
+			rejectDataChannel(dc)
+			return
 		}
 
 		log.Println("got data channel: ", dc.Label())
 		go func() {
-			err := igp.createTunnel(ctx, dc)
-			if err != nil {
+			if err := create(); err != nil {
 				log.Println("create tunnel failed: ", err)
 			}
 		}()
 	})
 }
 
+// rejectDataChannel closes dc once it is open, since closing it earlier is not signalled to the peer.
+func rejectDataChannel(dc *webrtc.DataChannel) {
+	if dc.ReadyState() == webrtc.DataChannelStateOpen {
+		dc.Close()
+		return
+	}
+	dc.OnOpen(func() { dc.Close() })
+}
+
+// createTunnel serves the smux session carrying every stream based endpoint of the egress.
 func (igp *IngressProxy) createTunnel(ctx context.Context, dc *webrtc.DataChannel) (err error) {
 	defer dc.Close()
 
@@ -127,7 +219,7 @@ func (igp *IngressProxy) createTunnel(ctx context.Context, dc *webrtc.DataChanne
 	}
 	defer dcc.Close()
 
-	session, err := smux.Server(dcc, nil)
+	session, err := smux.Server(dcc, muxConfig(igp.disconnectGrace))
 	if err != nil {
 		return fmt.Errorf("open session error: %w", err)
 	}
@@ -140,26 +232,102 @@ func (igp *IngressProxy) createTunnel(ctx context.Context, dc *webrtc.DataChanne
 
 		stream, err := session.AcceptStream()
 		if err != nil {
-			log.Println("ingress: accept stream error: ", err)
-			continue
+			return fmt.Errorf("accept stream error: %w", err)
 		}
 
-		conn, err := net.Dial("tcp", dc.Label())
-		if err != nil {
-			log.Println("ingress: dial error: ", err)
-			continue
-		}
-		log.Println("ingress: dial success:", dc.Label())
-
 		go func() {
-			err = relay(conn, stream)
-			if err != nil {
-				log.Println("ingress: relay error:", err)
+			if err := igp.handleStream(ctx, session, stream); err != nil {
+				log.Println("ingress:", err)
 			}
 		}()
 	}
 }
 
+// handleStream authorizes stream against its header before acting on it. session is nil for a stream carried by a data
+// channel of its own.
+func (igp *IngressProxy) handleStream(ctx context.Context, session *smux.Session, stream net.Conn) (err error) {
+	h, err := readStreamHeader(stream)
+	if err != nil {
+		stream.Close()
+		return err
+	}
+	if igp.noCompress {
+		h.Compression = ""
+	}
+
+	switch h.Network {
+	case networkTCP:
+	case networkReverse:
+		if session == nil {
+			writeStreamAck(stream, streamStatusFailure)
+			stream.Close()
+			return fmt.Errorf("unexpected stream network on a data channel: %s", h.Network)
+		}
+		return igp.handleReverseListen(session, stream, h)
+	case networkSNI:
+		return igp.handleSNIStream(ctx, stream, h)
+	default:
+		writeStreamAck(stream, streamStatusFailure)
+		stream.Close()
+		return fmt.Errorf("unexpected stream network: %s", h.Network)
+	}
+
+	// the stream is counted while dialing, so that slow dials can not exceed the limits.
+	ep := Endpoint{network: networkTCP, remote: h.Destination}
+	sl, err := igp.limiter.acquire(igp.peerCert, []Endpoint{ep})
+	if err != nil {
+		writeStreamAck(stream, streamStatusOf(err))
+		stream.Close()
+		return fmt.Errorf("%w: request %s from %s", err, h.RequestID, h.ClientAddr)
+	}
+	conn, upstream, err := igp.dial(ctx, ep)
+	if err != nil {
+		writeStreamAck(stream, streamStatusOf(err))
+		stream.Close()
+		sl.release()
+		return fmt.Errorf("dial error: %w: request %s from %s", err, h.RequestID, h.ClientAddr)
+	}
+	log.Println("ingress: dial success:", h.Destination, conn.RemoteAddr(), "request", h.RequestID, "from", h.ClientAddr)
+
+	// the address actually dialed is checked too, so that asking for it instead of the hostname can not skip the rules.
+	eps := []Endpoint{ep, upstream, {network: networkTCP, remote: conn.RemoteAddr().String()}}
+	if err = igp.limiter.extend(sl, igp.peerCert, eps); err != nil {
+		writeStreamAck(stream, streamStatusOf(err))
+		conn.Close()
+		stream.Close()
+		sl.release()
+		return fmt.Errorf("%w: request %s from %s", err, h.RequestID, h.ClientAddr)
+	}
+	if err = igp.proxyProtocol.writeHeader(conn, eps, h.ClientAddr, igp.peerCert, h.RequestID); err != nil {
+		writeStreamAck(stream, streamStatusFailure)
+		conn.Close()
+		stream.Close()
+		sl.release()
+		return err
+	}
+
+	accepted, err := ackStream(stream, h)
+	if err != nil {
+		conn.Close()
+		stream.Close()
+		sl.release()
+		return fmt.Errorf("accept stream error: %w", err)
+	}
+	limited := sl.wrap(accepted)
+
+	if igp.httpFilter.covers(eps) {
+		if err = igp.httpFilter.relay(igp.peerCert, eps, limited, conn, igp.timeouts.min(sl.timeouts)); err != nil {
+			return fmt.Errorf("http relay error: %w: request %s from %s", err, h.RequestID, h.ClientAddr)
+		}
+		return
+	}
+
+	if err = relay(conn, limited, igp.timeouts.min(sl.timeouts)); err != nil {
+		return fmt.Errorf("relay error: %w", err)
+	}
+	return
+}
+
 func (igp *IngressProxy) Stop() (err error) {
 	return igp.peer.Close()
 }
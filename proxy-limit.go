@@ -0,0 +1,557 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+var (
+	// errQuotaExceeded is returned for the streams whose traffic quota is used up.
+	errQuotaExceeded = errors.New("traffic quota exceeded")
+
+	// errTooManyStreams is returned for the streams beyond the maximum number of concurrent ones.
+	errTooManyStreams = errors.New("too many streams")
+)
+
+// limitSweepInterval is the minimum delay between two removals of the budgets a new stream would get unchanged.
+const limitSweepInterval = time.Minute
+
+// Limiter throttles, meters, and bounds the streams relayed by the ingress, from rules matching their endpoint and peer.
+type Limiter struct {
+	rules []limitRule
+
+	mu        sync.Mutex
+	budgets   map[string]*limitBudget
+	lastSweep time.Time
+}
+
+type limitRule struct {
+	peer peerSelector
+	dest endpointPattern
+
+	up, down float64 // bytes per second
+	quota    int64
+	window   time.Duration
+	streams  int
+	timeouts streamTimeouts
+	shared   bool
+}
+
+// limitBudget is the traffic and the number of streams allowed to the streams matching a rule, either for a single
+// peer or for every peer.
+type limitBudget struct {
+	up, down *tokenBucket
+	quota    *byteQuota
+
+	maxStreams int
+	mu         sync.Mutex
+	streams    int
+}
+
+// NewLimiter parses rules, each written as
+// '[<peer selector>@]<endpoint>[,up=<rate>][,down=<rate>][,quota=<size>/<window>][,streams=<n>][,idle=<duration>]
+// [,lifetime=<duration>][,shared]'. The endpoint is matched like an '--allow' entry. Rates are bytes per second and
+// sizes are bytes, both with an optional k, M, G, or T suffix, or Ki, Mi, Gi, or Ti for powers of 1024. Every rule
+// matching a stream applies to it, and the streams of a peer matching the same rule share its budget, or the streams
+// of every peer with 'shared'.
+func NewLimiter(rules []string) (l *Limiter, err error) {
+	l = &Limiter{budgets: map[string]*limitBudget{}}
+	for _, s := range rules {
+		r, err := limitRuleFromString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid limit: %s: %w", s, err)
+		}
+		l.rules = append(l.rules, r)
+	}
+	return
+}
+
+func limitRuleFromString(s string) (r limitRule, err error) {
+	s, opts, _ := strings.Cut(s, ",")
+	er, err := endpointRuleFromString(strings.TrimSpace(s))
+	if err != nil {
+		return
+	}
+	if er.deny {
+		return r, fmt.Errorf("deny entries are not supported")
+	}
+	r.peer, r.dest = er.peer, er.dest
+
+	for _, kv := range strings.Split(opts, ",") {
+		k, v, _ := strings.Cut(kv, "=")
+		switch k {
+		case "":
+		case "up", "down":
+			n, err := parseByteSize(strings.TrimSuffix(v, "/s"))
+			if err != nil {
+				return r, fmt.Errorf("invalid %s rate: %w", k, err)
+			}
+			if k == "up" {
+				r.up = float64(n)
+			} else {
+				r.down = float64(n)
+			}
+
+		case "quota":
+			size, window, _ := strings.Cut(v, "/")
+			if r.quota, err = parseByteSize(size); err != nil {
+				return r, fmt.Errorf("invalid quota: %w", err)
+			}
+			if r.window, err = time.ParseDuration(window); err != nil || r.window <= 0 {
+				return r, fmt.Errorf("invalid quota window: %s", window)
+			}
+
+		case "streams":
+			if r.streams, err = strconv.Atoi(v); err != nil || r.streams <= 0 {
+				return r, fmt.Errorf("invalid streams: %s", v)
+			}
+
+		case "idle", "lifetime":
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				return r, fmt.Errorf("invalid %s timeout: %s", k, v)
+			}
+			if k == "idle" {
+				r.timeouts.idle = d
+			} else {
+				r.timeouts.lifetime = d
+			}
+
+		case "shared":
+			r.shared = true
+
+		default:
+			return r, fmt.Errorf("unknown option: %s", k)
+		}
+	}
+	if r.up == 0 && r.down == 0 && r.quota == 0 && r.streams == 0 && r.timeouts == (streamTimeouts{}) {
+		return r, fmt.Errorf("missing up, down, quota, streams, idle, or lifetime")
+	}
+	return
+}
+
+var byteSizeUnits = map[string]float64{
+	"": 1, "K": 1e3, "M": 1e6, "G": 1e9, "T": 1e12,
+	"KI": 1 << 10, "MI": 1 << 20, "GI": 1 << 30, "TI": 1 << 40,
+}
+
+// parseByteSize parses a positive number of bytes with an optional unit, such as '512KiB' or '1.5G'.
+func parseByteSize(s string) (n int64, err error) {
+	num := strings.TrimRightFunc(s, unicode.IsLetter)
+	mult, ok := byteSizeUnits[strings.TrimSuffix(strings.ToUpper(s[len(num):]), "B")]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit: %s", s)
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v*mult < 1 || v*mult > math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+	return int64(v * mult), nil
+}
+
+// matchingLocked returns the budgets of the rules matching any of eps for the peer presenting cert, along with the
+// shortest of their timeouts. It must be called with l.mu held.
+func (l *Limiter) matchingLocked(cert *AetherportCertificate, eps []Endpoint) (bs []*limitBudget, t streamTimeouts) {
+	l.sweepLocked(time.Now())
+	for i, r := range l.rules {
+		if !(endpointRule{peer: r.peer, dest: r.dest}).match(cert, eps) {
+			continue
+		}
+
+		key := strconv.Itoa(i)
+		if !r.shared {
+			key += "/" + peerKey(cert)
+		}
+		b, ok := l.budgets[key]
+		if !ok {
+			b = r.newBudget()
+			l.budgets[key] = b
+		}
+		bs, t = append(bs, b), t.min(r.timeouts)
+	}
+	return
+}
+
+// sweepLocked removes the budgets without any stream, whose quota window has ended and whose rates are back to a full
+// burst, as they would be created again the same. Budgets would otherwise pile up for every peer ever seen, such as
+// peers renewing their certificate. It must be called with l.mu held.
+func (l *Limiter) sweepLocked(now time.Time) {
+	if now.Sub(l.lastSweep) < limitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for k, b := range l.budgets {
+		if b.unused(now) {
+			delete(l.budgets, k)
+		}
+	}
+}
+
+func (r limitRule) newBudget() *limitBudget {
+	b := &limitBudget{up: newTokenBucket(r.up), down: newTokenBucket(r.down), maxStreams: r.streams}
+	if r.quota > 0 {
+		b.quota = &byteQuota{limit: r.quota, window: r.window}
+	}
+	return b
+}
+
+// peerKey identifies the peer presenting cert among the budgets.
+func peerKey(cert *AetherportCertificate) string {
+	if cert == nil {
+		return ""
+	}
+	if fp, err := cert.Sha256Sum(); err == nil {
+		return fp
+	}
+	return cert.Details.Name
+}
+
+// acquire counts a new stream to any of eps for the peer presenting cert against the limits of the matching rules,
+// until the stream is released. It fails with errQuotaExceeded or errTooManyStreams when the stream is rejected.
+func (l *Limiter) acquire(cert *AetherportCertificate, eps []Endpoint) (sl *streamLimit, err error) {
+	sl = &streamLimit{}
+	if err = l.extend(sl, cert, eps); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// extend also counts the stream of sl against the limits of the rules matching any of eps, for a stream acquired
+// before dialing whose endpoints are only all known once dialed. sl is left unchanged when it fails.
+func (l *Limiter) extend(sl *streamLimit, cert *AetherportCertificate, eps []Endpoint) (err error) {
+	if l == nil {
+		return
+	}
+
+	// the budgets are counted before l.mu is released, so that they can not be swept in between.
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bs, t := l.matchingLocked(cert, eps)
+
+	var added []*limitBudget
+	for _, b := range bs {
+		if sl.counts(b) {
+			continue
+		}
+
+		b.mu.Lock()
+		switch {
+		case b.quota.exceeded():
+			err = errQuotaExceeded
+		case b.maxStreams > 0 && b.streams >= b.maxStreams:
+			err = errTooManyStreams
+		default:
+			b.streams++
+		}
+		b.mu.Unlock()
+
+		if err != nil {
+			(&streamLimit{budgets: added}).release()
+			return fmt.Errorf("%w: %s for %s", err, eps[0].remoteString(), peerName(cert))
+		}
+		added = append(added, b)
+	}
+	sl.budgets, sl.timeouts = append(sl.budgets, added...), sl.timeouts.min(t)
+	return
+}
+
+// unused reports whether b has no stream and would be created the same at now.
+func (b *limitBudget) unused(now time.Time) bool {
+	b.mu.Lock()
+	streams := b.streams
+	b.mu.Unlock()
+	return streams == 0 && b.quota.ended(now) && b.up.refilled(now) && b.down.refilled(now)
+}
+
+// streamLimit holds the budgets limiting a stream, along with the timeouts of its relay.
+type streamLimit struct {
+	budgets  []*limitBudget
+	timeouts streamTimeouts
+	released sync.Once
+}
+
+func (sl *streamLimit) counts(b *limitBudget) bool {
+	for _, c := range sl.budgets {
+		if c == b {
+			return true
+		}
+	}
+	return false
+}
+
+// release stops counting the stream against the maximum number of streams.
+func (sl *streamLimit) release() {
+	sl.released.Do(func() {
+		for _, b := range sl.budgets {
+			b.mu.Lock()
+			b.streams--
+			b.mu.Unlock()
+		}
+	})
+}
+
+// checkQuota fails with errQuotaExceeded once the quota of any of the budgets is used up.
+func (sl *streamLimit) checkQuota() error {
+	for _, b := range sl.budgets {
+		if b.quota.exceeded() {
+			return errQuotaExceeded
+		}
+	}
+	return nil
+}
+
+// wrap returns conn throttled and metered by the budgets, where reading from conn is the upload of the peer. Closing
+// it releases the stream.
+func (sl *streamLimit) wrap(conn net.Conn) net.Conn {
+	if len(sl.budgets) == 0 {
+		return conn
+	}
+	return &limitedConn{Conn: conn, limit: sl}
+}
+
+// limitedConn is a net.Conn whose reads and writes are throttled and counted against the budgets of its limit.
+type limitedConn struct {
+	net.Conn
+	limit *streamLimit
+}
+
+func (c *limitedConn) Close() error {
+	c.limit.release()
+	return c.Conn.Close()
+}
+
+func (c *limitedConn) Read(b []byte) (n int, err error) {
+	if err = c.limit.checkQuota(); err != nil {
+		return
+	}
+	for _, bg := range c.limit.budgets {
+		b = b[:bg.up.chunk(len(b))]
+	}
+
+	n, err = c.Conn.Read(b)
+	for _, bg := range c.limit.budgets {
+		bg.quota.add(n)
+		bg.up.take(n)
+	}
+	return
+}
+
+func (c *limitedConn) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		if err = c.limit.checkQuota(); err != nil {
+			return
+		}
+		m := len(b)
+		for _, bg := range c.limit.budgets {
+			m = bg.down.chunk(m)
+		}
+		for _, bg := range c.limit.budgets {
+			bg.quota.add(m)
+			bg.down.take(m)
+		}
+
+		k, err := c.Conn.Write(b[:m])
+		if n += k; err != nil {
+			return n, err
+		}
+		b = b[m:]
+	}
+	return
+}
+
+// wrapPacket returns conn, a socket to the remote endpoint of a UDP flow, throttled and metered by the budgets, where
+// writing to conn is the upload of the peer. Unlike wrap, it does not release the flow when closed.
+func (sl *streamLimit) wrapPacket(conn net.Conn) net.Conn {
+	if len(sl.budgets) == 0 {
+		return conn
+	}
+	return &limitedPacketConn{Conn: conn, limit: sl}
+}
+
+// limitedPacketConn is a net.Conn of datagrams whose reads and writes are throttled and counted against the budgets
+// of its limit, each datagram as a whole since it can not be split. Datagrams beyond the rates are dropped rather than
+// waited for, as UDP does, so that the flows sharing a data channel do not wait for each other.
+type limitedPacketConn struct {
+	net.Conn
+	limit *streamLimit
+}
+
+func (c *limitedPacketConn) Read(b []byte) (n int, err error) {
+	for {
+		if n, err = c.Conn.Read(b); err != nil {
+			return
+		}
+		if err = c.limit.checkQuota(); err != nil {
+			return 0, err
+		}
+		if c.admit(n, func(bg *limitBudget) *tokenBucket { return bg.down }) {
+			return
+		}
+	}
+}
+
+// Write drops b without failing when it exceeds the upload rate.
+func (c *limitedPacketConn) Write(b []byte) (n int, err error) {
+	if err = c.limit.checkQuota(); err != nil {
+		return
+	}
+	if !c.admit(len(b), func(bg *limitBudget) *tokenBucket { return bg.up }) {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+// admit reports whether a datagram of n bytes is within the rate of the bucket of every budget, then counts it.
+func (c *limitedPacketConn) admit(n int, bucket func(*limitBudget) *tokenBucket) bool {
+	for _, bg := range c.limit.budgets {
+		if !bucket(bg).available(n) {
+			return false
+		}
+	}
+	for _, bg := range c.limit.budgets {
+		bg.quota.add(n)
+		bucket(bg).tryTake(n)
+	}
+	return true
+}
+
+// tokenBucket allows rate bytes per second on average, in bursts of up to one second worth of bytes. A nil
+// tokenBucket allows any rate.
+type tokenBucket struct {
+	rate float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// chunk returns how many of n bytes can be relayed at once without exceeding the burst.
+func (tb *tokenBucket) chunk(n int) int {
+	if tb == nil || float64(n) <= tb.rate {
+		return n
+	}
+	return int(math.Max(tb.rate, 1))
+}
+
+// refilled reports whether the bucket is back to a full burst at now.
+func (tb *tokenBucket) refilled(now time.Time) bool {
+	if tb == nil {
+		return true
+	}
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	return tb.refillLocked(now) >= tb.rate
+}
+
+// available reports whether n tokens can be taken without waiting. More tokens than a burst can be taken from a full
+// bucket, leaving it in debt.
+func (tb *tokenBucket) available(n int) bool {
+	if tb == nil {
+		return true
+	}
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	return tb.refillLocked(time.Now()) >= math.Min(float64(n), tb.rate)
+}
+
+// tryTake removes n tokens if they are available, reporting whether it did.
+func (tb *tokenBucket) tryTake(n int) bool {
+	if tb == nil || n <= 0 {
+		return true
+	}
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	now := time.Now()
+	tokens := tb.refillLocked(now)
+	if tokens < math.Min(float64(n), tb.rate) {
+		return false
+	}
+	tb.tokens, tb.last = tokens-float64(n), now
+	return true
+}
+
+// refillLocked returns the tokens in the bucket at now. It must be called with tb.mu held.
+func (tb *tokenBucket) refillLocked(now time.Time) float64 {
+	return math.Min(tb.rate, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate)
+}
+
+// take removes n tokens, waiting until they are available. Concurrent takers wait in turn, as each one leaves the
+// bucket in debt for the next one.
+func (tb *tokenBucket) take(n int) {
+	if tb == nil || n <= 0 {
+		return
+	}
+
+	tb.mu.Lock()
+	now := time.Now()
+	tb.tokens, tb.last = tb.refillLocked(now)-float64(n), now
+	wait := time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+	tb.mu.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// byteQuota counts the bytes relayed in fixed windows, each one starting with the first byte after the previous one
+// ended. A nil byteQuota is never exceeded.
+type byteQuota struct {
+	limit  int64
+	window time.Duration
+
+	mu    sync.Mutex
+	start time.Time
+	used  int64
+}
+
+func (q *byteQuota) add(n int) {
+	if q == nil || n <= 0 {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if now := time.Now(); now.Sub(q.start) >= q.window {
+		q.start, q.used = now, 0
+	}
+	q.used += int64(n)
+}
+
+// ended reports whether the current window is over at now, so that the next byte starts a new one.
+func (q *byteQuota) ended(now time.Time) bool {
+	if q == nil {
+		return true
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return now.Sub(q.start) >= q.window
+}
+
+func (q *byteQuota) exceeded() bool {
+	if q == nil {
+		return false
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return time.Since(q.start) < q.window && q.used >= q.limit
+}
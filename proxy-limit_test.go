@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		s string
+		n int64
+	}{
+		{"512", 512},
+		{"1k", 1000},
+		{"1KB", 1000},
+		{"1.5M", 1500000},
+		{"1Ki", 1024},
+		{"2MiB", 2 << 20},
+		{"1T", 1e12},
+	}
+	for _, tt := range tests {
+		n, err := parseByteSize(tt.s)
+		if err != nil || n != tt.n {
+			t.Errorf("%s: got %d, %v, want %d", tt.s, n, err, tt.n)
+		}
+	}
+
+	for _, s := range []string{"", "0", "-1k", "1X", "0.1", "k"} {
+		if _, err := parseByteSize(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestLimitRuleInvalid(t *testing.T) {
+	for _, s := range []string{
+		"10.0.0.5:22",
+		"!10.0.0.5:22,up=1k",
+		"10.0.0.5:22,up=fast",
+		"10.0.0.5:22,quota=1G",
+		"10.0.0.5:22,quota=1G/0s",
+		"10.0.0.5:22,streams=0",
+		"10.0.0.5:22,idle=-1s",
+		"10.0.0.5:22,burst=1",
+	} {
+		if _, err := limitRuleFromString(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestTokenBucketChunk(t *testing.T) {
+	tests := []struct {
+		rate  float64
+		n     int
+		chunk int
+	}{
+		{0, 1 << 20, 1 << 20},
+		{1000, 500, 500},
+		{1000, 1000, 1000},
+		{1000, 4096, 1000},
+		{0.5, 10, 1},
+	}
+	for _, tt := range tests {
+		if got := newTokenBucket(tt.rate).chunk(tt.n); got != tt.chunk {
+			t.Errorf("rate %v, %d bytes: got a chunk of %d, want %d", tt.rate, tt.n, got, tt.chunk)
+		}
+	}
+}
+
+func TestTokenBucketTake(t *testing.T) {
+	tests := []struct {
+		rate  float64
+		takes []int
+		wait  time.Duration
+	}{
+		{0, []int{1 << 30}, 0},
+		{1000, []int{1000}, 0},
+		{1000, []int{500, 500}, 0},
+		{1000, []int{1000, 200}, 200 * time.Millisecond},
+		{1000, []int{1300}, 300 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		tb := newTokenBucket(tt.rate)
+		start := time.Now()
+		for _, n := range tt.takes {
+			tb.take(n)
+		}
+		if d := time.Since(start); d < tt.wait-20*time.Millisecond || d > tt.wait+150*time.Millisecond {
+			t.Errorf("rate %v, taking %v: waited %s, want about %s", tt.rate, tt.takes, d, tt.wait)
+		}
+	}
+}
+
+func TestTokenBucketTryTake(t *testing.T) {
+	tb := newTokenBucket(1000)
+	if !tb.tryTake(4000) {
+		t.Fatal("expected a full bucket to allow more than a burst")
+	}
+	if tb.tryTake(1) || tb.available(1) {
+		t.Fatal("expected a bucket in debt to refuse")
+	}
+	if !newTokenBucket(0).tryTake(1 << 30) {
+		t.Fatal("expected no rate to allow anything")
+	}
+}
+
+func TestByteQuotaWindow(t *testing.T) {
+	q := &byteQuota{limit: 100, window: 100 * time.Millisecond}
+	steps := []struct {
+		sleep    time.Duration
+		add      int
+		exceeded bool
+	}{
+		{0, 60, false},
+		{0, 40, true},
+		{0, 10, true},
+		// the window ended, so that the next byte starts a new one.
+		{120 * time.Millisecond, 0, false},
+		{0, 99, false},
+		{0, 1, true},
+	}
+	for i, s := range steps {
+		time.Sleep(s.sleep)
+		q.add(s.add)
+		if got := q.exceeded(); got != s.exceeded {
+			t.Fatalf("step %d: got exceeded %v, want %v", i, got, s.exceeded)
+		}
+	}
+
+	var none *byteQuota
+	none.add(1 << 30)
+	if none.exceeded() || !none.ended(time.Now()) {
+		t.Fatal("expected a nil quota never to be exceeded")
+	}
+}
+
+var (
+	testLimitPeer  = &AetherportCertificate{Details: AetherportCertificateDetails{Name: "node"}, Signature: []byte{1}}
+	testLimitOther = &AetherportCertificate{Details: AetherportCertificateDetails{Name: "other"}, Signature: []byte{2}}
+)
+
+func TestLimiterStreams(t *testing.T) {
+	tests := []struct {
+		rule  string
+		peers []*AetherportCertificate
+		err   []error
+	}{
+		{"10.0.0.5:22,streams=2", []*AetherportCertificate{testLimitPeer, testLimitPeer, testLimitPeer}, []error{nil, nil, errTooManyStreams}},
+		{"10.0.0.5:22,streams=2", []*AetherportCertificate{testLimitPeer, testLimitPeer, testLimitOther}, []error{nil, nil, nil}},
+		{"10.0.0.5:22,streams=2,shared", []*AetherportCertificate{testLimitPeer, testLimitPeer, testLimitOther}, []error{nil, nil, errTooManyStreams}},
+		{"name=other@10.0.0.5:22,streams=1", []*AetherportCertificate{testLimitPeer, testLimitPeer, testLimitPeer}, []error{nil, nil, nil}},
+		{"10.0.0.6:22,streams=1", []*AetherportCertificate{testLimitPeer, testLimitPeer}, []error{nil, nil}},
+	}
+	for _, tt := range tests {
+		l, err := NewLimiter([]string{tt.rule})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, peer := range tt.peers {
+			_, err := l.acquire(peer, []Endpoint{{remote: "10.0.0.5:22"}})
+			if !errors.Is(err, tt.err[i]) || (err == nil) != (tt.err[i] == nil) {
+				t.Errorf("%s: stream %d: got %v, want %v", tt.rule, i, err, tt.err[i])
+			}
+		}
+	}
+}
+
+func TestLimiterRelease(t *testing.T) {
+	l, err := NewLimiter([]string{"10.0.0.5:22,streams=1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	eps := []Endpoint{{remote: "10.0.0.5:22"}}
+
+	sl, err := l.acquire(testLimitPeer, eps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = l.acquire(testLimitPeer, eps); !errors.Is(err, errTooManyStreams) {
+		t.Fatalf("expected the second stream to be rejected, got %v", err)
+	}
+
+	// a stream wrapped once accepted, then released again on an error path, is only released once.
+	a, b := net.Pipe()
+	defer b.Close()
+	conn := sl.wrap(a)
+	sl.release()
+	conn.Close()
+	sl.release()
+	if n := sl.budgets[0].streams; n != 0 {
+		t.Fatalf("expected no stream left, got %d", n)
+	}
+
+	if _, err = l.acquire(testLimitPeer, eps); err != nil {
+		t.Fatalf("expected a stream to be accepted once the other one is released, got %v", err)
+	}
+}
+
+func TestLimiterExtend(t *testing.T) {
+	l, err := NewLimiter([]string{"10.0.0.5:22,streams=1", "*,streams=2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	requested := []Endpoint{{remote: "db.internal:22"}}
+	dialed := []Endpoint{{remote: "db.internal:22"}, {remote: "10.0.0.5:22"}}
+
+	first, err := l.acquire(testLimitPeer, requested)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = l.extend(first, testLimitPeer, dialed); err != nil {
+		t.Fatal(err)
+	}
+	if len(first.budgets) != 2 {
+		t.Fatalf("expected the stream to count against both rules once dialed, got %d budgets", len(first.budgets))
+	}
+
+	second, err := l.acquire(testLimitPeer, requested)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = l.extend(second, testLimitPeer, dialed); !errors.Is(err, errTooManyStreams) {
+		t.Fatalf("expected the dialed address to be limited, got %v", err)
+	}
+	if len(second.budgets) != 1 {
+		t.Fatalf("expected a failed extend to leave the stream unchanged, got %d budgets", len(second.budgets))
+	}
+
+	second.release()
+	first.release()
+	if _, err = l.acquire(testLimitPeer, dialed); err != nil {
+		t.Fatalf("expected every stream to be released, got %v", err)
+	}
+}
+
+func TestLimitedConnQuota(t *testing.T) {
+	l, err := NewLimiter([]string{"10.0.0.5:22,quota=10/1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	eps := []Endpoint{{remote: "10.0.0.5:22"}}
+	sl, err := l.acquire(testLimitPeer, eps)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := net.Pipe()
+	defer b.Close()
+	conn := sl.wrap(a)
+	defer conn.Close()
+	go b.Write(make([]byte, 10))
+	if n, err := conn.Read(make([]byte, 64)); n != 10 || err != nil {
+		t.Fatalf("expected the quota to be used up, got %d, %v", n, err)
+	}
+
+	if _, err = conn.Read(make([]byte, 64)); !errors.Is(err, errQuotaExceeded) {
+		t.Fatalf("expected the stream to fail once its quota is used up, got %v", err)
+	}
+	if _, err = l.acquire(testLimitPeer, eps); !errors.Is(err, errQuotaExceeded) {
+		t.Fatalf("expected new streams to be rejected until the window ends, got %v", err)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EgressListeners keeps the local sockets of the egress bound across reconnections of the peer, so that clients are
+// not refused while the tunnel is renegotiated and the ports can not be taken by another process in between.
+type EgressListeners struct {
+	// wait is how long an accepted connection waits for a tunnel to take it before being reset.
+	wait time.Duration
+
+	mu      sync.Mutex
+	streams map[string]*egressListener
+	packets map[string]net.PacketConn
+
+	// demands are signaled, per ingress group, when a connection starts waiting for a tunnel.
+	demands map[string]chan struct{}
+}
+
+func NewEgressListeners(wait time.Duration) *EgressListeners {
+	return &EgressListeners{
+		wait:    wait,
+		streams: map[string]*egressListener{},
+		packets: map[string]net.PacketConn{},
+		demands: map[string]chan struct{}{},
+	}
+}
+
+// egressListener accepts connections continuously, handing each one to the tunnel currently receiving from conns.
+type egressListener struct {
+	l     net.Listener
+	conns chan net.Conn
+	done  chan struct{}
+	wait  time.Duration
+
+	group   string
+	demand  chan struct{}
+	waiting int32 // number of connections waiting for a tunnel
+}
+
+// stream returns the listener of ep, listening on its local address if it is not already.
+func (els *EgressListeners) stream(ep Endpoint) (el *egressListener, err error) {
+	els.mu.Lock()
+	defer els.mu.Unlock()
+
+	if el, ok := els.streams[ep.String()]; ok {
+		return el, nil
+	}
+
+	l, err := listenStream(ep.local, ep.options)
+	if err != nil {
+		return nil, err
+	}
+	el = &egressListener{
+		l:      l,
+		conns:  make(chan net.Conn),
+		done:   make(chan struct{}),
+		wait:   els.wait,
+		group:  ep.options.ingress,
+		demand: els.demandLocked(ep.options.ingress),
+	}
+	els.streams[ep.String()] = el
+	go el.acceptLoop()
+	return
+}
+
+// demandLocked returns the channel signaled when a connection of group waits for a tunnel. It must be called with
+// els.mu held.
+func (els *EgressListeners) demandLocked(group string) chan struct{} {
+	if _, ok := els.demands[group]; !ok {
+		els.demands[group] = make(chan struct{}, 1)
+	}
+	return els.demands[group]
+}
+
+// waitDemand waits until a connection accepted for an endpoint of group waits for a tunnel, or until woken up by
+// notify. It reports whether a connection is waiting.
+func (els *EgressListeners) waitDemand(ctx context.Context, group string) (waiting bool, err error) {
+	els.mu.Lock()
+	demand := els.demandLocked(group)
+	els.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	case <-demand:
+	}
+
+	els.mu.Lock()
+	defer els.mu.Unlock()
+	for _, el := range els.streams {
+		if el.group == group && atomic.LoadInt32(&el.waiting) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// notify wakes up whoever waits for a demand of group.
+func (els *EgressListeners) notify(group string) {
+	els.mu.Lock()
+	demand := els.demandLocked(group)
+	els.mu.Unlock()
+
+	select {
+	case demand <- struct{}{}:
+	default:
+	}
+}
+
+// requeue hands conn to the next tunnel of ep, for a connection whose tunnel went down before relaying anything.
+// It reports false when ep is no longer listened on.
+func (els *EgressListeners) requeue(ep Endpoint, conn net.Conn) bool {
+	els.mu.Lock()
+	el, ok := els.streams[ep.String()]
+	els.mu.Unlock()
+
+	if ok {
+		go el.offer(conn)
+	}
+	return ok
+}
+
+func (el *egressListener) acceptLoop() {
+	defer close(el.done)
+
+	for {
+		conn, err := el.l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Println("egress: accept connection error:", err)
+			continue
+		}
+		log.Println("egress: new connection: ", conn.RemoteAddr())
+
+		go el.offer(conn)
+	}
+}
+
+// offer waits for a tunnel to take conn, resetting it when none does in time.
+func (el *egressListener) offer(conn net.Conn) {
+	t := time.NewTimer(el.wait)
+	defer t.Stop()
+
+	atomic.AddInt32(&el.waiting, 1)
+	defer atomic.AddInt32(&el.waiting, -1)
+	select {
+	case el.demand <- struct{}{}:
+	default:
+	}
+
+	select {
+	case el.conns <- conn:
+	case <-t.C:
+		log.Println("egress: no tunnel available, resetting connection:", conn.RemoteAddr())
+		resetConn(conn)
+	case <-el.done:
+		resetConn(conn)
+	}
+}
+
+// packet returns the socket of the udp endpoint ep, listening on its local address if it is not already.
+func (els *EgressListeners) packet(ep Endpoint) (pc net.PacketConn, err error) {
+	els.mu.Lock()
+	defer els.mu.Unlock()
+
+	if pc, ok := els.packets[ep.String()]; ok {
+		return pc, nil
+	}
+
+	if pc, err = net.ListenPacket("udp", ep.local); err != nil {
+		return nil, err
+	}
+	els.packets[ep.String()] = pc
+	return
+}
+
+// listen listens on the local address of ep if it is not already, for the endpoints having one.
+func (els *EgressListeners) listen(ep Endpoint) (err error) {
+	switch {
+	case ep.isStdio(), ep.network == networkReverse:
+		return nil
+	case ep.network == networkUDP:
+		_, err = els.packet(ep)
+	default:
+		_, err = els.stream(ep)
+	}
+	return
+}
+
+// close stops listening for ep, once it is no longer forwarded.
+func (els *EgressListeners) close(ep Endpoint) {
+	els.mu.Lock()
+	defer els.mu.Unlock()
+
+	if el, ok := els.streams[ep.String()]; ok {
+		el.l.Close()
+		delete(els.streams, ep.String())
+	}
+	if pc, ok := els.packets[ep.String()]; ok {
+		pc.Close()
+		delete(els.packets, ep.String())
+	}
+}
+
+// Close stops listening for every endpoint.
+func (els *EgressListeners) Close() (err error) {
+	els.mu.Lock()
+	defer els.mu.Unlock()
+
+	for k, el := range els.streams {
+		el.l.Close()
+		delete(els.streams, k)
+	}
+	for k, pc := range els.packets {
+		pc.Close()
+		delete(els.packets, k)
+	}
+	return
+}
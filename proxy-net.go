@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+const addrUnix = "unix"
+
+// isUnixAddr reports whether addr is in the form of 'unix:<path>'. Paths starting with '@' are abstract sockets on Linux.
+func isUnixAddr(addr string) bool {
+	return strings.HasPrefix(addr, addrUnix+":")
+}
+
+// isLocalAddr reports whether addr can only be reached from this host: a unix socket or a loopback address.
+func isLocalAddr(addr string) bool {
+	if isUnixAddr(addr) {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	return isLoopbackHost(host)
+}
+
+// isLoopbackHost reports whether host is localhost or a loopback IP.
+func isLoopbackHost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+// splitAddr returns the network and address suitable for net.Listen and net.Dial.
+func splitAddr(addr string) (network string, address string) {
+	if isUnixAddr(addr) {
+		return addrUnix, strings.TrimPrefix(addr, addrUnix+":")
+	}
+	return "tcp", addr
+}
+
+// listenStream listens on a tcp or unix socket address, applying the socket permission to unix socket files.
+func listenStream(addr string, opts endpointOptions) (l net.Listener, err error) {
+	network, address := splitAddr(addr)
+	if network != addrUnix {
+		return net.Listen(network, address)
+	}
+
+	abstract := strings.HasPrefix(address, "@")
+	if !abstract {
+		if err := removeStaleSocket(address); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err = net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if !abstract && opts.socketPerm != 0 {
+		if err := os.Chmod(address, opts.socketPerm); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("change socket permission failed: %w", err)
+		}
+	}
+	return
+}
+
+// removeStaleSocket removes a unix socket file left behind by a previous process that no longer listens on it.
+func removeStaleSocket(path string) (err error) {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	if conn, err := net.Dial(addrUnix, path); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use", path)
+	}
+	return os.Remove(path)
+}
+
+// dialStream connects to a tcp or unix socket address.
+func dialStream(addr string) (net.Conn, error) {
+	return net.Dial(splitAddr(addr))
+}
+
+// dialAuthorized authorizes ep and connects to it. A hostname is resolved once and every resolved address is
+// authorized again before being dialed directly, so a DNS answer changing after the check can not redirect the connection.
+func dialAuthorized(ctx context.Context, auth EndpointAuthorizer, cert *AetherportCertificate, ep Endpoint) (conn net.Conn, err error) {
+	if _, err = authorizeEndpoint(auth, cert, ep); err != nil {
+		return
+	}
+
+	network, address := splitAddr(ep.remote)
+	if ep.network == networkUDP {
+		network = networkUDP
+	}
+	host, port, errs := net.SplitHostPort(address)
+	if network == addrUnix || errs != nil || net.ParseIP(host) != nil {
+		return (&net.Dialer{}).DialContext(ctx, network, address)
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		rep := ep
+		rep.remote, rep.resolvedHost = net.JoinHostPort(ip.String(), port), host
+		if _, err = authorizeEndpoint(auth, cert, rep); err != nil {
+			continue
+		}
+		if conn, err = (&net.Dialer{}).DialContext(ctx, network, rep.remote); err == nil {
+			return
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("no address found for %s", host)
+	}
+	return nil, err
+}
+
+// resetConn closes conn, aborting it with a TCP RST instead of a FIN when possible so the client fails fast.
+func resetConn(conn net.Conn) {
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	conn.Close()
+}
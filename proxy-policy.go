@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const policyPollInterval = 2 * time.Second
+
+// Policy authorizes endpoints with ordered rules loaded from a YAML file, which can be reloaded at any time.
+// Reloading only affects the streams opened afterward.
+type Policy struct {
+	path  string
+	rules atomic.Pointer[policyRules]
+}
+
+func LoadPolicy(path string) (p *Policy, err error) {
+	p = &Policy{path: path}
+	if err = p.Reload(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Reload replaces the rules with the current content of the file, keeping the previous ones when it is invalid.
+func (p *Policy) Reload() (err error) {
+	b, err := os.ReadFile(p.path)
+	if err != nil {
+		return fmt.Errorf("read policy file failed: %w", err)
+	}
+	rules, err := parsePolicy(b)
+	if err != nil {
+		return fmt.Errorf("parse policy file failed: %s: %w", p.path, err)
+	}
+	p.rules.Store(rules)
+	return
+}
+
+// Watch reloads the policy on SIGHUP or when the file changes, until ctx is done.
+func (p *Policy) Watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	t := time.NewTicker(policyPollInterval)
+	defer t.Stop()
+
+	last, _ := os.Stat(p.path)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-hup:
+
+		case <-t.C:
+			fi, err := os.Stat(p.path)
+			if err != nil || (last != nil && fi.ModTime().Equal(last.ModTime()) && fi.Size() == last.Size()) {
+				continue
+			}
+			last = fi
+		}
+
+		if err := p.Reload(); err != nil {
+			log.Println("policy: reload failed, keeping the previous rules:", err)
+			continue
+		}
+		log.Println("policy: reloaded", p.path)
+	}
+}
+
+// Authorizer returns the authorizer for the destinations of streams.
+func (p *Policy) Authorizer() EndpointAuthorizer {
+	return func(cert *AetherportCertificate, ep Endpoint) (bool, error) {
+		return p.rules.Load().authorize(cert, ep, false, time.Now()), nil
+	}
+}
+
+// ReverseAuthorizer returns the authorizer for the addresses listened on for reverse forwards.
+func (p *Policy) ReverseAuthorizer() EndpointAuthorizer {
+	return func(cert *AetherportCertificate, ep Endpoint) (bool, error) {
+		return p.rules.Load().authorize(cert, ep, true, time.Now()), nil
+	}
+}
+
+type policyFile struct {
+	Default  string           `yaml:"default"`
+	Timezone string           `yaml:"timezone"`
+	Rules    []policyRuleFile `yaml:"rules"`
+}
+
+type policyRuleFile struct {
+	Name    string `yaml:"name"`
+	Action  string `yaml:"action"`
+	Reverse bool   `yaml:"reverse"`
+	Peer    struct {
+		Name   string            `yaml:"name"`
+		Issuer string            `yaml:"issuer"`
+		Labels map[string]string `yaml:"labels"`
+	} `yaml:"peer"`
+	Destinations []string           `yaml:"destinations"`
+	Time         []policyWindowFile `yaml:"time"`
+}
+
+type policyWindowFile struct {
+	Days []string `yaml:"days"`
+	From string   `yaml:"from"`
+	To   string   `yaml:"to"`
+}
+
+type policyRules struct {
+	allowByDefault bool
+	location       *time.Location
+	rules          []policyRule
+}
+
+type policyRule struct {
+	allow   bool
+	reverse bool
+	peer    peerSelector
+	dests   []endpointPattern
+	windows []policyWindow
+}
+
+func parsePolicy(b []byte) (pr *policyRules, err error) {
+	var f policyFile
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err = dec.Decode(&f); err != nil {
+		return nil, err
+	}
+
+	pr = &policyRules{location: time.Local}
+	switch f.Default {
+	case "", "deny":
+	case "allow":
+		pr.allowByDefault = true
+	default:
+		return nil, fmt.Errorf("invalid default action: %s", f.Default)
+	}
+	if f.Timezone != "" {
+		if pr.location, err = time.LoadLocation(f.Timezone); err != nil {
+			return nil, fmt.Errorf("invalid timezone: %w", err)
+		}
+	}
+
+	for i, rf := range f.Rules {
+		r, err := parsePolicyRule(rf)
+		if err != nil && rf.Name != "" {
+			return nil, fmt.Errorf("invalid rule #%d (%s): %w", i+1, rf.Name, err)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule #%d: %w", i+1, err)
+		}
+		pr.rules = append(pr.rules, r)
+	}
+	return
+}
+
+func parsePolicyRule(rf policyRuleFile) (r policyRule, err error) {
+	switch rf.Action {
+	case "allow":
+		r.allow = true
+	case "deny":
+	default:
+		return r, fmt.Errorf("invalid action: %q", rf.Action)
+	}
+	r.reverse = rf.Reverse
+
+	r.peer = peerSelector{name: rf.Peer.Name, issuer: strings.ToLower(rf.Peer.Issuer)}
+	for k, v := range rf.Peer.Labels {
+		r.peer.labels = append(r.peer.labels, newLabel(k, v))
+	}
+
+	if len(rf.Destinations) == 0 {
+		return r, fmt.Errorf("no destinations")
+	}
+	for _, d := range rf.Destinations {
+		p, err := endpointPatternFromString(d)
+		if err != nil {
+			return r, fmt.Errorf("invalid destination: %s: %w", d, err)
+		}
+		r.dests = append(r.dests, p)
+	}
+
+	for _, wf := range rf.Time {
+		w, err := parsePolicyWindow(wf)
+		if err != nil {
+			return r, err
+		}
+		r.windows = append(r.windows, w)
+	}
+	return
+}
+
+// authorize returns the action of the first rule matching cert and ep, or the default action when none does. Reverse
+// listen addresses are denied by default, whatever the default action, so that only explicit rules let peers listen
+// on the receiver.
+func (pr *policyRules) authorize(cert *AetherportCertificate, ep Endpoint, reverse bool, now time.Time) bool {
+	now = now.In(pr.location)
+	eps := authorizedForms(ep)
+	for _, r := range pr.rules {
+		if r.match(cert, eps, reverse, now) {
+			return r.allow
+		}
+	}
+	return pr.allowByDefault && !reverse
+}
+
+func (r policyRule) match(cert *AetherportCertificate, eps []Endpoint, reverse bool, now time.Time) bool {
+	if r.reverse != reverse || !r.peer.match(cert) || !r.activeAt(now) {
+		return false
+	}
+	for _, d := range r.dests {
+		for _, ep := range eps {
+			if d.match(ep) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r policyRule) activeAt(t time.Time) bool {
+	if len(r.windows) == 0 {
+		return true
+	}
+	for _, w := range r.windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// policyWindow is a daily time range, wrapping around midnight when to is before from. to is 24h for the end of the day.
+type policyWindow struct {
+	days     [7]bool
+	from, to time.Duration
+}
+
+var policyWeekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func parsePolicyWindow(wf policyWindowFile) (w policyWindow, err error) {
+	for _, d := range wf.Days {
+		wd, ok := policyWeekdays[strings.ToLower(d)]
+		if !ok {
+			return w, fmt.Errorf("invalid day: %s", d)
+		}
+		w.days[wd] = true
+	}
+	if len(wf.Days) == 0 {
+		w.days = [7]bool{true, true, true, true, true, true, true}
+	}
+
+	if w.from, err = parseTimeOfDay(wf.From, 0); err != nil {
+		return
+	}
+	if w.to, err = parseTimeOfDay(wf.To, 24*time.Hour); err != nil {
+		return
+	}
+	return
+}
+
+func parseTimeOfDay(s string, def time.Duration) (d time.Duration, err error) {
+	switch s {
+	case "":
+		return def, nil
+	case "24:00":
+		return 24 * time.Hour, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day, expecting hh:mm: %s", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (w policyWindow) contains(t time.Time) bool {
+	d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if w.from <= w.to {
+		return w.days[t.Weekday()] && d >= w.from && d < w.to
+	}
+
+	// wrapping around midnight, the part after midnight belongs to the window started the day before.
+	if d >= w.from {
+		return w.days[t.Weekday()]
+	}
+	return d < w.to && w.days[(t.Weekday()+6)%7]
+}
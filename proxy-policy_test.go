@@ -0,0 +1,169 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testPolicy = `
+default: allow
+timezone: Asia/Jakarta
+rules:
+  - name: no metadata
+    action: deny
+    destinations: ["169.254.169.254:*"]
+
+  - name: db team during office hours
+    action: allow
+    peer:
+      labels: {team: db}
+    destinations: ["10.0.0.0/8:5432"]
+    time:
+      - days: [mon, tue, wed, thu, fri]
+        from: "08:00"
+        to: "18:00"
+
+  - name: no database otherwise
+    action: deny
+    destinations: ["10.0.0.0/8:5432"]
+
+  - name: ci preview
+    action: allow
+    reverse: true
+    peer: {name: ci}
+    destinations: ["0.0.0.0:8080"]
+`
+
+func TestPolicyFirstMatch(t *testing.T) {
+	pr, err := parsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := &AetherportCertificate{Details: AetherportCertificateDetails{Name: "db", Labels: []label{newLabel("team", "db")}}}
+	ci := &AetherportCertificate{Details: AetherportCertificateDetails{Name: "ci"}}
+	jakarta, _ := time.LoadLocation("Asia/Jakarta")
+	office := time.Date(2024, 3, 6, 10, 0, 0, 0, jakarta)  // a wednesday
+	evening := time.Date(2024, 3, 6, 19, 0, 0, 0, jakarta) // same day, after hours
+	sunday := time.Date(2024, 3, 10, 10, 0, 0, 0, jakarta)
+
+	tests := []struct {
+		name    string
+		cert    *AetherportCertificate
+		ep      Endpoint
+		reverse bool
+		now     time.Time
+		allow   bool
+	}{
+		{"deny before any allow", db, Endpoint{remote: "169.254.169.254:80"}, false, office, false},
+		{"allowed during the window", db, Endpoint{remote: "10.0.0.5:5432"}, false, office, true},
+		{"window in another timezone", db, Endpoint{remote: "10.0.0.5:5432"}, false, office.UTC(), true},
+		{"denied after the window", db, Endpoint{remote: "10.0.0.5:5432"}, false, evening, false},
+		{"denied on another day", db, Endpoint{remote: "10.0.0.5:5432"}, false, sunday, false},
+		{"peer not matching", ci, Endpoint{remote: "10.0.0.5:5432"}, false, office, false},
+		{"default allow", ci, Endpoint{remote: "192.168.0.1:22"}, false, office, true},
+		{"resolved address checked", db, Endpoint{remote: "169.254.169.254:80", resolvedHost: "metadata"}, false, office, false},
+		{"reverse rule", ci, Endpoint{remote: "0.0.0.0:8080"}, true, office, true},
+		{"reverse rule of another peer", db, Endpoint{remote: "0.0.0.0:8080"}, true, office, false},
+		{"reverse denied by default", ci, Endpoint{remote: "0.0.0.0:9090"}, true, office, false},
+		{"destination rules not applying to reverse", db, Endpoint{remote: "10.0.0.5:5432"}, true, office, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pr.authorize(tt.cert, tt.ep, tt.reverse, tt.now); got != tt.allow {
+				t.Errorf("got %v, want %v", got, tt.allow)
+			}
+		})
+	}
+}
+
+func TestPolicyDefaultDeny(t *testing.T) {
+	pr, err := parsePolicy([]byte("rules: []"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pr.authorize(nil, Endpoint{remote: "10.0.0.1:22"}, false, time.Now()) {
+		t.Error("expected the endpoint to be denied by default")
+	}
+}
+
+func TestPolicyWindow(t *testing.T) {
+	at := func(day, hour, min int) time.Time { return time.Date(2024, 3, day, hour, min, 0, 0, time.UTC) }
+	monday, tuesday, saturday := 4, 5, 9
+
+	tests := []struct {
+		name   string
+		window policyWindowFile
+		t      time.Time
+		inside bool
+	}{
+		{"start included", policyWindowFile{From: "08:00", To: "18:00"}, at(monday, 8, 0), true},
+		{"end excluded", policyWindowFile{From: "08:00", To: "18:00"}, at(monday, 18, 0), false},
+		{"until end of day", policyWindowFile{From: "20:00", To: "24:00"}, at(monday, 23, 59), true},
+		{"end of day excludes midnight", policyWindowFile{From: "20:00", To: "24:00"}, at(tuesday, 0, 0), false},
+		{"whole day by default", policyWindowFile{}, at(monday, 23, 59), true},
+		{"wrapping, before midnight", policyWindowFile{From: "22:00", To: "06:00"}, at(monday, 23, 0), true},
+		{"wrapping, after midnight", policyWindowFile{From: "22:00", To: "06:00"}, at(tuesday, 5, 59), true},
+		{"wrapping, outside", policyWindowFile{From: "22:00", To: "06:00"}, at(monday, 12, 0), false},
+		{
+			"wrapping, after midnight of a listed day",
+			policyWindowFile{Days: []string{"fri"}, From: "22:00", To: "06:00"}, at(saturday, 1, 0), true,
+		},
+		{
+			"wrapping, after midnight of an unlisted day",
+			policyWindowFile{Days: []string{"sat"}, From: "22:00", To: "06:00"}, at(saturday, 1, 0), false,
+		},
+		{"day not listed", policyWindowFile{Days: []string{"Tue"}}, at(monday, 12, 0), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parsePolicyWindow(tt.window)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := w.contains(tt.t); got != tt.inside {
+				t.Errorf("got %v, want %v", got, tt.inside)
+			}
+		})
+	}
+}
+
+func TestPolicyInvalid(t *testing.T) {
+	for name, p := range map[string]string{
+		"default":     "default: maybe",
+		"action":      "rules: [{action: permit, destinations: ['*']}]",
+		"destination": "rules: [{action: allow, destinations: ['10.0.0.1']}]",
+		"none":        "rules: [{action: allow}]",
+		"day":         "rules: [{action: allow, destinations: ['*'], time: [{days: [someday]}]}]",
+		"time":        "rules: [{action: allow, destinations: ['*'], time: [{from: '8am'}]}]",
+		"field":       "rules: [{action: allow, destinations: ['*'], port: 22}]",
+		"timezone":    "timezone: Nowhere/Never",
+	} {
+		if _, err := parsePolicy([]byte(p)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestPolicyReloadKeepsRulesOnError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(path, []byte("default: allow"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := LoadPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.WriteFile(path, []byte("default: maybe"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Reload(); err == nil {
+		t.Fatal("expected the invalid policy to be rejected")
+	}
+	if ok, _ := p.Authorizer()(nil, Endpoint{remote: "10.0.0.1:22"}); !ok {
+		t.Error("expected the previous rules to be kept")
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Types of the TLVs added to PROXY protocol v2 headers, in the range reserved for custom use.
+const (
+	proxyTLVPeerName        = 0xE0
+	proxyTLVPeerLabels      = 0xE1 // comma separated '<key>=<value>'
+	proxyTLVPeerFingerprint = 0xE2
+
+	proxyTLVUniqueID = 0x05 // PP2_TYPE_UNIQUE_ID, set to the request ID
+
+	proxyHeaderTimeout = 10 * time.Second
+	proxyV1MaxLength   = 107 // the longest v1 header, with its CRLF
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtocol chooses the upstreams whose connections start with a PROXY protocol header.
+type ProxyProtocol struct {
+	rules []proxyProtocolRule
+}
+
+type proxyProtocolRule struct {
+	dest    endpointPattern
+	version int
+}
+
+// NewProxyProtocol parses rules, each written as '<endpoint>[,version=1|2]', where the endpoint is matched like an
+// '--allow' entry. Version 2 is the default, and the only one carrying the peer identity.
+func NewProxyProtocol(rules []string) (pp *ProxyProtocol, err error) {
+	pp = &ProxyProtocol{}
+	for _, s := range rules {
+		s, opts, _ := strings.Cut(s, ",")
+		r := proxyProtocolRule{version: 2}
+		if r.dest, err = endpointPatternFromString(s); err != nil {
+			return nil, fmt.Errorf("invalid proxy protocol rule: %s: %w", s, err)
+		}
+
+		switch opts {
+		case "", "version=2":
+		case "version=1":
+			r.version = 1
+		default:
+			return nil, fmt.Errorf("invalid proxy protocol option: %s", opts)
+		}
+		pp.rules = append(pp.rules, r)
+	}
+	return
+}
+
+// version returns the PROXY protocol version to use for connections to any of eps, or 0 for none.
+func (pp *ProxyProtocol) version(eps []Endpoint) int {
+	if pp == nil {
+		return 0
+	}
+	for _, r := range pp.rules {
+		for _, ep := range eps {
+			if r.dest.match(ep) {
+				return r.version
+			}
+		}
+	}
+	return 0
+}
+
+// writeHeader writes the PROXY protocol header for the connection from clientAddr, relayed for the peer presenting
+// cert, to conn when eps requires one.
+func (pp *ProxyProtocol) writeHeader(conn net.Conn, eps []Endpoint, clientAddr string, cert *AetherportCertificate, requestID string) (err error) {
+	var b []byte
+	src, _ := netip.ParseAddrPort(clientAddr)
+	dst, _ := netip.ParseAddrPort(conn.RemoteAddr().String())
+	switch pp.version(eps) {
+	case 0:
+		return
+	case 1:
+		b = proxyHeaderV1(src, dst)
+	default:
+		b = proxyHeaderV2(src, dst, proxyPeerTLVs(cert, requestID))
+	}
+
+	if _, err = conn.Write(b); err != nil {
+		return fmt.Errorf("write proxy protocol header failed: %w", err)
+	}
+	return
+}
+
+func proxyHeaderV1(src, dst netip.AddrPort) []byte {
+	src, dst, ok := proxyAddrs(src, dst)
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	family := "TCP4"
+	if src.Addr().Is6() {
+		family = "TCP6"
+	}
+	return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", family, src.Addr(), dst.Addr(), src.Port(), dst.Port())
+}
+
+func proxyHeaderV2(src, dst netip.AddrPort, tlvs []byte) []byte {
+	var addrs bytes.Buffer
+	command, family := byte(0x20), byte(0x00) // LOCAL, UNSPEC
+	if src, dst, ok := proxyAddrs(src, dst); ok {
+		command, family = 0x21, 0x11 // PROXY, TCP over IPv4
+		if src.Addr().Is6() {
+			family = 0x21 // TCP over IPv6
+		}
+		sa, da := src.Addr().AsSlice(), dst.Addr().AsSlice()
+		addrs.Write(sa)
+		addrs.Write(da)
+		binary.Write(&addrs, binary.BigEndian, src.Port())
+		binary.Write(&addrs, binary.BigEndian, dst.Port())
+	}
+
+	b := append([]byte{}, proxyV2Signature...)
+	b = append(b, command, family)
+	b = binary.BigEndian.AppendUint16(b, uint16(addrs.Len()+len(tlvs)))
+	b = append(b, addrs.Bytes()...)
+	return append(b, tlvs...)
+}
+
+// proxyAddrs returns src and dst in the same address family, reporting false when either is missing.
+func proxyAddrs(src, dst netip.AddrPort) (netip.AddrPort, netip.AddrPort, bool) {
+	if !src.IsValid() || !dst.IsValid() {
+		return src, dst, false
+	}
+
+	sa, da := src.Addr().Unmap(), dst.Addr().Unmap()
+	if sa.Is4() != da.Is4() {
+		sa, da = netip.AddrFrom16(sa.As16()), netip.AddrFrom16(da.As16())
+	}
+	return netip.AddrPortFrom(sa, src.Port()), netip.AddrPortFrom(da, dst.Port()), true
+}
+
+func proxyPeerTLVs(cert *AetherportCertificate, requestID string) (b []byte) {
+	tlv := func(t byte, v string) {
+		if v == "" || len(v) > 0xFFFF {
+			return
+		}
+		b = append(b, t)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(v)))
+		b = append(b, v...)
+	}
+
+	tlv(proxyTLVUniqueID, requestID)
+	if cert == nil {
+		return
+	}
+	tlv(proxyTLVPeerName, cert.Details.Name)
+
+	labels := make([]string, 0, len(cert.Details.Labels))
+	for _, l := range cert.Details.Labels {
+		labels = append(labels, l.String())
+	}
+	tlv(proxyTLVPeerLabels, strings.Join(labels, ","))
+
+	if fp, err := cert.Sha256Sum(); err == nil {
+		tlv(proxyTLVPeerFingerprint, fp)
+	}
+	return
+}
+
+// proxiedConn is a connection whose client address was given by a PROXY protocol header.
+type proxiedConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (pc proxiedConn) Read(b []byte) (n int, err error) {
+	return pc.r.Read(b)
+}
+
+func (pc proxiedConn) RemoteAddr() net.Addr {
+	return pc.remote
+}
+
+// acceptProxyHeader reads the PROXY protocol v1 or v2 header conn starts with, returning conn with the client address
+// it carries. A header without an address, such as a health check, keeps the address of conn.
+func acceptProxyHeader(conn net.Conn) (pc net.Conn, err error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	br := bufio.NewReader(conn)
+	sig, err := br.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("read proxy protocol header failed: %w", err)
+	}
+
+	var remote net.Addr
+	if bytes.Equal(sig, proxyV2Signature) {
+		remote, err = readProxyHeaderV2(br)
+	} else {
+		remote, err = readProxyHeaderV1(br)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read proxy protocol header failed: %w", err)
+	}
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	return proxiedConn{Conn: conn, r: br, remote: remote}, nil
+}
+
+func readProxyHeaderV1(br *bufio.Reader) (remote net.Addr, err error) {
+	line, err := br.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) > proxyV1MaxLength || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("invalid v1 header: %q", line)
+	}
+	f := strings.Split(string(line[:len(line)-2]), " ")
+	switch {
+	case len(f) >= 2 && f[0] == "PROXY" && f[1] == "UNKNOWN":
+		return nil, nil
+	case len(f) != 6 || f[0] != "PROXY" || (f[1] != "TCP4" && f[1] != "TCP6"):
+		return nil, fmt.Errorf("invalid v1 header: %q", line)
+	}
+
+	var ips [2]netip.Addr
+	var ports [2]uint64
+	for i := range ips {
+		if ips[i], err = netip.ParseAddr(f[2+i]); err != nil || ips[i].Is4() != (f[1] == "TCP4") || ips[i].Zone() != "" {
+			return nil, fmt.Errorf("invalid v1 address: %s", f[2+i])
+		}
+		if ports[i], err = strconv.ParseUint(f[4+i], 10, 16); err != nil {
+			return nil, fmt.Errorf("invalid v1 port: %s", f[4+i])
+		}
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ips[0], uint16(ports[0]))), nil
+}
+
+func readProxyHeaderV2(br *bufio.Reader) (remote net.Addr, err error) {
+	h := make([]byte, len(proxyV2Signature)+4)
+	if _, err = io.ReadFull(br, h); err != nil {
+		return
+	}
+	command, family := h[12], h[13]
+	b := make([]byte, binary.BigEndian.Uint16(h[14:]))
+	if _, err = io.ReadFull(br, b); err != nil {
+		return
+	}
+
+	var addrs int
+	switch family {
+	case 0x11, 0x12: // TCP or UDP over IPv4
+		addrs = 12
+	case 0x21, 0x22: // TCP or UDP over IPv6
+		addrs = 36
+	case 0x31, 0x32: // UNIX stream or datagram
+		addrs = 216
+	}
+	switch {
+	case command>>4 != 2:
+		return nil, fmt.Errorf("unsupported v2 version: %d", command>>4)
+	case command&0xF > 1:
+		return nil, fmt.Errorf("unsupported v2 command: %d", command&0xF)
+	case len(b) < addrs:
+		return nil, fmt.Errorf("v2 addresses too short: %d bytes", len(b))
+	}
+	if _, err = parseProxyTLVs(b[addrs:]); err != nil {
+		return
+	}
+
+	switch {
+	case command&0xF == 0: // LOCAL
+		return nil, nil
+	case family == 0x11:
+		ip, _ := netip.AddrFromSlice(b[0:4])
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, binary.BigEndian.Uint16(b[8:]))), nil
+	case family == 0x21:
+		ip, _ := netip.AddrFromSlice(b[0:16])
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, binary.BigEndian.Uint16(b[32:]))), nil
+	}
+	return nil, nil
+}
+
+// parseProxyTLVs returns the values of the TLVs b consists of by type, failing when one overruns b.
+func parseProxyTLVs(b []byte) (tlvs map[byte][]byte, err error) {
+	tlvs = map[byte][]byte{}
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, fmt.Errorf("v2 tlv too short: %d bytes", len(b))
+		}
+		n := int(binary.BigEndian.Uint16(b[1:]))
+		if len(b) < 3+n {
+			return nil, fmt.Errorf("v2 tlv 0x%02X overruns the header: %d bytes", b[0], n)
+		}
+		tlvs[b[0]] = b[3 : 3+n]
+		b = b[3+n:]
+	}
+	return
+}
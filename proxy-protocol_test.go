@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testProxyHeaderV2(command, family byte, body []byte) []byte {
+	b := append([]byte{}, proxyV2Signature...)
+	b = append(b, command, family)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(body)))
+	return append(b, body...)
+}
+
+func decodeTestHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestProxyHeaderGolden(t *testing.T) {
+	src4, dst4 := netip.MustParseAddrPort("192.0.2.1:51234"), netip.MustParseAddrPort("10.0.0.5:22")
+	src6, dst6 := netip.MustParseAddrPort("[2001:db8::1]:51234"), netip.MustParseAddrPort("[fd00::5]:22")
+	tlvs := proxyPeerTLVs(nil, "req-1")
+
+	tests := []struct {
+		name string
+		got  []byte
+		want []byte
+	}{
+		{"v1 ipv4", proxyHeaderV1(src4, dst4), []byte("PROXY TCP4 192.0.2.1 10.0.0.5 51234 22\r\n")},
+		{"v1 ipv6", proxyHeaderV1(src6, dst6), []byte("PROXY TCP6 2001:db8::1 fd00::5 51234 22\r\n")},
+		{"v1 mixed", proxyHeaderV1(src4, dst6), []byte("PROXY TCP6 ::ffff:192.0.2.1 fd00::5 51234 22\r\n")},
+		{"v1 mapped", proxyHeaderV1(netip.MustParseAddrPort("[::ffff:192.0.2.1]:51234"), dst4), []byte("PROXY TCP4 192.0.2.1 10.0.0.5 51234 22\r\n")},
+		{"v1 unknown", proxyHeaderV1(netip.AddrPort{}, dst4), []byte("PROXY UNKNOWN\r\n")},
+		{"v2 ipv4", proxyHeaderV2(src4, dst4, tlvs), decodeTestHex(t,
+			"0d0a0d0a000d0a515549540a 21 11 0014 c0000201 0a000005 c822 0016 05 0005 7265712d31")},
+		{"v2 ipv6", proxyHeaderV2(src6, dst6, nil), decodeTestHex(t,
+			"0d0a0d0a000d0a515549540a 21 21 0024 20010db8000000000000000000000001 fd000000000000000000000000000005 c822 0016")},
+		{"v2 local", proxyHeaderV2(netip.AddrPort{}, dst4, tlvs), decodeTestHex(t,
+			"0d0a0d0a000d0a515549540a 20 00 0008 05 0005 7265712d31")},
+	}
+	for _, tt := range tests {
+		if !bytes.Equal(tt.got, tt.want) {
+			t.Errorf("%s: got %x, want %x", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestProxyPeerTLVs(t *testing.T) {
+	cert := &AetherportCertificate{Details: AetherportCertificateDetails{
+		Name:   "node",
+		Labels: []label{newLabel("env", "prod"), newLabel("team", "a")},
+	}}
+	fp, err := cert.Sha256Sum()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := decodeTestHex(t, "05 0005 7265712d31  e0 0004 6e6f6465  e1 000f 656e763d70726f642c7465616d3d61  e2 0040")
+	want = append(want, fp...)
+	if got := proxyPeerTLVs(cert, "req-1"); !bytes.Equal(got, want) {
+		t.Fatalf("got %x, want %x", got, want)
+	}
+
+	// empty values are left out.
+	cert.Details.Labels = nil
+	if fp, err = cert.Sha256Sum(); err != nil {
+		t.Fatal(err)
+	}
+	want = append(decodeTestHex(t, "e0 0004 6e6f6465  e2 0040"), fp...)
+	if got := proxyPeerTLVs(cert, ""); !bytes.Equal(got, want) {
+		t.Fatalf("got %x, want %x", got, want)
+	}
+	if got := proxyPeerTLVs(nil, ""); len(got) != 0 {
+		t.Fatalf("expected no tlv without peer and request ID, got %x", got)
+	}
+}
+
+// acceptTestProxyHeader passes header followed by data through acceptProxyHeader.
+func acceptTestProxyHeader(t *testing.T, header []byte) (net.Conn, error) {
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close(); server.Close() })
+	go func() {
+		client.Write(append(header, "data"...))
+		client.Close()
+	}()
+	return acceptProxyHeader(server)
+}
+
+func TestAcceptProxyHeaderRoundTrip(t *testing.T) {
+	dst4, dst6 := netip.MustParseAddrPort("10.0.0.5:22"), netip.MustParseAddrPort("[fd00::5]:22")
+	tests := []struct {
+		src, dst netip.AddrPort
+		remote   string
+	}{
+		{netip.MustParseAddrPort("192.0.2.1:51234"), dst4, "192.0.2.1:51234"},
+		{netip.MustParseAddrPort("[2001:db8::1]:51234"), dst6, "[2001:db8::1]:51234"},
+		{netip.MustParseAddrPort("192.0.2.1:51234"), dst6, "192.0.2.1:51234"},
+		{netip.AddrPort{}, dst4, "pipe"},
+	}
+	cert := &AetherportCertificate{Details: AetherportCertificateDetails{Name: "node", Labels: []label{newLabel("env", "prod")}}}
+	for _, tt := range tests {
+		for version, header := range map[int][]byte{
+			1: proxyHeaderV1(tt.src, tt.dst),
+			2: proxyHeaderV2(tt.src, tt.dst, proxyPeerTLVs(cert, "req-1")),
+		} {
+			conn, err := acceptTestProxyHeader(t, header)
+			if err != nil {
+				t.Errorf("v%d from %s: %v", version, tt.src, err)
+				continue
+			}
+			if got := conn.RemoteAddr().String(); got != tt.remote {
+				t.Errorf("v%d from %s: got remote %s, want %s", version, tt.src, got, tt.remote)
+			}
+			if b, err := io.ReadAll(conn); string(b) != "data" {
+				t.Errorf("v%d from %s: expected the data after the header, got %q: %v", version, tt.src, b, err)
+			}
+		}
+	}
+}
+
+func TestProxyHeaderV2TLVs(t *testing.T) {
+	cert := &AetherportCertificate{Details: AetherportCertificateDetails{
+		Name:   "node",
+		Labels: []label{newLabel("env", "prod"), newLabel("team", "a")},
+	}}
+	fp, err := cert.Sha256Sum()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		src, dst netip.AddrPort
+		addrs    int
+	}{
+		{netip.MustParseAddrPort("192.0.2.1:51234"), netip.MustParseAddrPort("10.0.0.5:22"), 12},
+		{netip.MustParseAddrPort("[2001:db8::1]:51234"), netip.MustParseAddrPort("[fd00::5]:22"), 36},
+		{netip.AddrPort{}, netip.MustParseAddrPort("10.0.0.5:22"), 0},
+	}
+	for _, tt := range tests {
+		b := proxyHeaderV2(tt.src, tt.dst, proxyPeerTLVs(cert, "req-1"))
+		tlvs, err := parseProxyTLVs(b[len(proxyV2Signature)+4+tt.addrs:])
+		if err != nil {
+			t.Fatalf("%s: %v", tt.src, err)
+		}
+		want := map[byte]string{
+			proxyTLVUniqueID:        "req-1",
+			proxyTLVPeerName:        "node",
+			proxyTLVPeerLabels:      "env=prod,team=a",
+			proxyTLVPeerFingerprint: fp,
+		}
+		if len(tlvs) != len(want) {
+			t.Errorf("%s: got %d tlvs, want %d", tt.src, len(tlvs), len(want))
+		}
+		for typ, v := range want {
+			if string(tlvs[typ]) != v {
+				t.Errorf("%s: tlv 0x%02X: got %q, want %q", tt.src, typ, tlvs[typ], v)
+			}
+		}
+	}
+}
+
+func TestAcceptProxyHeaderInvalid(t *testing.T) {
+	addrs4 := decodeTestHex(t, "c0000201 0a000005 c822 0016")
+	tests := map[string][]byte{
+		"not proxy":          []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"),
+		"v1 missing port":    []byte("PROXY TCP4 192.0.2.1 10.0.0.5 51234\r\n"),
+		"v1 unknown family":  []byte("PROXY UDP4 192.0.2.1 10.0.0.5 51234 22\r\n"),
+		"v1 family mismatch": []byte("PROXY TCP4 2001:db8::1 10.0.0.5 51234 22\r\n"),
+		"v1 bad address":     []byte("PROXY TCP4 192.0.2 10.0.0.5 51234 22\r\n"),
+		"v1 bad port":        []byte("PROXY TCP4 192.0.2.1 10.0.0.5 70000 22\r\n"),
+		"v1 double space":    []byte("PROXY TCP4  192.0.2.1 10.0.0.5 51234 22\r\n"),
+		"v1 missing cr":      []byte("PROXY TCP4 192.0.2.1 10.0.0.5 51234 22\n"),
+		"v1 too long":        []byte("PROXY TCP6 " + strings.Repeat("0", 100) + "::1 ::1 1 2\r\n"),
+		"v1 truncated":       []byte("PROXY TCP4 192.0.2.1"),
+		"v2 bad signature":   append([]byte("\r\n\r\n\x00\r\nQUIX\n\x21\x11\x00\x0c"), addrs4...),
+		"v2 truncated":       proxyV2Signature[:8],
+		"v2 bad version":     testProxyHeaderV2(0x11, 0x11, addrs4),
+		"v2 bad command":     testProxyHeaderV2(0x22, 0x11, addrs4),
+		"v2 short ipv4":      testProxyHeaderV2(0x21, 0x11, addrs4[:8]),
+		"v2 short ipv6":      testProxyHeaderV2(0x21, 0x21, addrs4),
+		"v2 short body":      testProxyHeaderV2(0x21, 0x11, addrs4)[:20],
+		"v2 tlv overrun":     testProxyHeaderV2(0x21, 0x11, append(append([]byte{}, addrs4...), 0x05, 0x00, 0x10, 'a', 'b')),
+		"v2 tlv truncated":   testProxyHeaderV2(0x21, 0x11, append(append([]byte{}, addrs4...), 0x05, 0x00)),
+		"v2 local tlv":       testProxyHeaderV2(0x20, 0x00, []byte{0xe0, 0x00, 0x04, 'n'}),
+	}
+	for name, header := range tests {
+		start := time.Now()
+		client, server := net.Pipe()
+		go func() {
+			client.Write(header)
+			client.Close()
+		}()
+		if _, err := acceptProxyHeader(server); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("%s: expected to fail right away, took %s", name, d)
+		}
+		server.Close()
+	}
+}
+
+func TestProxyProtocolWriteHeader(t *testing.T) {
+	pp, err := NewProxyProtocol([]string{"10.0.0.5:22,version=1", "10.0.0.0/8:*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		remote string
+		header string
+	}{
+		{"10.0.0.5:22", "PROXY TCP4 192.0.2.1 127.0.0.1 "},
+		{"10.0.0.6:22", string(proxyV2Signature)},
+		{"192.168.0.1:22", ""},
+	}
+	for _, tt := range tests {
+		client, server := newTestConnPair(t)
+		err := pp.writeHeader(client, []Endpoint{{network: networkTCP, remote: tt.remote}}, "192.0.2.1:51234", testLimitPeer, "req-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Write([]byte("data"))
+		client.Close()
+
+		b, _ := io.ReadAll(server)
+		server.Close()
+		if !bytes.HasPrefix(b, []byte(tt.header)) || !bytes.HasSuffix(b, []byte("data")) {
+			t.Errorf("%s: got %q, want a header starting with %q", tt.remote, b, tt.header)
+		}
+		if tt.header == "" && string(b) != "data" {
+			t.Errorf("%s: expected no header, got %q", tt.remote, b)
+		}
+	}
+}
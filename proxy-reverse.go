@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+
+	"github.com/xtaci/smux"
+)
+
+// handleReverseListen listens on the address requested by the egress for as long as stream stays open, and opens a
+// stream toward the egress for every accepted connection.
+func (igp *IngressProxy) handleReverseListen(session *smux.Session, stream net.Conn, h streamHeader) (err error) {
+	defer stream.Close()
+
+	if igp.reverseAuth == nil {
+		writeStreamAck(stream, streamStatusUnauthorized)
+		return fmt.Errorf("reverse: not allowed: %s", h.Listen)
+	}
+	if ok, err := authorizeEndpoint(igp.reverseAuth, igp.peerCert, Endpoint{network: networkTCP, remote: h.Listen}); !ok {
+		writeStreamAck(stream, streamStatusUnauthorized)
+		return fmt.Errorf("reverse: %w", err)
+	}
+
+	listener, err := listenStream(h.Listen, endpointOptions{socketPerm: h.ListenPerm})
+	if err != nil {
+		writeStreamAck(stream, streamStatusFailure)
+		return fmt.Errorf("listen to reverse socket failed: %w", err)
+	}
+	defer listener.Close()
+	log.Println("ingress: reverse: listening on", h.Listen)
+
+	if err = writeStreamAck(stream, streamStatusOK); err != nil {
+		return fmt.Errorf("reverse: write stream ack error: %w", err)
+	}
+
+	go func() {
+		io.Copy(io.Discard, stream)
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			log.Println("ingress: reverse: accept connection error:", err)
+			continue
+		}
+		log.Println("ingress: reverse: new connection: ", conn.RemoteAddr())
+
+		go func() {
+			if err := igp.relayReverseConn(session, conn, h); err != nil {
+				log.Println("ingress: reverse:", err)
+			}
+		}()
+	}
+}
+
+// relayReverseConn relays conn through a new stream toward the egress that asked to listen with the header lh.
+func (igp *IngressProxy) relayReverseConn(session *smux.Session, conn net.Conn, lh streamHeader) (err error) {
+	listen := lh.Listen
+
+	// the limits are checked before opening the stream, so that the egress does not dial for nothing.
+	sl, err := igp.limiter.acquire(igp.peerCert, []Endpoint{{network: networkTCP, remote: listen}})
+	if err != nil {
+		resetConn(conn)
+		return fmt.Errorf("reverse: %w: %s", err, conn.RemoteAddr())
+	}
+
+	stream, err := openStream(session, streamHeader{
+		Network:     networkReverse,
+		Listen:      listen,
+		ClientAddr:  conn.RemoteAddr().String(),
+		RequestID:   newRequestID(),
+		Compression: lh.Compression,
+	})
+	if err != nil {
+		resetConn(conn)
+		sl.release()
+		return fmt.Errorf("connect %s failed: %w", conn.RemoteAddr(), err)
+	}
+
+	if err = relay(conn, sl.wrap(stream), igp.timeouts.min(sl.timeouts)); err != nil {
+		return fmt.Errorf("relay error: %w", err)
+	}
+	return
+}
+
+// startReverseTunnel asks the ingress to listen on the local side of ep until ctx is done.
+func (egp *EgressProxy) startReverseTunnel(ctx context.Context, ep Endpoint) (err error) {
+	stream, err := openStream(egp.session, streamHeader{
+		Network:     networkReverse,
+		Listen:      ep.local,
+		ListenPerm:  ep.options.socketPerm,
+		RequestID:   newRequestID(),
+		Compression: ep.options.compress,
+	})
+	if err != nil {
+		return fmt.Errorf("reverse listen on %s failed: %w", ep.local, err)
+	}
+	defer stream.Close()
+
+	stop := closeOnDone(ctx, stream)
+	defer stop()
+
+	io.Copy(io.Discard, stream)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return fmt.Errorf("reverse listener closed by the ingress: %s", ep.local)
+}
+
+// handleReverseStream connects a stream carrying a connection accepted by a reverse listener to the target of its forward.
+// Only the target configured for the forward is dialed, so the ingress can not choose the destination.
+func (egp *EgressProxy) handleReverseStream(stream *smux.Stream, h streamHeader) (err error) {
+	t := egp.reverseTunnel(h.Listen)
+	if t == nil {
+		writeStreamAck(stream, streamStatusUnauthorized)
+		stream.Close()
+		return fmt.Errorf("reverse: unknown listener: %s", h.Listen)
+	}
+
+	conn, err := dialStream(t.ep.remote)
+	if err != nil {
+		writeStreamAck(stream, streamStatusOf(err))
+		stream.Close()
+		return fmt.Errorf("reverse: dial error: %w", err)
+	}
+	log.Println("egress: reverse: dial success:", t.ep.remote)
+
+	accepted, err := ackStream(stream, h)
+	if err != nil {
+		conn.Close()
+		stream.Close()
+		return fmt.Errorf("reverse: accept stream error: %w", err)
+	}
+
+	stop := closeOnDone(t.ctx, conn)
+	defer stop()
+
+	if err = relay(conn, accepted, egp.timeouts); err != nil {
+		return fmt.Errorf("reverse: relay error: %w", err)
+	}
+	return
+}
+
+func (egp *EgressProxy) reverseTunnel(listen string) *egressTunnel {
+	egp.mu.Lock()
+	defer egp.mu.Unlock()
+
+	for _, t := range egp.tunnels {
+		if t.ep.network == networkReverse && t.ep.local == listen {
+			return t
+		}
+	}
+	return nil
+}
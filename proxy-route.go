@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Router maps the endpoints egresses ask for to the upstreams actually dialed, depending on the peer certificate.
+type Router struct {
+	routes []route
+}
+
+type route struct {
+	peer     peerSelector
+	dest     endpointPattern
+	upstream string
+}
+
+// NewRouter parses rules, each written as '[<peer selector>@]<endpoint>-><upstream>'. The endpoint is matched like
+// an '--allow' entry, and the upstream is an address of the same network. For a given endpoint, the first rule whose
+// selector matches the peer is used, and peers matching none of its rules are denied.
+func NewRouter(rules []string) (r *Router, err error) {
+	r = &Router{}
+	for _, s := range rules {
+		rt, err := routeFromString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route: %s: %w", s, err)
+		}
+		r.routes = append(r.routes, rt)
+	}
+	return
+}
+
+func routeFromString(s string) (r route, err error) {
+	dest, upstream, ok := strings.Cut(s, "->")
+	if !ok {
+		return r, fmt.Errorf("missing '-><upstream>'")
+	}
+
+	er, err := endpointRuleFromString(strings.TrimSpace(dest))
+	if err != nil {
+		return
+	}
+	if er.deny {
+		return r, fmt.Errorf("deny entries are not supported")
+	}
+	r.peer, r.dest = er.peer, er.dest
+
+	r.upstream = strings.TrimSpace(upstream)
+	if !isUnixAddr(r.upstream) {
+		if _, _, err = net.SplitHostPort(r.upstream); err != nil {
+			return r, fmt.Errorf("invalid upstream: %s: %w", r.upstream, err)
+		}
+	}
+	return
+}
+
+// route returns the upstream of ep for the peer presenting cert, reporting false when ep is not routed. ep is denied
+// when it is routed for other peers only.
+func (r *Router) route(cert *AetherportCertificate, ep Endpoint) (upstream Endpoint, ok bool, err error) {
+	if r == nil {
+		return ep, false, nil
+	}
+
+	routed := false
+	for _, rt := range r.routes {
+		if !rt.dest.match(ep) {
+			continue
+		}
+		if rt.peer.match(cert) {
+			return Endpoint{network: ep.network, remote: rt.upstream}, true, nil
+		}
+		routed = true
+	}
+	if routed {
+		return ep, false, fmt.Errorf("%w: %s is not routed for %s", errUnallowedEndpoint, ep.remoteString(), peerName(cert))
+	}
+	return ep, false, nil
+}
+
+// authorize checks ep against the authorizer and the routes of the ingress, returning the endpoint to dial for it.
+func (igp *IngressProxy) authorize(ep Endpoint) (dial Endpoint, err error) {
+	if _, err = authorizeEndpoint(igp.epAuth, igp.peerCert, ep); err != nil {
+		return
+	}
+	dial, _, err = igp.router.route(igp.peerCert, ep)
+	return
+}
+
+// dial connects to the upstream of ep after authorizing it. A routed upstream is dialed as configured, while any
+// other endpoint has every address it resolves to authorized as well.
+func (igp *IngressProxy) dial(ctx context.Context, ep Endpoint) (conn net.Conn, upstream Endpoint, err error) {
+	upstream, routed, err := igp.router.route(igp.peerCert, ep)
+	if err != nil {
+		return nil, ep, err
+	}
+	if !routed {
+		conn, err = dialAuthorized(ctx, igp.epAuth, igp.peerCert, ep)
+		return conn, ep, err
+	}
+
+	if _, err = authorizeEndpoint(igp.epAuth, igp.peerCert, ep); err != nil {
+		return nil, ep, err
+	}
+	conn, err = dialAuthorized(ctx, nil, igp.peerCert, upstream)
+	return conn, upstream, err
+}
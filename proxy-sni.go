@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sniRulePrefix = "sni:"
+
+	clientHelloTimeout = 10 * time.Second
+)
+
+// SNIRouter picks the upstream of a TLS connection from the server name of its ClientHello.
+type SNIRouter struct {
+	allows []sniRoute
+	denies []sniRoute
+
+	// auth must also allow the upstreams, so that the deny rules and external authorization apply to them.
+	auth EndpointAuthorizer
+}
+
+type sniRoute struct {
+	peer   peerSelector
+	name   hostMatcher
+	target endpointPattern
+	fixed  string // the upstream when target names a single one, otherwise the server name is dialed
+	port   int
+}
+
+// isSNIRule reports whether the '--allow' entry s, written as '[!][<peer selector>@]sni:<server name>-><endpoint>',
+// routes TLS connections by server name instead of allowing an endpoint.
+func isSNIRule(s string) bool {
+	s = strings.TrimPrefix(s, "!")
+	if i := strings.Index(s, "@"); i >= 0 && !strings.Contains(s[:i], ":") {
+		s = s[i+1:]
+	}
+	return strings.HasPrefix(s, sniRulePrefix)
+}
+
+// NewSNIRouter parses rules, each written as '[!][<peer selector>@]sni:<server name>-><endpoint>'. The server name is
+// a hostname, '*.<domain>', or '*'. When the endpoint is a single address, it is the upstream of every matching
+// connection; otherwise the server name itself is dialed on the endpoint's port, and must resolve to an address
+// matching the endpoint. Entries starting with '!' deny the server names, taking precedence over every allowing entry.
+// The upstreams, and the addresses they resolve to, must also be allowed by auth, unless it is nil.
+func NewSNIRouter(rules []string, auth EndpointAuthorizer) (r *SNIRouter, err error) {
+	r = &SNIRouter{auth: auth}
+	for _, s := range rules {
+		deny, route, err := sniRouteFromString(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sni rule: %s: %w", s, err)
+		}
+		if deny {
+			r.denies = append(r.denies, route)
+		} else {
+			r.allows = append(r.allows, route)
+		}
+	}
+	return
+}
+
+func sniRouteFromString(s string) (deny bool, r sniRoute, err error) {
+	if strings.HasPrefix(s, "!") {
+		deny, s = true, s[1:]
+	}
+	if i := strings.Index(s, "@"); i >= 0 && !strings.Contains(s[:i], ":") {
+		if r.peer, err = peerSelectorFromString(s[:i]); err != nil {
+			return
+		}
+		s = s[i+1:]
+	}
+
+	name, target, hasTarget := strings.Cut(strings.TrimPrefix(s, sniRulePrefix), "->")
+	if r.name, err = hostMatcherFromString(strings.TrimSpace(name)); err != nil {
+		return
+	}
+	if r.name.ipnet != nil {
+		return deny, r, fmt.Errorf("server name must be a hostname: %s", name)
+	}
+	if deny {
+		return
+	}
+
+	if !hasTarget {
+		return deny, r, fmt.Errorf("missing '-><endpoint>'")
+	}
+	target = strings.TrimSpace(target)
+	if r.target, err = endpointPatternFromString(target); err != nil {
+		return
+	}
+	if r.target.any || r.target.network != networkTCP || r.target.unix != "" {
+		return deny, r, fmt.Errorf("endpoint must be '<host>:<port>': %s", target)
+	}
+	if r.target.portLo != r.target.portHi {
+		return deny, r, fmt.Errorf("endpoint must have a single port: %s", target)
+	}
+	r.port = r.target.portLo
+
+	h := r.target.host
+	ones, bits := 0, -1
+	if h.ipnet != nil {
+		ones, bits = h.ipnet.Mask.Size()
+	}
+	if h.name != "" || ones == bits {
+		r.fixed = target
+	}
+	return
+}
+
+// route returns the upstream of a connection with serverName from the peer presenting cert, along with the
+// authorizer its resolved addresses must pass.
+func (sr *SNIRouter) route(cert *AetherportCertificate, serverName string) (dest string, auth EndpointAuthorizer, err error) {
+	ep := Endpoint{network: networkSNI, remote: serverName}
+	if sr == nil || serverName == "" {
+		return "", nil, fmt.Errorf("%w: %s for %s", errUnallowedEndpoint, ep.remoteString(), peerName(cert))
+	}
+
+	for _, r := range sr.denies {
+		if r.peer.match(cert) && r.name.match(serverName) {
+			return "", nil, fmt.Errorf("%w: %s for %s", errUnallowedEndpoint, ep.remoteString(), peerName(cert))
+		}
+	}
+	for _, r := range sr.allows {
+		if !r.peer.match(cert) || !r.name.match(serverName) {
+			continue
+		}
+
+		dest = r.fixed
+		if dest == "" {
+			dest = net.JoinHostPort(serverName, strconv.Itoa(r.port))
+		}
+		return dest, allOfAuthorizers(r.authorize, sr.auth), nil
+	}
+	return "", nil, fmt.Errorf("%w: %s for %s", errUnallowedEndpoint, ep.remoteString(), peerName(cert))
+}
+
+// authorize allows the upstream chosen by the route. A hostname is let through until it is resolved, so the addresses
+// it resolves to are the ones checked against the target.
+func (r sniRoute) authorize(_ *AetherportCertificate, ep Endpoint) (bool, error) {
+	host, _, err := net.SplitHostPort(ep.remote)
+	if err == nil && ep.resolvedHost == "" && net.ParseIP(host) == nil {
+		return true, nil
+	}
+	for _, e := range authorizedForms(ep) {
+		if r.target.match(e) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// errClientHelloRead stops the handshake used to parse a ClientHello once it has been read.
+var errClientHelloRead = errors.New("client hello read")
+
+// readClientHello reads the TLS ClientHello from conn without answering it, returning every byte read so they can be
+// replayed to the upstream, along with the server name it asks for.
+func readClientHello(conn net.Conn) (raw []byte, serverName string, err error) {
+	conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var buf bytes.Buffer
+	var read bool
+	err = tls.Server(helloConn{r: io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(chi *tls.ClientHelloInfo) (*tls.Config, error) {
+			read, serverName = true, chi.ServerName
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	if !read {
+		return nil, "", fmt.Errorf("read tls client hello failed: %w", err)
+	}
+	return buf.Bytes(), normalizeHostname(serverName), nil
+}
+
+// helloConn is a read-only net.Conn for parsing a ClientHello, discarding whatever the TLS server tries to answer.
+type helloConn struct {
+	r io.Reader
+}
+
+func (c helloConn) Read(b []byte) (int, error)         { return c.r.Read(b) }
+func (c helloConn) Write(b []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c helloConn) Close() error                       { return nil }
+func (c helloConn) LocalAddr() net.Addr                { return nil }
+func (c helloConn) RemoteAddr() net.Addr               { return nil }
+func (c helloConn) SetDeadline(t time.Time) error      { return nil }
+func (c helloConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c helloConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// handleSNIConn sends the ClientHello of conn along with a new stream, leaving the choice of the upstream to the ingress.
+func (egp *EgressProxy) handleSNIConn(conn net.Conn, ep Endpoint) (err error) {
+	hello, serverName, err := readClientHello(conn)
+	if err != nil {
+		resetConn(conn)
+		return err
+	}
+
+	stream, err := egp.openStreamWithData(ep, streamHeader{
+		Network:     networkSNI,
+		ClientAddr:  conn.RemoteAddr().String(),
+		RequestID:   newRequestID(),
+		Compression: ep.options.compress,
+	}, hello)
+	if err != nil {
+		resetConn(conn)
+		return fmt.Errorf("connect to %s failed: %w", Endpoint{network: networkSNI, remote: serverName}.remoteString(), err)
+	}
+
+	if err = relay(conn, stream, egp.timeouts); err != nil {
+		return fmt.Errorf("relay error: %w", err)
+	}
+	return
+}
+
+// handleSNIStream connects stream to the upstream routed from the server name of the ClientHello it starts with.
+func (igp *IngressProxy) handleSNIStream(ctx context.Context, stream net.Conn, h streamHeader) (err error) {
+	hello, serverName, err := readClientHello(stream)
+	if err != nil {
+		writeStreamAck(stream, streamStatusFailure)
+		stream.Close()
+		return fmt.Errorf("%w: request %s from %s", err, h.RequestID, h.ClientAddr)
+	}
+
+	dest, auth, err := igp.sniRouter.route(igp.peerCert, serverName)
+	if err != nil {
+		writeStreamAck(stream, streamStatusOf(err))
+		stream.Close()
+		return fmt.Errorf("%w: request %s from %s", err, h.RequestID, h.ClientAddr)
+	}
+
+	sl, err := igp.limiter.acquire(igp.peerCert, []Endpoint{{network: networkTCP, remote: dest}})
+	if err != nil {
+		writeStreamAck(stream, streamStatusOf(err))
+		stream.Close()
+		return fmt.Errorf("%w: sni %s request %s from %s", err, serverName, h.RequestID, h.ClientAddr)
+	}
+	conn, err := dialAuthorized(ctx, auth, igp.peerCert, Endpoint{network: networkTCP, remote: dest})
+	if err != nil {
+		writeStreamAck(stream, streamStatusOf(err))
+		stream.Close()
+		sl.release()
+		return fmt.Errorf("dial error: %w: sni %s request %s from %s", err, serverName, h.RequestID, h.ClientAddr)
+	}
+	log.Println("ingress: dial success: sni", serverName, conn.RemoteAddr(), "request", h.RequestID, "from", h.ClientAddr)
+
+	eps := []Endpoint{{network: networkTCP, remote: dest}, {network: networkTCP, remote: conn.RemoteAddr().String()}}
+	if err = igp.limiter.extend(sl, igp.peerCert, eps); err != nil {
+		writeStreamAck(stream, streamStatusOf(err))
+		conn.Close()
+		stream.Close()
+		sl.release()
+		return fmt.Errorf("%w: sni %s request %s from %s", err, serverName, h.RequestID, h.ClientAddr)
+	}
+	if err = igp.proxyProtocol.writeHeader(conn, eps, h.ClientAddr, igp.peerCert, h.RequestID); err != nil {
+		writeStreamAck(stream, streamStatusFailure)
+		conn.Close()
+		stream.Close()
+		sl.release()
+		return err
+	}
+
+	accepted, err := ackStream(stream, h)
+	if err != nil {
+		conn.Close()
+		stream.Close()
+		sl.release()
+		return fmt.Errorf("accept stream error: %w", err)
+	}
+	limited := sl.wrap(accepted)
+	if _, err = conn.Write(hello); err != nil {
+		conn.Close()
+		limited.Close()
+		return fmt.Errorf("write tls client hello error: %w", err)
+	}
+
+	if err = relay(conn, limited, igp.timeouts.min(sl.timeouts)); err != nil {
+		return fmt.Errorf("relay error: %w", err)
+	}
+	return
+}
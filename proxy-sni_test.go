@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// recordingConn records everything written to it.
+type recordingConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.written.Write(b)
+	return c.Conn.Write(b)
+}
+
+func newTestTLSCertificate(t *testing.T, name string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestReadClientHelloReplay(t *testing.T) {
+	client, server := newTestConnPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	rc := &recordingConn{Conn: client}
+	tc := tls.Client(rc, &tls.Config{ServerName: "API.example.com.", InsecureSkipVerify: true})
+	handshaked := make(chan error, 1)
+	go func() {
+		err := tc.Handshake()
+		if err == nil {
+			_, err = tc.Write([]byte("ping"))
+		}
+		handshaked <- err
+	}()
+
+	raw, serverName, err := readClientHello(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverName != "api.example.com" {
+		t.Fatalf("expected the normalized server name, got %q", serverName)
+	}
+	if !bytes.Equal(raw, rc.written.Bytes()) {
+		t.Fatalf("expected the %d bytes written by the client, got %d", rc.written.Len(), len(raw))
+	}
+
+	// an upstream given the replayed bytes completes the handshake as if it had read them itself.
+	upstream := tls.Server(bufferedConn{Conn: server, r: bufio.NewReader(io.MultiReader(bytes.NewReader(raw), server))}, &tls.Config{
+		Certificates: []tls.Certificate{newTestTLSCertificate(t, "api.example.com")},
+	})
+	got := make([]byte, 4)
+	if _, err = io.ReadFull(upstream, got); err != nil || string(got) != "ping" {
+		t.Fatalf("expected the upstream to read the client data, got %q: %v", got, err)
+	}
+	if err = <-handshaked; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadClientHelloMissingServerName(t *testing.T) {
+	client, server := newTestConnPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	go tls.Client(client, &tls.Config{InsecureSkipVerify: true}).Handshake()
+	_, serverName, err := readClientHello(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverName != "" {
+		t.Fatalf("expected no server name, got %q", serverName)
+	}
+
+	r, err := NewSNIRouter([]string{"sni:*->10.0.0.0/8:443"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = r.route(testLimitPeer, serverName); !errors.Is(err, errUnallowedEndpoint) {
+		t.Fatalf("expected a connection without server name to be denied, got %v", err)
+	}
+}
+
+func TestReadClientHelloInvalid(t *testing.T) {
+	header := func(typ byte, length int) []byte {
+		b := []byte{typ, 3, 1, 0, 0}
+		binary.BigEndian.PutUint16(b[3:], uint16(length))
+		return b
+	}
+	tests := map[string][]byte{
+		"not tls":        []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"),
+		"empty":          nil,
+		"short header":   {22, 3, 1},
+		"truncated":      append(header(22, 512), make([]byte, 100)...),
+		"oversized":      append(header(22, 0xffff), make([]byte, 1024)...),
+		"not handshake":  append(header(23, 16), make([]byte, 16)...),
+		"garbage record": append(header(22, 16), bytes.Repeat([]byte{0xff}, 16)...),
+	}
+	for name, data := range tests {
+		client, server := newTestConnPair(t)
+		client.Write(data)
+		// incomplete data is followed by the end of the connection, while the other clients stay open, so that only
+		// parsing what was sent can end the read before the timeout.
+		if name == "empty" || name == "short header" || name == "truncated" {
+			client.Close()
+		}
+
+		start := time.Now()
+		if _, _, err := readClientHello(server); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("%s: expected to fail right away, took %s", name, d)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestSNIRouter(t *testing.T) {
+	tests := []struct {
+		rules      []string
+		serverName string
+		dest       string
+	}{
+		{[]string{"sni:db.example.com->10.0.0.5:5432"}, "db.example.com", "10.0.0.5:5432"},
+		{[]string{"sni:*.example.com->10.0.0.0/8:443"}, "api.example.com", "api.example.com:443"},
+		{[]string{"sni:*.example.com->10.0.0.0/8:443"}, "example.com", ""},
+		{[]string{"sni:*.example.com->10.0.0.0/8:443"}, "api.example.org", ""},
+		{[]string{"sni:*->10.0.0.0/8:443", "!sni:admin.example.com"}, "admin.example.com", ""},
+		{[]string{"name=other@sni:*->10.0.0.0/8:443"}, "api.example.com", ""},
+		{[]string{"name=node@sni:*->10.0.0.0/8:443"}, "api.example.com", "api.example.com:443"},
+	}
+	for _, tt := range tests {
+		r, err := NewSNIRouter(tt.rules, nil)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.rules, err)
+		}
+		dest, _, err := r.route(testLimitPeer, tt.serverName)
+		if tt.dest == "" {
+			if !errors.Is(err, errUnallowedEndpoint) {
+				t.Errorf("%v, %s: expected to be denied, got %s, %v", tt.rules, tt.serverName, dest, err)
+			}
+			continue
+		}
+		if err != nil || dest != tt.dest {
+			t.Errorf("%v, %s: got %s, %v, want %s", tt.rules, tt.serverName, dest, err, tt.dest)
+		}
+	}
+}
+
+func TestSNIRouterAuthorizesUpstream(t *testing.T) {
+	auth, err := NewBasicEndpointAuthorizer([]string{"*", "!10.0.0.9:443"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewSNIRouter([]string{"sni:blocked.example.com->10.0.0.9:443", "sni:*->10.0.0.0/8:443"}, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, routeAuth, err := r.route(testLimitPeer, "api.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ep    Endpoint
+		allow bool
+	}{
+		{Endpoint{network: networkTCP, remote: "10.1.2.3:443", resolvedHost: "api.example.com"}, true},
+		{Endpoint{network: networkTCP, remote: "127.0.0.1:443", resolvedHost: "api.example.com"}, false},
+		{Endpoint{network: networkTCP, remote: "169.254.169.254:443", resolvedHost: "api.example.com"}, false},
+		{Endpoint{network: networkTCP, remote: "10.1.2.3:8443", resolvedHost: "api.example.com"}, false},
+		{Endpoint{network: networkTCP, remote: "10.0.0.9:443", resolvedHost: "api.example.com"}, false},
+	}
+	for _, tt := range tests {
+		if ok, _ := routeAuth(testLimitPeer, tt.ep); ok != tt.allow {
+			t.Errorf("%s resolved from %s: got %v, want %v", tt.ep.remote, tt.ep.resolvedHost, ok, tt.allow)
+		}
+	}
+
+	// a fixed upstream is denied too, when the deny entries of '--allow' cover it.
+	dest, routeAuth, err := r.route(testLimitPeer, "blocked.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := routeAuth(testLimitPeer, Endpoint{network: networkTCP, remote: dest}); ok {
+		t.Fatalf("expected %s to be denied", dest)
+	}
+}
+
+func TestSNIRouterDialsWithinTarget(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	r, err := NewSNIRouter([]string{"sni:*->10.0.0.0/8:" + port}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// localhost resolves outside of the target, so it is not dialed even though the server name matches.
+	dest, auth, err := r.route(testLimitPeer, "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialAuthorized(context.Background(), auth, testLimitPeer, Endpoint{network: networkTCP, remote: dest})
+	if err == nil {
+		conn.Close()
+		t.Fatalf("expected %s not to be dialed", dest)
+	}
+	if !errors.Is(err, errUnallowedEndpoint) {
+		t.Fatalf("expected the resolved address to be unallowed, got %v", err)
+	}
+}
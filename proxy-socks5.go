@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone         = 0x00
+	socks5AuthNoAcceptable = 0xff
+
+	socks5CmdConnect = 0x01
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks5RepSucceeded           = 0x00
+	socks5RepGeneralFailure      = 0x01
+	socks5RepNotAllowed          = 0x02
+	socks5RepHostUnreachable     = 0x04
+	socks5RepConnectionRefused   = 0x05
+	socks5RepTTLExpired          = 0x06
+	socks5RepCommandNotSupported = 0x07
+	socks5RepAtypNotSupported    = 0x08
+)
+
+// socks5Handshake negotiates a no-authentication SOCKS5 session and reads a CONNECT request, returning the requested address.
+func socks5Handshake(rw io.ReadWriter) (addr string, err error) {
+	b := make([]byte, 2)
+	if _, err = io.ReadFull(rw, b); err != nil {
+		return "", fmt.Errorf("read greeting failed: %w", err)
+	}
+	if b[0] != socks5Version {
+		return "", fmt.Errorf("unsupported socks version: %d", b[0])
+	}
+	methods := make([]byte, b[1])
+	if _, err = io.ReadFull(rw, methods); err != nil {
+		return "", fmt.Errorf("read authentication methods failed: %w", err)
+	}
+	if !bytes.Contains(methods, []byte{socks5AuthNone}) {
+		rw.Write([]byte{socks5Version, socks5AuthNoAcceptable})
+		return "", fmt.Errorf("no acceptable authentication method")
+	}
+	if _, err = rw.Write([]byte{socks5Version, socks5AuthNone}); err != nil {
+		return "", fmt.Errorf("write method selection failed: %w", err)
+	}
+
+	h := make([]byte, 4)
+	if _, err = io.ReadFull(rw, h); err != nil {
+		return "", fmt.Errorf("read request failed: %w", err)
+	}
+	if h[0] != socks5Version {
+		return "", fmt.Errorf("unsupported socks version: %d", h[0])
+	}
+	if h[1] != socks5CmdConnect {
+		socks5Reply(rw, socks5RepCommandNotSupported)
+		return "", fmt.Errorf("unsupported socks command: %d", h[1])
+	}
+
+	var host string
+	switch h[3] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if h[3] == socks5AtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err = io.ReadFull(rw, ip); err != nil {
+			return "", fmt.Errorf("read ip address failed: %w", err)
+		}
+		host = ip.String()
+
+	case socks5AtypDomain:
+		l := make([]byte, 1)
+		if _, err = io.ReadFull(rw, l); err != nil {
+			return "", fmt.Errorf("read domain length failed: %w", err)
+		}
+		d := make([]byte, l[0])
+		if _, err = io.ReadFull(rw, d); err != nil {
+			return "", fmt.Errorf("read domain failed: %w", err)
+		}
+		host = string(d)
+
+	default:
+		socks5Reply(rw, socks5RepAtypNotSupported)
+		return "", fmt.Errorf("unsupported socks address type: %d", h[3])
+	}
+
+	p := make([]byte, 2)
+	if _, err = io.ReadFull(rw, p); err != nil {
+		return "", fmt.Errorf("read port failed: %w", err)
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(p)))), nil
+}
+
+func socks5Reply(w io.Writer, rep byte) (err error) {
+	_, err = w.Write([]byte{socks5Version, rep, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+	return
+}
+
+// socks5ReplyOf maps the failure of a stream to the closest SOCKS5 reply.
+func socks5ReplyOf(err error) byte {
+	switch streamErrorStatus(err) {
+	case streamStatusUnauthorized:
+		return socks5RepNotAllowed
+	case streamStatusRefused:
+		return socks5RepConnectionRefused
+	case streamStatusTimeout:
+		return socks5RepTTLExpired
+	case streamStatusDNSFailure, streamStatusUnreachable:
+		return socks5RepHostUnreachable
+	}
+	return socks5RepGeneralFailure
+}
+
+func (egp *EgressProxy) handleSOCKS5Conn(conn net.Conn, ep Endpoint) (err error) {
+	dest, err := socks5Handshake(conn)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("socks5 handshake error: %w", err)
+	}
+
+	stream, err := egp.openStream(ep, dest, conn.RemoteAddr().String())
+	if err != nil {
+		socks5Reply(conn, socks5ReplyOf(err))
+		conn.Close()
+		return err
+	}
+	socks5Reply(conn, socks5RepSucceeded)
+
+	if err = relay(conn, stream, egp.timeouts); err != nil {
+		return fmt.Errorf("relay error: %w", err)
+	}
+	return
+}
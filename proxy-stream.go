@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// muxLabel is the label of the data channel carrying the smux session shared by every stream based endpoint.
+const muxLabel = "aetherport"
+
+// muxConfig returns the configuration of the smux session of a peer connection that may stay disconnected for grace
+// before being given up, keeping the session alive for that long without keepalives.
+func muxConfig(grace time.Duration) *smux.Config {
+	cfg := smux.DefaultConfig()
+	cfg.KeepAliveTimeout += grace
+	return cfg
+}
+
+const streamHeaderVersion = 1
+
+// streamHeader is written by the opener of a stream before any payload, telling the peer what to do with the stream.
+type streamHeader struct {
+	// Network is tcp to connect the stream to Destination. With reverse, a stream from the egress asks the ingress to
+	// listen on Listen for as long as the stream stays open, and a stream from the ingress carries a connection accepted there.
+	// With sni, the stream starts with a TLS ClientHello whose server name the ingress routes by.
+	Network     string      `json:"network"`
+	Destination string      `json:"destination,omitempty"`
+	Listen      string      `json:"listen,omitempty"`
+	ListenPerm  os.FileMode `json:"listen_perm,omitempty"`
+
+	ClientAddr string `json:"client_addr,omitempty"`
+	RequestID  string `json:"request_id,omitempty"`
+
+	// Compression asks the receiver to compress the rest of the stream with the given algorithm, which it agrees to
+	// by acknowledging the stream with streamStatusCompressed. With reverse, it applies to the streams from the ingress.
+	Compression string `json:"compression,omitempty"`
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	io.ReadFull(rand.Reader, b)
+	return hex.EncodeToString(b)
+}
+
+// writeStreamHeader writes h as a version byte followed by a big endian uint16 length and the JSON encoded header.
+func writeStreamHeader(w io.Writer, h streamHeader) (err error) {
+	j, err := json.Marshal(h)
+	if err != nil {
+		return fmt.Errorf("marshal stream header failed: %w", err)
+	}
+	if len(j) > math.MaxUint16 {
+		return fmt.Errorf("stream header too long: %d bytes", len(j))
+	}
+
+	b := make([]byte, 3, 3+len(j))
+	b[0] = streamHeaderVersion
+	binary.BigEndian.PutUint16(b[1:], uint16(len(j)))
+	_, err = w.Write(append(b, j...))
+	return
+}
+
+// openStream opens a stream on session, writes h, and waits for the peer to acknowledge it. The stream is compressed
+// when the peer agreed to.
+func openStream(session *smux.Session, h streamHeader) (conn net.Conn, err error) {
+	return openStreamWithData(session, h, nil)
+}
+
+// openStreamWithData is openStream also writing data before waiting, for peers that need it to act on the header.
+func openStreamWithData(session *smux.Session, h streamHeader, data []byte) (conn net.Conn, err error) {
+	stream, err := session.OpenStream()
+	if err != nil {
+		return nil, fmt.Errorf("open stream error: %w", err)
+	}
+	return startStream(stream, h, data)
+}
+
+// startStream writes h and data to stream, then waits for the peer to acknowledge it. stream is closed on failure.
+func startStream(stream net.Conn, h streamHeader, data []byte) (conn net.Conn, err error) {
+	if err = writeStreamHeader(stream, h); err != nil {
+		stream.Close()
+		return nil, fmt.Errorf("write stream header error: %w", err)
+	}
+	if _, err = stream.Write(data); err != nil {
+		stream.Close()
+		return nil, fmt.Errorf("write stream data error: %w", err)
+	}
+	s, err := readStreamAck(stream)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+	if s != streamStatusCompressed {
+		return stream, nil
+	}
+
+	if conn, err = newCompressedConn(stream, h.Compression); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return
+}
+
+// streamHeaderTimeout is how long the opener of a stream has to write its header.
+const streamHeaderTimeout = 10 * time.Second
+
+// readStreamHeader reads the header of stream, failing when it is not written within streamHeaderTimeout.
+func readStreamHeader(stream net.Conn) (h streamHeader, err error) {
+	stream.SetReadDeadline(time.Now().Add(streamHeaderTimeout))
+	defer stream.SetReadDeadline(time.Time{})
+
+	b := make([]byte, 3)
+	if _, err = io.ReadFull(stream, b); err != nil {
+		return h, fmt.Errorf("read stream header failed: %w", err)
+	}
+	if b[0] != streamHeaderVersion {
+		return h, fmt.Errorf("unsupported stream header version: %d", b[0])
+	}
+
+	j := make([]byte, binary.BigEndian.Uint16(b[1:]))
+	if _, err = io.ReadFull(stream, j); err != nil {
+		return h, fmt.Errorf("read stream header failed: %w", err)
+	}
+	if err = json.Unmarshal(j, &h); err != nil {
+		return h, fmt.Errorf("unmarshal stream header failed: %w", err)
+	}
+	return
+}
+
+// streamStatus is the single byte the receiver of a stream writes after its header, once it has acted on it.
+type streamStatus byte
+
+const (
+	streamStatusOK streamStatus = iota
+	streamStatusFailure
+	streamStatusUnauthorized
+	streamStatusRefused
+	streamStatusTimeout
+	streamStatusDNSFailure
+	streamStatusUnreachable
+	streamStatusQuotaExceeded
+	streamStatusTooManyStreams
+
+	// streamStatusCompressed accepts the stream like streamStatusOK, with the rest of it compressed as its header asked.
+	streamStatusCompressed
+)
+
+// streamError is the failure reported by the receiver of a stream.
+type streamError struct {
+	status streamStatus
+}
+
+func (e *streamError) Error() string {
+	switch e.status {
+	case streamStatusUnauthorized:
+		return "stream rejected: unauthorized"
+	case streamStatusRefused:
+		return "stream rejected: connection refused"
+	case streamStatusTimeout:
+		return "stream rejected: timeout"
+	case streamStatusDNSFailure:
+		return "stream rejected: dns failure"
+	case streamStatusUnreachable:
+		return "stream rejected: unreachable"
+	case streamStatusQuotaExceeded:
+		return "stream rejected: quota exceeded"
+	case streamStatusTooManyStreams:
+		return "stream rejected: too many streams"
+	}
+	return "stream rejected: failure"
+}
+
+// streamStatusOf classifies an authorization or dial error.
+func streamStatusOf(err error) streamStatus {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return streamStatusOK
+	case errors.Is(err, errUnallowedEndpoint):
+		return streamStatusUnauthorized
+	case errors.Is(err, errQuotaExceeded):
+		return streamStatusQuotaExceeded
+	case errors.Is(err, errTooManyStreams):
+		return streamStatusTooManyStreams
+	case errors.As(err, &dnsErr):
+		return streamStatusDNSFailure
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ENOENT):
+		return streamStatusRefused
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return streamStatusUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return streamStatusTimeout
+	}
+	return streamStatusFailure
+}
+
+func writeStreamAck(w io.Writer, s streamStatus) (err error) {
+	_, err = w.Write([]byte{byte(s)})
+	return
+}
+
+// ackStream accepts stream, returning it compressed when its header h asks for a known algorithm.
+func ackStream(stream net.Conn, h streamHeader) (conn net.Conn, err error) {
+	if h.Compression != compressionZstd && h.Compression != compressionSnappy {
+		return stream, writeStreamAck(stream, streamStatusOK)
+	}
+
+	if err = writeStreamAck(stream, streamStatusCompressed); err != nil {
+		return
+	}
+	cc, err := newCompressedConn(stream, h.Compression)
+	if err != nil {
+		return nil, err
+	}
+	return cc, nil
+}
+
+// readStreamAck waits for the receiver of a stream to act on its header, returning a *streamError when it failed.
+func readStreamAck(r io.Reader) (s streamStatus, err error) {
+	b := make([]byte, 1)
+	if _, err = io.ReadFull(r, b); err != nil {
+		return s, fmt.Errorf("read stream ack failed: %w", err)
+	}
+	if s = streamStatus(b[0]); s != streamStatusOK && s != streamStatusCompressed {
+		return s, &streamError{status: s}
+	}
+	return
+}
+
+// streamErrorStatus returns the status carried by err, or streamStatusFailure when it is not a *streamError.
+func streamErrorStatus(err error) streamStatus {
+	var serr *streamError
+	if errors.As(err, &serr) {
+		return serr.status
+	}
+	return streamStatusFailure
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/datachannel"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	udpHeaderLen = 4
+
+	// udpMaxMessage is the largest message pion sends on a data channel, as it assumes the peer accepts no more.
+	udpMaxMessage = 64 * 1024
+
+	// udpMaxDatagram is the largest datagram carried along with its header. Larger ones are dropped.
+	udpMaxDatagram = udpMaxMessage - udpHeaderLen
+
+	// udpMaxPending is how many datagrams of a new flow are kept while its remote endpoint is dialed. Later ones are
+	// dropped.
+	udpMaxPending = 16
+
+	udpDefaultIdleTime = time.Minute
+)
+
+// udpDataChannelInit returns options for a data channel that behaves like UDP: unordered and without retransmission.
+func udpDataChannelInit() *webrtc.DataChannelInit {
+	ordered, retransmits := false, uint16(0)
+	return &webrtc.DataChannelInit{
+		Ordered:        &ordered,
+		MaxRetransmits: &retransmits,
+	}
+}
+
+// udpPack prefixes payload with the flow ID. b must have udpHeaderLen bytes reserved before the payload.
+func udpPack(b []byte, id uint32) []byte {
+	binary.BigEndian.PutUint32(b, id)
+	return b
+}
+
+func udpUnpack(b []byte) (id uint32, payload []byte, err error) {
+	if len(b) < udpHeaderLen {
+		return 0, nil, fmt.Errorf("datagram too short: %d bytes", len(b))
+	}
+	return binary.BigEndian.Uint32(b), b[udpHeaderLen:], nil
+}
+
+type udpFlow struct {
+	id       uint32
+	addr     net.Addr // egress: address of the local client
+	lastSeen int64
+
+	mu      sync.Mutex
+	conn    net.Conn     // ingress: socket connected to the remote endpoint, nil while it is dialed
+	pending [][]byte     // ingress: datagrams received while dialing
+	limit   *streamLimit // ingress: limits the flow is counted against like a stream, released once it is removed
+	refused bool         // ingress: rejected by the limits, dropping its datagrams until it expires
+}
+
+func (f *udpFlow) touch() {
+	atomic.StoreInt64(&f.lastSeen, time.Now().UnixNano())
+}
+
+func (f *udpFlow) idleSince(t time.Time) time.Duration {
+	return t.Sub(time.Unix(0, atomic.LoadInt64(&f.lastSeen)))
+}
+
+// udpFlows tracks datagram flows on one side of a UDP tunnel and expires the idle ones.
+type udpFlows struct {
+	mu     sync.Mutex
+	byID   map[uint32]*udpFlow
+	byAddr map[string]*udpFlow
+	nextID uint32
+	idle   time.Duration
+}
+
+func newUDPFlows(idle time.Duration) *udpFlows {
+	if idle <= 0 {
+		idle = udpDefaultIdleTime
+	}
+	return &udpFlows{
+		byID:   map[uint32]*udpFlow{},
+		byAddr: map[string]*udpFlow{},
+		idle:   idle,
+	}
+}
+
+func (fs *udpFlows) get(id uint32) *udpFlow {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.byID[id]
+}
+
+func (fs *udpFlows) getOrCreateByAddr(addr net.Addr) (f *udpFlow, created bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if f, ok := fs.byAddr[addr.String()]; ok {
+		return f, false
+	}
+
+	fs.nextID++
+	f = &udpFlow{id: fs.nextID, addr: addr}
+	f.touch()
+	fs.byID[f.id] = f
+	fs.byAddr[addr.String()] = f
+	return f, true
+}
+
+// getOrAdd returns the flow with id, adding one waiting for its socket when there is none.
+func (fs *udpFlows) getOrAdd(id uint32) (f *udpFlow, added bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if f, ok := fs.byID[id]; ok {
+		return f, false
+	}
+	f = &udpFlow{id: id}
+	f.touch()
+	fs.byID[id] = f
+	return f, true
+}
+
+// connect gives f its socket and the limits it is counted against, then writes the datagrams received meanwhile,
+// reporting false when f was removed while dialing.
+func (fs *udpFlows) connect(f *udpFlow, conn net.Conn, sl *streamLimit) bool {
+	fs.mu.Lock()
+	if fs.byID[f.id] != f {
+		fs.mu.Unlock()
+		return false
+	}
+	f.mu.Lock()
+	pending := f.pending
+	f.conn, f.pending, f.limit = conn, nil, sl
+	f.mu.Unlock()
+	fs.mu.Unlock()
+
+	for _, p := range pending {
+		if _, err := conn.Write(p); err != nil {
+			log.Println("ingress: udp: write to remote error:", err)
+		}
+	}
+	return true
+}
+
+func (fs *udpFlows) remove(f *udpFlow) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.byID[f.id] == f {
+		delete(fs.byID, f.id)
+	}
+	if f.addr != nil && fs.byAddr[f.addr.String()] == f {
+		delete(fs.byAddr, f.addr.String())
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conn != nil {
+		f.conn.Close()
+	}
+	if f.limit != nil {
+		f.limit.release()
+	}
+}
+
+// refuse drops the datagrams of f until it expires, so that its client is not dialed again for every datagram.
+func (fs *udpFlows) refuse(f *udpFlow) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.refused, f.pending = true, nil
+}
+
+// write sends payload to the remote endpoint of f, or keeps a copy until it is dialed. It reports false when f was
+// refused, dropping payload.
+func (f *udpFlow) write(payload []byte) bool {
+	f.mu.Lock()
+	conn := f.conn
+	if f.refused {
+		f.mu.Unlock()
+		return false
+	}
+	if conn == nil {
+		if len(f.pending) < udpMaxPending {
+			f.pending = append(f.pending, append([]byte{}, payload...))
+		}
+		f.mu.Unlock()
+		return true
+	}
+	f.mu.Unlock()
+
+	if _, err := conn.Write(payload); err != nil {
+		log.Println("ingress: udp: write to remote error:", err)
+		if errors.Is(err, errQuotaExceeded) {
+			// stops the relay of the flow, which then removes it.
+			conn.Close()
+		}
+	}
+	return true
+}
+
+func (fs *udpFlows) expire(t time.Time) {
+	fs.mu.Lock()
+	var expired []*udpFlow
+	for _, f := range fs.byID {
+		if f.idleSince(t) > fs.idle {
+			expired = append(expired, f)
+		}
+	}
+	fs.mu.Unlock()
+
+	for _, f := range expired {
+		fs.remove(f)
+	}
+}
+
+func (fs *udpFlows) expireLoop(ctx context.Context) {
+	t := time.NewTicker(fs.idle / 2)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			fs.expire(now)
+		}
+	}
+}
+
+func (fs *udpFlows) close() {
+	fs.mu.Lock()
+	var all []*udpFlow
+	for _, f := range fs.byID {
+		all = append(all, f)
+	}
+	fs.mu.Unlock()
+
+	for _, f := range all {
+		fs.remove(f)
+	}
+}
+
+// startUDPTunnel forwards ep over its own data channel, labelled with the remote address only.
+func (egp *EgressProxy) startUDPTunnel(ctx context.Context, ep Endpoint) (err error) {
+	dc, err := egp.peer.CreateDataChannel(networkUDP+"/"+ep.remote, udpDataChannelInit())
+	if err != nil {
+		return fmt.Errorf("create data channel failed: %w", err)
+	}
+	defer dc.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	dcd, err := detach(ctx, dc)
+	if err != nil {
+		return fmt.Errorf("detach datachannel failed: %w", err)
+	}
+	defer dcd.Close()
+
+	pc, err := egp.listeners.packet(ep)
+	if err != nil {
+		return fmt.Errorf("listen to local socket failed: %w", err)
+	}
+
+	// the socket stays open for the next tunnel, so reads are interrupted with a deadline instead.
+	pc.SetReadDeadline(time.Time{})
+	flows := newUDPFlows(egp.udpIdleTimeout)
+	go flows.expireLoop(ctx)
+	go func() {
+		<-ctx.Done()
+		pc.SetReadDeadline(time.Now())
+	}()
+	go func() {
+		defer cancel()
+
+		b := make([]byte, udpHeaderLen+udpMaxDatagram)
+		for {
+			n, err := dcd.Read(b)
+			if err != nil {
+				log.Println("egress: udp: read datachannel error:", err)
+				return
+			}
+			id, payload, err := udpUnpack(b[:n])
+			if err != nil {
+				log.Println("egress: udp: invalid datagram:", err)
+				continue
+			}
+			f := flows.get(id)
+			if f == nil {
+				continue
+			}
+			f.touch()
+			if _, err := pc.WriteTo(payload, f.addr); err != nil {
+				log.Println("egress: udp: write to local client error:", err)
+			}
+		}
+	}()
+
+	// one byte more than carried, so that larger datagrams are noticed rather than truncated.
+	b := make([]byte, udpHeaderLen+udpMaxDatagram+1)
+	for {
+		n, addr, err := pc.ReadFrom(b[udpHeaderLen:])
+		if errors.Is(err, net.ErrClosed) || ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			log.Println("egress: udp: read local socket error:", err)
+			continue
+		}
+		if n > udpMaxDatagram {
+			log.Println("egress: udp: dropping datagram larger than", udpMaxDatagram, "bytes from", addr)
+			continue
+		}
+
+		f, created := flows.getOrCreateByAddr(addr)
+		if created {
+			log.Println("egress: udp: new flow: ", addr)
+		}
+		f.touch()
+		if _, err := dcd.Write(udpPack(b[:udpHeaderLen+n], f.id)); err != nil {
+			log.Println("egress: udp: write datachannel error:", err)
+		}
+	}
+}
+
+func (igp *IngressProxy) createUDPTunnel(ctx context.Context, dc *webrtc.DataChannel, ep Endpoint) (err error) {
+	defer dc.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	dcd, err := detach(ctx, dc)
+	if err != nil {
+		return fmt.Errorf("detach datachannel failed: %w", err)
+	}
+	defer dcd.Close()
+
+	flows := newUDPFlows(igp.udpIdleTimeout)
+	defer flows.close()
+	go flows.expireLoop(ctx)
+
+	b := make([]byte, udpHeaderLen+udpMaxDatagram)
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		n, err := dcd.Read(b)
+		if err != nil {
+			return fmt.Errorf("read datachannel error: %w", err)
+		}
+		id, payload, err := udpUnpack(b[:n])
+		if err != nil {
+			log.Println("ingress: udp: invalid datagram:", err)
+			continue
+		}
+
+		// new flows are dialed aside, so that a slow lookup does not hold the datagrams of the others.
+		f, added := flows.getOrAdd(id)
+		if added {
+			go igp.dialUDPFlow(ctx, dcd, flows, f, ep)
+		}
+		// a refused flow is left to expire, so that it is admitted again once its client stopped for a while.
+		if f.write(payload) {
+			f.touch()
+		}
+	}
+}
+
+// dialUDPFlow connects f to ep, then relays the datagrams coming back. Every flow holds a socket, so it is counted
+// against the limits like a stream.
+func (igp *IngressProxy) dialUDPFlow(ctx context.Context, dcd *datachannel.DataChannel, flows *udpFlows, f *udpFlow, ep Endpoint) {
+	sl, err := igp.limiter.acquire(igp.peerCert, []Endpoint{ep})
+	if err != nil {
+		log.Println("ingress: udp: flow refused:", err)
+		flows.refuse(f)
+		return
+	}
+	conn, upstream, err := igp.dial(ctx, ep)
+	if err != nil {
+		log.Println("ingress: udp: dial error: ", err)
+		sl.release()
+		flows.remove(f)
+		return
+	}
+
+	eps := []Endpoint{ep, upstream, {network: networkUDP, remote: conn.RemoteAddr().String()}}
+	if err = igp.limiter.extend(sl, igp.peerCert, eps); err != nil {
+		log.Println("ingress: udp: flow refused:", err)
+		conn.Close()
+		sl.release()
+		flows.refuse(f)
+		return
+	}
+	if !flows.connect(f, sl.wrapPacket(conn), sl) {
+		conn.Close()
+		sl.release()
+		return
+	}
+	log.Println("ingress: udp: dial success:", ep.remote, upstream.remote)
+	igp.relayUDPFlow(dcd, flows, f)
+}
+
+func (igp *IngressProxy) relayUDPFlow(dcd *datachannel.DataChannel, flows *udpFlows, f *udpFlow) {
+	defer flows.remove(f)
+
+	b := make([]byte, udpHeaderLen+udpMaxDatagram+1)
+	for {
+		n, err := f.conn.Read(b[udpHeaderLen:])
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Println("ingress: udp: read remote error:", err)
+			return
+		}
+		if n > udpMaxDatagram {
+			log.Println("ingress: udp: dropping datagram larger than", udpMaxDatagram, "bytes from", f.conn.RemoteAddr())
+			continue
+		}
+
+		f.touch()
+		if _, err := dcd.Write(udpPack(b[:udpHeaderLen+n], f.id)); err != nil {
+			log.Println("ingress: udp: write datachannel error:", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestUDPServer listens on a loopback UDP socket, returning it along with a connected socket for a flow.
+func newTestUDPServer(t *testing.T) (server *net.UDPConn, dial func() net.Conn) {
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	return server, func() net.Conn {
+		conn, err := net.DialUDP("udp", nil, server.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+}
+
+func TestUDPFlowRateDoesNotDelayOthers(t *testing.T) {
+	server, dial := newTestUDPServer(t)
+	l, err := NewLimiter([]string{"udp/127.0.0.1:*,up=1k"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sl, err := l.acquire(nil, []Endpoint{{network: networkUDP, remote: server.LocalAddr().String()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flows := newUDPFlows(time.Minute)
+	defer flows.close()
+	slow, _ := flows.getOrAdd(1)
+	flows.connect(slow, sl.wrapPacket(dial()), sl)
+	fast, _ := flows.getOrAdd(2)
+	flows.connect(fast, dial(), nil)
+
+	// ten times the rate, which would hold the data channel for seconds if waited for.
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		slow.write(make([]byte, 1000))
+	}
+	fast.write([]byte("fast"))
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("expected the datagrams beyond the rate not to be waited for, took %s", d)
+	}
+
+	var throttled, other int
+	b := make([]byte, 2048)
+	server.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	for {
+		n, err := server.Read(b)
+		if err != nil {
+			break
+		}
+		if n == 1000 {
+			throttled++
+		} else {
+			other++
+		}
+	}
+	if throttled != 1 || other != 1 {
+		t.Fatalf("expected a single datagram of the throttled flow and the one of the other flow, got %d and %d", throttled, other)
+	}
+}
+
+func TestUDPPackUnpack(t *testing.T) {
+	b := append(make([]byte, udpHeaderLen), "payload"...)
+	id, payload, err := udpUnpack(udpPack(b, 0xdeadbeef))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 0xdeadbeef || string(payload) != "payload" {
+		t.Fatalf("got flow %x with %q, want flow deadbeef with %q", id, payload, "payload")
+	}
+
+	// a header alone is an empty datagram.
+	if id, payload, err = udpUnpack([]byte{0, 0, 0, 7}); err != nil || id != 7 || len(payload) != 0 {
+		t.Fatalf("expected an empty datagram of flow 7, got flow %d with %q: %v", id, payload, err)
+	}
+
+	for _, b := range [][]byte{nil, {}, {0}, {0, 0, 0}} {
+		if _, _, err := udpUnpack(b); err == nil {
+			t.Errorf("%x: expected an error", b)
+		}
+	}
+}
+
+func TestUDPFlowPending(t *testing.T) {
+	server, dial := newTestUDPServer(t)
+	flows := newUDPFlows(time.Minute)
+	defer flows.close()
+
+	// the datagrams are copied, as the buffer they are read into is reused for the next ones.
+	f, _ := flows.getOrAdd(1)
+	b := make([]byte, 1)
+	for i := 0; i < udpMaxPending+4; i++ {
+		b[0] = byte(i)
+		if !f.write(b) {
+			t.Fatalf("expected datagram %d to be kept", i)
+		}
+	}
+	if !flows.connect(f, dial(), nil) {
+		t.Fatal("expected the flow to be connected")
+	}
+	f.write([]byte{0xff})
+
+	var got []byte
+	server.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	for {
+		n, err := server.Read(b)
+		if err != nil {
+			break
+		}
+		got = append(got, b[:n]...)
+	}
+	want := []byte{0xff}
+	for i := udpMaxPending - 1; i >= 0; i-- {
+		want = append([]byte{byte(i)}, want...)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %x, want the first %d datagrams followed by the one written once connected, %x", got, udpMaxPending, want)
+	}
+}
+
+func TestUDPFlowRefused(t *testing.T) {
+	server, dial := newTestUDPServer(t)
+	flows := newUDPFlows(time.Minute)
+	defer flows.close()
+
+	f, _ := flows.getOrAdd(1)
+	f.write([]byte("pending"))
+	flows.refuse(f)
+	if f.write([]byte("refused")) {
+		t.Fatal("expected the datagrams of a refused flow to be dropped")
+	}
+	if g, added := flows.getOrAdd(1); added || g != f {
+		t.Fatal("expected a refused flow to be kept until it expires")
+	}
+
+	// another flow is not held by the refused one.
+	other, _ := flows.getOrAdd(2)
+	flows.connect(other, dial(), nil)
+	other.write([]byte("other"))
+	b := make([]byte, 16)
+	server.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if n, err := server.Read(b); err != nil || string(b[:n]) != "other" {
+		t.Fatalf("expected the datagram of the other flow only, got %q: %v", b[:n], err)
+	}
+	if n, err := server.Read(b); err == nil {
+		t.Fatalf("expected no datagram of the refused flow, got %q", b[:n])
+	}
+}
+
+func TestUDPFlowRemove(t *testing.T) {
+	_, dial := newTestUDPServer(t)
+	l, err := NewLimiter([]string{"udp/127.0.0.1:*,streams=1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep := []Endpoint{{network: networkUDP, remote: "127.0.0.1:53"}}
+	flows := newUDPFlows(time.Minute)
+	defer flows.close()
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+	f, created := flows.getOrCreateByAddr(addr)
+	if g, again := flows.getOrCreateByAddr(addr); !created || again || g != f {
+		t.Fatal("expected a single flow per client address")
+	}
+	sl, err := l.acquire(nil, ep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := dial()
+	flows.connect(f, conn, sl)
+
+	flows.remove(f)
+	if flows.get(f.id) != nil {
+		t.Fatal("expected the flow to be removed")
+	}
+	if g, created := flows.getOrCreateByAddr(addr); !created || g.id == f.id {
+		t.Fatalf("expected a new flow for the client, got flow %d again", g.id)
+	}
+	if _, err = conn.Write([]byte("closed")); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected the socket of the flow to be closed, got %v", err)
+	}
+	if sl, err = l.acquire(nil, ep); err != nil {
+		t.Fatalf("expected the flow to be released from the limits, got %v", err)
+	}
+	sl.release()
+
+	// a flow removed while dialed is not connected.
+	f, _ = flows.getOrAdd(7)
+	flows.remove(f)
+	if flows.connect(f, dial(), nil) {
+		t.Fatal("expected a removed flow not to be connected")
+	}
+	if g, added := flows.getOrAdd(7); !added || g == f {
+		t.Fatal("expected a new flow for the ID of a removed one")
+	}
+}
+
+func TestUDPFlowExpire(t *testing.T) {
+	_, dial := newTestUDPServer(t)
+	flows := newUDPFlows(time.Minute)
+	defer flows.close()
+
+	idle, _ := flows.getOrCreateByAddr(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353})
+	active, _ := flows.getOrCreateByAddr(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5354})
+	conn := dial()
+	flows.connect(idle, conn, nil)
+
+	now := time.Now()
+	atomic.StoreInt64(&idle.lastSeen, now.Add(-2*time.Minute).UnixNano())
+	flows.expire(now)
+	if flows.get(idle.id) != nil {
+		t.Fatal("expected the idle flow to expire")
+	}
+	if flows.get(active.id) != active {
+		t.Fatal("expected the active flow to be kept")
+	}
+	if _, err := conn.Write([]byte("expired")); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected the socket of the expired flow to be closed, got %v", err)
+	}
+
+	// a flow is kept until it has been idle for longer than the idle time.
+	flows.expire(now.Add(50 * time.Second))
+	if flows.get(active.id) != active {
+		t.Fatal("expected the flow to be kept within the idle time")
+	}
+	flows.expire(now.Add(70 * time.Second))
+	if flows.get(active.id) != nil {
+		t.Fatal("expected the flow to expire once idle for longer")
+	}
+}
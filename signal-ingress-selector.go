@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ingressSelectionPriority = "priority"
+	ingressSelectionLatency  = "latency"
+
+	ingressProbeTimeout = 5 * time.Second
+
+	// ingressFailHold is how long an ingress whose connection failed is only picked when no other one is usable.
+	ingressFailHold = 30 * time.Second
+)
+
+type ingressHealth int
+
+const (
+	// ingressHealthUnknown is the health of an ingress not probed yet, or whose aetherlight does not report it.
+	ingressHealthUnknown ingressHealth = iota
+	ingressHealthDown
+	ingressHealthUp
+)
+
+// ingressURL is an aetherlight URL of an ingress the egress can connect to.
+type ingressURL struct {
+	url      string
+	group    string
+	priority int
+}
+
+// ingressURLFromString parses s written as '<url>[,priority=<n>][,group=<name>]'.
+func ingressURLFromString(s string) (u ingressURL, err error) {
+	s, opts, _ := strings.Cut(s, ",")
+	if u.url = strings.TrimSuffix(s, "/"); u.url == "" {
+		return u, fmt.Errorf("empty ingress url")
+	}
+	if opts == "" {
+		return
+	}
+
+	for _, kv := range strings.Split(opts, ",") {
+		k, v, _ := strings.Cut(kv, "=")
+		switch k {
+		case "priority":
+			if u.priority, err = strconv.Atoi(v); err != nil {
+				return u, fmt.Errorf("invalid priority: %s", v)
+			}
+		case "group":
+			if v == "" {
+				return u, fmt.Errorf("empty group")
+			}
+			u.group = v
+		default:
+			return u, fmt.Errorf("unknown option: %s", k)
+		}
+	}
+	return
+}
+
+// statusURL returns the URL aetherlight reports whether the ingress is connected at.
+func (u ingressURL) statusURL() string {
+	s := u.url + "/status"
+	if strings.HasPrefix(s, "ws") {
+		s = "http" + strings.TrimPrefix(s, "ws")
+	}
+	return s
+}
+
+// IngressSelector picks the ingress an egress connects to among several aetherlight URLs, from their priority or from
+// the latency of their aetherlight, skipping the ones aetherlight reports as not connected.
+type IngressSelector struct {
+	mode     string
+	interval time.Duration
+
+	mu      sync.Mutex
+	states  []*ingressState
+	updated chan struct{} // closed after every round of probes
+}
+
+type ingressState struct {
+	ingressURL
+	health   ingressHealth
+	rtt      time.Duration
+	failedAt time.Time
+}
+
+func NewIngressSelector(urls []ingressURL, mode string, interval time.Duration) *IngressSelector {
+	s := &IngressSelector{mode: mode, interval: interval, updated: make(chan struct{})}
+	for _, u := range urls {
+		s.states = append(s.states, &ingressState{ingressURL: u})
+	}
+	return s
+}
+
+// Run keeps connect running against the best ingress until ctx is done. When the connection fails, the next best one
+// is picked, and with priority selection, the connection is moved back to a preferred ingress once it is up again.
+func (s *IngressSelector) Run(ctx context.Context, connect func(ctx context.Context, url string) error, onErr func(error)) {
+	if len(s.states) > 1 {
+		go s.probeLoop(ctx)
+	}
+
+	retry(ctx, &backoff{min: reconnectMinBackoff, max: reconnectMaxBackoff}, func(ctx context.Context) (err error) {
+		st, err := s.wait(ctx)
+		if err != nil {
+			return
+		}
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		failingBack := make(chan struct{})
+		if s.mode == ingressSelectionPriority && len(s.states) > 1 {
+			go s.failBack(ctx, st, func() {
+				close(failingBack)
+				cancel()
+			})
+		}
+
+		if len(s.states) > 1 {
+			log.Println("egress: connecting to ingress", st.url)
+		}
+		err = connect(ctx, st.url)
+		select {
+		case <-failingBack:
+			return nil
+		default:
+		}
+		if err != nil {
+			s.mu.Lock()
+			st.failedAt = time.Now()
+			s.mu.Unlock()
+		}
+		return
+	}, onErr)
+}
+
+// wait returns the best ingress, waiting for one to be usable.
+func (s *IngressSelector) wait(ctx context.Context) (st *ingressState, err error) {
+	for {
+		s.mu.Lock()
+		st, updated := s.best(), s.updated
+		s.mu.Unlock()
+		if st != nil {
+			return st, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-updated:
+		}
+	}
+}
+
+// failBack calls stop once an ingress with a better priority than cur is up.
+func (s *IngressSelector) failBack(ctx context.Context, cur *ingressState, stop func()) {
+	for {
+		s.mu.Lock()
+		st, updated := s.best(), s.updated
+		s.mu.Unlock()
+		if st != nil && st.health == ingressHealthUp && st.priority < cur.priority {
+			log.Println("egress: failing back to ingress", st.url)
+			stop()
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-updated:
+		}
+	}
+}
+
+// best returns the ingress to connect to, or nil when every one is down. It must be called with s.mu held.
+func (s *IngressSelector) best() *ingressState {
+	var usable []*ingressState
+	for _, st := range s.states {
+		if st.health != ingressHealthDown || len(s.states) == 1 {
+			usable = append(usable, st)
+		}
+	}
+	if len(usable) == 0 {
+		return nil
+	}
+
+	held := func(st *ingressState) bool { return time.Since(st.failedAt) < ingressFailHold }
+	sort.SliceStable(usable, func(i, j int) bool {
+		a, b := usable[i], usable[j]
+		switch {
+		case held(a) != held(b):
+			return !held(a)
+		case a.health != b.health:
+			return a.health == ingressHealthUp
+		case s.mode == ingressSelectionLatency:
+			return a.rtt < b.rtt
+		}
+		return a.priority < b.priority
+	})
+	return usable[0]
+}
+
+func (s *IngressSelector) probeLoop(ctx context.Context) {
+	t := time.NewTicker(s.interval)
+	defer t.Stop()
+
+	for {
+		s.probeAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// probeAll asks aetherlight for the status of every ingress at once, then wakes up whoever waits for an update.
+func (s *IngressSelector) probeAll(ctx context.Context) {
+	type result struct {
+		health ingressHealth
+		rtt    time.Duration
+	}
+	results := make([]result, len(s.states))
+
+	wg := sync.WaitGroup{}
+	for i, st := range s.states {
+		wg.Add(1)
+		go func(i int, u ingressURL) {
+			defer wg.Done()
+			results[i].health, results[i].rtt = probeIngress(ctx, u)
+		}(i, st.ingressURL)
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, st := range s.states {
+		if st.health != results[i].health {
+			log.Printf("egress: ingress %s is %s", st.url, results[i].health)
+		}
+		if st.health == ingressHealthDown && results[i].health == ingressHealthUp {
+			st.failedAt = time.Time{} // it has reconnected since it failed
+		}
+		st.health, st.rtt = results[i].health, results[i].rtt
+	}
+	close(s.updated)
+	s.updated = make(chan struct{})
+}
+
+// probeIngress returns the health of the ingress at u as reported by its aetherlight, along with the round-trip time
+// of the request.
+func probeIngress(ctx context.Context, u ingressURL) (health ingressHealth, rtt time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, ingressProbeTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.statusURL(), nil)
+	if err != nil {
+		return ingressHealthDown, 0
+	}
+	start := time.Now()
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return ingressHealthDown, 0
+	}
+	defer res.Body.Close()
+	rtt = time.Since(start)
+
+	var status ingressStatus
+	switch {
+	case res.StatusCode == http.StatusNotFound: // an aetherlight without status
+		return ingressHealthUnknown, rtt
+	case res.StatusCode != http.StatusOK:
+		return ingressHealthDown, rtt
+	case json.NewDecoder(res.Body).Decode(&status) != nil:
+		return ingressHealthUnknown, rtt
+	case !status.Connected:
+		return ingressHealthDown, rtt
+	}
+	return ingressHealthUp, rtt
+}
+
+func (h ingressHealth) String() string {
+	switch h {
+	case ingressHealthUp:
+		return "up"
+	case ingressHealthDown:
+		return "down"
+	}
+	return "unknown"
+}
@@ -6,6 +6,8 @@ import (
 	"errors"
 	"io"
 	"log"
+	"sync"
+	"time"
 
 	"github.com/pion/webrtc/v3"
 )
@@ -13,13 +15,19 @@ import (
 var _ SignalICE = &SignalMessenger{}
 var _ SignalIngress = &SignalMessenger{}
 var _ SignalEgress = &SignalMessenger{}
+var _ SignalKeepAlive = &SignalMessenger{}
+
+// signalKeepAliveInterval is how often a signaling channel kept open is written to, well within the idle timeout of
+// aetherlight relays.
+const signalKeepAliveInterval = time.Minute
 
 type SignalMessenger struct {
 	offer  chan string
 	answer chan string
 	ican   chan *webrtc.ICECandidateInit
 
-	io Messenger
+	io  Messenger
+	wmu sync.Mutex // serializes writes, which offers, candidates and keep-alives are sent from different goroutines
 }
 
 func NewSignalMessenger(ctx context.Context, io Messenger) (s *SignalMessenger) {
@@ -63,6 +71,8 @@ func (s *SignalMessenger) readLoop(ctx context.Context) {
 
 		case signalMessengerIceCandidate:
 			chanSend(ctx, s.ican, msg.ICECandidateInit())
+
+		case signalMessengerKeepAlive:
 		}
 	}
 }
@@ -77,7 +87,7 @@ func (s *SignalMessenger) SendOffer(ctx context.Context, offer string) (err erro
 		return
 	}
 
-	return s.io.Write(ctx, b)
+	return s.write(ctx, b)
 }
 
 func (s *SignalMessenger) RecvAnswer(ctx context.Context) (answer string, err error) {
@@ -98,7 +108,7 @@ func (s *SignalMessenger) SendAnswer(ctx context.Context, answer string) (err er
 		return
 	}
 
-	return s.io.Write(ctx, b)
+	return s.write(ctx, b)
 }
 
 func (s *SignalMessenger) SendICECandidate(ctx context.Context, ic *webrtc.ICECandidate) (err error) {
@@ -120,6 +130,21 @@ func (s *SignalMessenger) SendICECandidate(ctx context.Context, ic *webrtc.ICECa
 		return
 	}
 
+	return s.write(ctx, b)
+}
+
+func (s *SignalMessenger) SendKeepAlive(ctx context.Context) (err error) {
+	b, err := json.Marshal(SignalMessengerMessage{Type: signalMessengerKeepAlive})
+	if err != nil {
+		return
+	}
+
+	return s.write(ctx, b)
+}
+
+func (s *SignalMessenger) write(ctx context.Context, b []byte) (err error) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
 	return s.io.Write(ctx, b)
 }
 
@@ -138,6 +163,7 @@ const (
 	signalMessengerOffer        = "OFFER"
 	signalMessengerAnswer       = "ANSWER"
 	signalMessengerIceCandidate = "ICE_CANDIDATE"
+	signalMessengerKeepAlive    = "KEEP_ALIVE" // ignored, it only keeps the channel from being idle
 )
 
 type SignalMessengerMessage struct {
@@ -5,12 +5,15 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/btcsuite/btcutil/base58"
@@ -24,6 +27,9 @@ type ingress struct {
 	id      string
 	conn    net.Conn
 	session *smux.Session
+
+	handshakeTimeout time.Duration
+	idleTimeout      time.Duration
 }
 
 func newIngress(id string, c net.Conn) (mst ingress, err error) {
@@ -35,7 +41,13 @@ func newIngress(id string, c net.Conn) (mst ingress, err error) {
 		return mst, fmt.Errorf("create smux session failed: %w", err)
 	}
 
-	return ingress{id: id, conn: c, session: session}, nil
+	return ingress{
+		id:               id,
+		conn:             c,
+		session:          session,
+		handshakeTimeout: egressHandshakeTimeout,
+		idleTimeout:      egressRelayIdleTimeout,
+	}, nil
 }
 
 func (mst ingress) relay(ctx context.Context, egress io.ReadWriteCloser) (err error) {
@@ -44,7 +56,90 @@ func (mst ingress) relay(ctx context.Context, egress io.ReadWriteCloser) (err er
 		return fmt.Errorf("open session failed: %w", err)
 	}
 
-	return relay(egress, conn)
+	hw := newHandshakeWatch(mst.handshakeTimeout, func() {
+		egress.Close()
+		conn.Close()
+	})
+	defer hw.stop()
+	err = relay(hw.egress(egress), hw.ingress(conn), streamTimeouts{idle: mst.idleTimeout})
+	if hw.expired() {
+		return fmt.Errorf("egress did not complete the handshake in %s", mst.handshakeTimeout)
+	}
+	return
+}
+
+const (
+	// egressHandshakeTimeout is how long an egress may take to complete the noise handshake with the ingress, proving
+	// it holds a valid certificate, before its relay is closed.
+	egressHandshakeTimeout = time.Minute
+
+	// egressRelayIdleTimeout is how long the relay of an egress may carry nothing before it is closed. Connected
+	// egresses send a keep-alive every signalKeepAliveInterval.
+	egressRelayIdleTimeout = 5 * time.Minute
+)
+
+// handshakeWatch closes the relay between an egress and an ingress unless the egress completes the noise handshake in
+// time. The ingress writes the first handshake message, then only writes again once it has validated the answer of
+// the egress, so the handshake is complete once the ingress writes after the egress did.
+type handshakeWatch struct {
+	timer *time.Timer
+	phase int32 // one of the handshake constants below
+	fired int32
+}
+
+const (
+	handshakeWaitingIngress int32 = iota
+	handshakeWaitingEgress
+	handshakeWaitingValidation
+	handshakeComplete
+)
+
+func newHandshakeWatch(timeout time.Duration, closeAll func()) (hw *handshakeWatch) {
+	hw = &handshakeWatch{}
+	hw.timer = time.AfterFunc(timeout, func() {
+		if atomic.LoadInt32(&hw.phase) != handshakeComplete {
+			atomic.StoreInt32(&hw.fired, 1)
+			closeAll()
+		}
+	})
+	return
+}
+
+func (hw *handshakeWatch) egress(rwc io.ReadWriteCloser) io.ReadWriteCloser {
+	return onReadConn{ReadWriteCloser: rwc, onRead: func() {
+		atomic.CompareAndSwapInt32(&hw.phase, handshakeWaitingEgress, handshakeWaitingValidation)
+	}}
+}
+
+func (hw *handshakeWatch) ingress(rwc io.ReadWriteCloser) io.ReadWriteCloser {
+	return onReadConn{ReadWriteCloser: rwc, onRead: func() {
+		if atomic.CompareAndSwapInt32(&hw.phase, handshakeWaitingValidation, handshakeComplete) {
+			hw.timer.Stop()
+			return
+		}
+		atomic.CompareAndSwapInt32(&hw.phase, handshakeWaitingIngress, handshakeWaitingEgress)
+	}}
+}
+
+func (hw *handshakeWatch) stop() {
+	hw.timer.Stop()
+}
+
+func (hw *handshakeWatch) expired() bool {
+	return atomic.LoadInt32(&hw.fired) == 1
+}
+
+// onReadConn calls onRead every time data is read from it.
+type onReadConn struct {
+	io.ReadWriteCloser
+	onRead func()
+}
+
+func (c onReadConn) Read(b []byte) (n int, err error) {
+	if n, err = c.ReadWriteCloser.Read(b); n > 0 {
+		c.onRead()
+	}
+	return
 }
 
 func NewAetherlightHandler() (*chi.Mux, error) {
@@ -59,7 +154,21 @@ func NewAetherlightHandler() (*chi.Mux, error) {
 		w.Write(pub[:])
 	})
 
+	var mu sync.Mutex
 	ingresses := map[string]ingress{}
+
+	// the status of an ingress lets egresses given several ingresses pick one that is connected. It is public on
+	// purpose: egresses are not authenticated by aetherlight but by the ingress itself, and the connect endpoint below
+	// already tells anyone knowing the ingress ID whether it is connected, answering 404 when it is not.
+	r.Get("/ingresses/{ingressID}/status", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		_, ok := ingresses[chi.URLParam(r, "ingressID")]
+		mu.Unlock()
+
+		w.Header().Set("content-type", "application/json")
+		json.NewEncoder(w).Encode(ingressStatus{Connected: ok})
+	})
+
 	r.Get("/ingresses/{ingressID}", func(w http.ResponseWriter, r *http.Request) {
 		ingressID := chi.URLParam(r, "ingressID")
 
@@ -74,7 +183,9 @@ func NewAetherlightHandler() (*chi.Mux, error) {
 			isMaster = true
 		}
 
+		mu.Lock()
 		ing, ok := ingresses[ingressID]
+		mu.Unlock()
 		if !isMaster && !ok {
 			w.WriteHeader(http.StatusNotFound)
 			log.Printf("ingress '%s' not found\n", ingressID)
@@ -102,8 +213,12 @@ func NewAetherlightHandler() (*chi.Mux, error) {
 				return
 			}
 
+			mu.Lock()
 			ingresses[ingressID] = ing
+			mu.Unlock()
 			defer func() {
+				mu.Lock()
+				defer mu.Unlock()
 				if ingd := ingresses[ingressID]; ingd != ing {
 					return
 				}
@@ -113,10 +228,8 @@ func NewAetherlightHandler() (*chi.Mux, error) {
 			log.Printf("ingress '%s' has been disconnected", ingressID)
 
 		case false:
-			var cancel context.CancelFunc
-			ctx, cancel = context.WithTimeout(ctx, 1*time.Minute)
-			defer cancel()
-
+			// once through the handshake, the egress keeps the channel open for as long as it is connected, to restart
+			// ICE when its network changes.
 			err = ing.relay(ctx, websocket.NetConn(ctx, conn, websocket.MessageBinary))
 		}
 
@@ -125,6 +238,8 @@ func NewAetherlightHandler() (*chi.Mux, error) {
 			log.Println("tunnel error: ", err)
 			sc, msg = websocket.CloseStatus(err), err.Error()
 
+		case errors.Is(err, errRelayIdle):
+			sc, msg = websocket.StatusGoingAway, err.Error()
 		case err == nil:
 		case errors.Is(err, ctx.Err()):
 		case errors.Is(err, io.EOF):
@@ -135,6 +250,10 @@ func NewAetherlightHandler() (*chi.Mux, error) {
 	return r, nil
 }
 
+type ingressStatus struct {
+	Connected bool `json:"connected"`
+}
+
 func authenticate(r *http.Request, key *[32]byte, ingressID string) (err error) {
 	defer func() {
 		if e := recover(); e != nil {
@@ -179,7 +298,7 @@ func parseDate(r *http.Request, skew *time.Duration) (date time.Time, err error)
 		sk = *skew
 	}
 	if diff := time.Now().Sub(date); diff.Abs() > sk {
-		return date, fmt.Errorf("too high skew (%t): %s", date, diff)
+		return date, fmt.Errorf("too high skew (%s): %s", date, diff)
 	}
 	return
 }
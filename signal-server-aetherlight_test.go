@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/flynn/noise"
+	"github.com/xtaci/smux"
+)
+
+// newTestIdentities returns the identities of nodes named after names, signed by the same CA.
+func newTestIdentities(t *testing.T, names ...string) (ids []*Identity) {
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &AetherportCertificate{Details: AetherportCertificateDetails{
+		Name: "ca", NotBefore: time.Now().Add(-time.Minute), NotAfter: time.Now().Add(2 * time.Hour), PublicKey: pub, IsCA: true,
+	}}
+	if err = ca.Sign(key, nil); err != nil {
+		t.Fatal(err)
+	}
+	b, err := MarshalAetherportCertificateToPEM(ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := NewCAPoolFromPEM(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range names {
+		sk, err := noise.DH25519.GenerateKeypair(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert := &AetherportCertificate{Details: AetherportCertificateDetails{
+			Name: name, NotBefore: time.Now().Add(-time.Minute), NotAfter: time.Now().Add(time.Hour), PublicKey: sk.Public,
+		}}
+		if err = cert.Sign(key, ca); err != nil {
+			t.Fatal(err)
+		}
+		id, err := NewIdentity(sk.Private, cert, pool)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	return
+}
+
+// testRelay is an egress relayed by aetherlight to the stream accepted by the ingress.
+type testRelay struct {
+	egress net.Conn
+	stream <-chan net.Conn
+	done   <-chan error
+}
+
+func newTestRelay(t *testing.T, handshakeTimeout, idleTimeout time.Duration) *testRelay {
+	// smux registers a stream it opens only once its SYN is written, and a write to a net.Pipe returns only once read,
+	// by when the ingress may already have written to the stream, which would be dropped.
+	server, client := newTestConnPair(t)
+	ing, err := newIngress("test", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ing.handshakeTimeout, ing.idleTimeout = handshakeTimeout, idleTimeout
+	session, err := smux.Server(client, smux.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		session.Close()
+		ing.session.Close()
+	})
+
+	stream := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := session.AcceptStream(); err == nil {
+			stream <- conn
+		}
+	}()
+
+	egress, relayed := net.Pipe()
+	t.Cleanup(func() { egress.Close() })
+	done := make(chan error, 1)
+	go func() { done <- ing.relay(context.Background(), relayed) }()
+	return &testRelay{egress: egress, stream: stream, done: done}
+}
+
+func (tr *testRelay) wait(d time.Duration) (err error, ok bool) {
+	select {
+	case err = <-tr.done:
+		return err, true
+	case <-time.After(d):
+		return nil, false
+	}
+}
+
+// handshake runs the noise handshake of ingress and egress through tr, as the ingress and the egress of aetherlight do.
+func (tr *testRelay) handshake(t *testing.T, ingress, egress *Identity) (im, em *NoisedMessenger) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ierr := make(chan error, 1)
+	go func() {
+		var err error
+		im, err = NewNoisedMessengerI(ctx, NewChunkedIOMessenger(<-tr.stream), ingress)
+		ierr <- err
+	}()
+	em, err := NewNoisedMessengerR(ctx, NewChunkedIOMessenger(tr.egress), egress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-ierr; err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestAetherlightRelayNoiseHandshake(t *testing.T) {
+	ids := newTestIdentities(t, "ingress", "egress")
+	tr := newTestRelay(t, 300*time.Millisecond, 0)
+	im, em := tr.handshake(t, ids[0], ids[1])
+	if im.Peer().Details.Name != "egress" || em.Peer().Details.Name != "ingress" {
+		t.Fatalf("expected each side to be given the certificate of the other, got %s and %s",
+			im.Peer().Details.Name, em.Peer().Details.Name)
+	}
+
+	ctx := context.Background()
+	exchange := func() {
+		if err := em.Write(ctx, []byte("offer")); err != nil {
+			t.Fatal(err)
+		}
+		if b, err := im.Read(ctx); err != nil || string(b) != "offer" {
+			t.Fatalf("expected the offer, got %q: %v", b, err)
+		}
+		if err := im.Write(ctx, []byte("answer")); err != nil {
+			t.Fatal(err)
+		}
+		if b, err := em.Read(ctx); err != nil || string(b) != "answer" {
+			t.Fatalf("expected the answer, got %q: %v", b, err)
+		}
+	}
+	exchange()
+
+	// the handshake was recognized as complete, so the relay outlives its timeout.
+	if err, ok := tr.wait(600 * time.Millisecond); ok {
+		t.Fatalf("expected the relay to stay open after the handshake, got %v", err)
+	}
+	exchange()
+}
+
+func TestAetherlightRelayHandshakeTimeout(t *testing.T) {
+	ids := newTestIdentities(t, "ingress", "egress")
+	tests := map[string]func(tr *testRelay){
+		// the egress never reads the first message of the ingress.
+		"silent": func(tr *testRelay) {
+			go NewNoisedMessengerI(context.Background(), NewChunkedIOMessenger(<-tr.stream), ids[0])
+		},
+		// the egress reads it, but never answers.
+		"reading": func(tr *testRelay) {
+			go NewNoisedMessengerI(context.Background(), NewChunkedIOMessenger(<-tr.stream), ids[0])
+			go NewChunkedIOMessenger(tr.egress).Read(context.Background())
+		},
+		// the egress answers with garbage, which the ingress never writes after.
+		"garbage": func(tr *testRelay) {
+			go func() {
+				stream := <-tr.stream
+				stream.Read(make([]byte, 1024))
+			}()
+			go func() {
+				m := NewChunkedIOMessenger(tr.egress)
+				m.Write(context.Background(), []byte("not a handshake"))
+			}()
+		},
+	}
+	for name, run := range tests {
+		tr := newTestRelay(t, 200*time.Millisecond, 0)
+		start := time.Now()
+		run(tr)
+		err, ok := tr.wait(2 * time.Second)
+		switch {
+		case !ok:
+			t.Errorf("%s: expected the relay to be closed at the handshake timeout", name)
+		case err == nil:
+			t.Errorf("%s: expected the relay to fail", name)
+		case time.Since(start) < 200*time.Millisecond:
+			t.Errorf("%s: expected the relay to be closed at the handshake timeout, closed after %s", name, time.Since(start))
+		}
+	}
+}
+
+func TestAetherlightRelayUntrustedPeer(t *testing.T) {
+	ingress := newTestIdentities(t, "ingress")[0]
+	untrusted := newTestIdentities(t, "egress")[0]
+	tr := newTestRelay(t, time.Minute, 0)
+
+	// each side closes its connection once the handshake fails, as the ingress and the egress of aetherlight do.
+	ierr, eerr := make(chan error, 1), make(chan error, 1)
+	go func() {
+		stream := <-tr.stream
+		_, err := NewNoisedMessengerI(context.Background(), NewChunkedIOMessenger(stream), ingress)
+		stream.Close()
+		ierr <- err
+	}()
+	go func() {
+		_, err := NewNoisedMessengerR(context.Background(), NewChunkedIOMessenger(tr.egress), untrusted)
+		tr.egress.Close()
+		eerr <- err
+	}()
+
+	if err := <-eerr; err == nil {
+		t.Fatal("expected the egress to reject the ingress of another CA")
+	}
+	if err := <-ierr; err == nil {
+		t.Fatal("expected the ingress handshake to fail")
+	}
+	if _, ok := tr.wait(time.Second); !ok {
+		t.Fatal("expected the relay to be closed along with the connections")
+	}
+}
+
+func TestAetherlightRelayIdleTimeout(t *testing.T) {
+	ids := newTestIdentities(t, "ingress", "egress")
+	tr := newTestRelay(t, time.Minute, 300*time.Millisecond)
+	im, em := tr.handshake(t, ids[0], ids[1])
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ingress, egress := NewSignalMessenger(ctx, im), NewSignalMessenger(ctx, em)
+	defer ingress.Close()
+
+	// keep-alives are ignored by the ingress, and keep the relay open for as long as they are sent.
+	kctx, stopKeepAlive := context.WithCancel(ctx)
+	go keepSignalAlive(kctx, egress, 100*time.Millisecond)
+	if err, ok := tr.wait(time.Second); ok {
+		t.Fatalf("expected the keep-alives to keep the relay open, got %v", err)
+	}
+	if err := egress.SendOffer(ctx, "offer"); err != nil {
+		t.Fatal(err)
+	}
+	if offer, err := ingress.RecvOffer(ctx); err != nil || offer != "offer" {
+		t.Fatalf("expected the offer after the keep-alives, got %q: %v", offer, err)
+	}
+
+	stopKeepAlive()
+	start := time.Now()
+	err, ok := tr.wait(2 * time.Second)
+	if !ok || !errors.Is(err, errRelayIdle) {
+		t.Fatalf("expected the relay to be closed once idle, got %v", err)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Fatalf("expected the relay to be closed after the idle timeout, closed after %s", d)
+	}
+}
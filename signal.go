@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"time"
 
 	"github.com/pion/webrtc/v3"
 )
@@ -23,3 +24,23 @@ type SignalICE interface {
 	RecvICECandidate(ctx context.Context) (ic *webrtc.ICECandidateInit, err error)
 	Close() (err error)
 }
+
+type SignalKeepAlive interface {
+	SendKeepAlive(ctx context.Context) (err error)
+}
+
+// keepSignalAlive sends a keep-alive over s every interval, until ctx is done or s fails.
+func keepSignalAlive(ctx context.Context, s SignalKeepAlive, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.SendKeepAlive(ctx); err != nil {
+			return
+		}
+	}
+}
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/rand"
+	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/hashicorp/go-multierror"
 )
@@ -52,22 +58,50 @@ func chanClose[T any](c chan T) (err error) {
 	return
 }
 
-func relay(a io.ReadWriteCloser, b io.ReadWriteCloser) (err error) {
+var (
+	errRelayIdle     = errors.New("idle timeout")
+	errRelayLifetime = errors.New("max lifetime reached")
+)
+
+// streamTimeouts bound how long a relayed connection lives. Zero values mean no limit.
+type streamTimeouts struct {
+	// idle is how long nothing may be read from either side.
+	idle     time.Duration
+	lifetime time.Duration
+}
+
+// min returns the shortest of each timeout of t and o.
+func (t streamTimeouts) min(o streamTimeouts) streamTimeouts {
+	shortest := func(a, b time.Duration) time.Duration {
+		if a == 0 || (b != 0 && b < a) {
+			return b
+		}
+		return a
+	}
+	return streamTimeouts{idle: shortest(t.idle, o.idle), lifetime: shortest(t.lifetime, o.lifetime)}
+}
+
+// relay copies a to b and b to a until either side is closed, or until one of t expires.
+func relay(a io.ReadWriteCloser, b io.ReadWriteCloser, t streamTimeouts) (err error) {
 	var errA, errB error
+	ra, rb, stop := watchRelay(a, b, t)
 
 	wg := sync.WaitGroup{}
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
 		defer b.Close()
-		_, errA = io.Copy(b, a)
+		_, errA = io.Copy(b, ra)
 	}()
 	go func() {
 		defer wg.Done()
 		defer a.Close()
-		_, errB = io.Copy(a, b)
+		_, errB = io.Copy(a, rb)
 	}()
 	wg.Wait()
+	if err = stop(); err != nil {
+		return
+	}
 
 	switch {
 	default:
@@ -78,3 +112,172 @@ func relay(a io.ReadWriteCloser, b io.ReadWriteCloser) (err error) {
 	}
 	return
 }
+
+// watchRelay returns readers of a and b whose reads keep their relay alive, closing both once one of t expires, until
+// the returned stop is called. stop reports the timeout that expired, if any.
+func watchRelay(a, b io.ReadWriteCloser, t streamTimeouts) (ra io.Reader, rb io.Reader, stop func() error) {
+	if t == (streamTimeouts{}) {
+		return a, b, func() error { return nil }
+	}
+
+	w := &relayWatchdog{}
+	stop = w.watch(t, func() {
+		a.Close()
+		b.Close()
+	})
+	return w.reader(a), w.reader(b), stop
+}
+
+// relayWatchdog closes a relay once nothing was read from either side for the idle timeout, or once it has lived
+// for the lifetime.
+type relayWatchdog struct {
+	last int64 // unix nanoseconds of the last read
+}
+
+func (w *relayWatchdog) reader(r io.Reader) io.Reader {
+	return watchedReader{r: r, w: w}
+}
+
+// watch calls closeAll once one of t expires, until the returned stop is called. stop reports which one did.
+func (w *relayWatchdog) watch(t streamTimeouts, closeAll func()) (stop func() error) {
+	start := time.Now()
+	atomic.StoreInt64(&w.last, start.UnixNano())
+	done, result := make(chan struct{}), make(chan error, 1)
+
+	go func() {
+		for {
+			d := time.Duration(math.MaxInt64)
+			if t.lifetime > 0 {
+				if d = time.Until(start.Add(t.lifetime)); d <= 0 {
+					closeAll()
+					result <- fmt.Errorf("%w after %s", errRelayLifetime, t.lifetime)
+					return
+				}
+			}
+			if t.idle > 0 {
+				di := time.Until(time.Unix(0, atomic.LoadInt64(&w.last)).Add(t.idle))
+				if di <= 0 {
+					closeAll()
+					result <- fmt.Errorf("%w after %s", errRelayIdle, t.idle)
+					return
+				}
+				if di < d {
+					d = di
+				}
+			}
+
+			timer := time.NewTimer(d)
+			select {
+			case <-done:
+				timer.Stop()
+				result <- nil
+				return
+			case <-timer.C:
+			}
+		}
+	}()
+	return func() error {
+		close(done)
+		return <-result
+	}
+}
+
+type watchedReader struct {
+	r io.Reader
+	w *relayWatchdog
+}
+
+func (wr watchedReader) Read(b []byte) (n int, err error) {
+	n, err = wr.r.Read(b)
+	if n > 0 {
+		atomic.StoreInt64(&wr.w.last, time.Now().UnixNano())
+	}
+	return
+}
+
+// bufferedConn is a net.Conn whose reads are served by r first, for connections that have been partially parsed.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (bc bufferedConn) Read(b []byte) (n int, err error) {
+	return bc.r.Read(b)
+}
+
+// closeOnDone closes c once ctx is done, unless the returned stop is called first.
+func closeOnDone(ctx context.Context, c io.Closer) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// waitDone waits up to d for ctx to be done, reporting whether it is.
+func waitDone(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+// backoff computes exponentially growing delays between retries, from min up to max, with up to half of each delay
+// randomized so that peers failing together do not retry together.
+type backoff struct {
+	min, max time.Duration
+	cur      time.Duration
+	rand     *rand.Rand
+}
+
+func (b *backoff) next() (d time.Duration) {
+	switch {
+	case b.cur < b.min:
+		b.cur = b.min
+	case b.cur < b.max:
+		b.cur *= 2
+	}
+	if b.cur > b.max {
+		b.cur = b.max
+	}
+	if b.rand == nil {
+		b.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return b.cur/2 + time.Duration(b.rand.Int63n(int64(b.cur/2)+1))
+}
+
+func (b *backoff) reset() {
+	b.cur = 0
+}
+
+// retry runs f until ctx is done, waiting for a backoff between runs. The backoff starts over after a run that lasted
+// longer than its maximum, since the failure is then unrelated to the previous ones.
+func retry(ctx context.Context, b *backoff, f func(ctx context.Context) error, onErr func(error)) {
+	for {
+		start := time.Now()
+		if err := f(ctx); err != nil {
+			onErr(err)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > b.max {
+			b.reset()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(b.next()):
+		}
+	}
+}